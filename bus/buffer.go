@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchSize is the number of positions the Hub accepts in a batch.
+const maxBatchSize = 1000
+
+// batchResult is the answer of the Hub to a batch: the number of positions
+// stored and rejected.
+type batchResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// positionBuffer keeps the positions of a bus that couldn't be sent during a
+// connectivity gap. When it is full the oldest position is dropped; with a
+// size of 0 or less every position is dropped.
+type positionBuffer struct {
+	size      int
+	positions []BusPosition
+	dropped   int
+}
+
+func (b *positionBuffer) add(position BusPosition) {
+	if b.size <= 0 {
+		b.dropped++
+		return
+	}
+	if len(b.positions) >= b.size {
+		b.positions = b.positions[1:]
+		b.dropped++
+	}
+	b.positions = append(b.positions, position)
+}
+
+// flush sends the buffered positions to the batch URL, oldest first. The
+// positions sent are removed, stored or rejected; the others stay buffered
+// if the Hub can't be reached or fails.
+func (b *positionBuffer) flush(ctx context.Context, client *http.Client, batchUrl string, apiKey string) (result batchResult, err error) {
+	for len(b.positions) > 0 {
+		batch := b.positions[:min(len(b.positions), maxBatchSize)]
+		statusCode, body, err := postJSON(ctx, client, batchUrl, deviceHeader(apiKey), batch)
+		if err != nil {
+			return result, err
+		}
+		if statusCode >= http.StatusInternalServerError {
+			return result, fmt.Errorf("unexpected status %d: %s", statusCode, body)
+		}
+		b.positions = b.positions[len(batch):]
+		if statusCode != http.StatusOK {
+			// The Hub refused the whole batch: resending it wouldn't help.
+			result.Rejected += len(batch)
+			continue
+		}
+		var r batchResult
+		if err := json.Unmarshal(body, &r); err != nil {
+			return result, fmt.Errorf("invalid batch result: %w", err)
+		}
+		result.Accepted += r.Accepted
+		result.Rejected += r.Rejected
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// sequences returns the sequences of the buffered positions, oldest first.
+func sequences(b *positionBuffer) []int64 {
+	got := []int64{}
+	for _, p := range b.positions {
+		got = append(got, p.Sequence)
+	}
+	return got
+}
+
+func TestPositionBufferAdd(t *testing.T) {
+	b := &positionBuffer{size: 3}
+	for i := int64(1); i <= 5; i++ {
+		b.add(BusPosition{BusId: "492", Sequence: i})
+	}
+	if got := sequences(b); !reflect.DeepEqual(got, []int64{3, 4, 5}) {
+		t.Errorf("buffered positions = %v, want [3 4 5]", got)
+	}
+	if b.dropped != 2 {
+		t.Errorf("dropped = %d, want 2", b.dropped)
+	}
+}
+
+func TestPositionBufferAddWithoutSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		b := &positionBuffer{size: size}
+		b.add(BusPosition{BusId: "492", Sequence: 1})
+		b.add(BusPosition{BusId: "492", Sequence: 2})
+		if len(b.positions) != 0 || b.dropped != 2 {
+			t.Errorf("size %d: %d positions buffered and %d dropped, want 0 and 2", size, len(b.positions), b.dropped)
+		}
+	}
+}
+
+func TestPositionBufferFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions int
+		status    int
+		result    string
+		want      batchResult
+		wantErr   bool
+		wantLeft  int
+		wantSizes []int
+	}{
+		{name: "one batch", positions: 3, status: http.StatusOK, result: `{"accepted": 2, "rejected": 1}`, want: batchResult{Accepted: 2, Rejected: 1}, wantSizes: []int{3}},
+		{name: "split in batches", positions: maxBatchSize + 1, status: http.StatusOK, result: `{"accepted": 1, "rejected": 0}`, want: batchResult{Accepted: 2}, wantSizes: []int{maxBatchSize, 1}},
+		{name: "batch refused", positions: 2, status: http.StatusBadRequest, result: `{"error": "wrong bus position batch"}`, want: batchResult{Rejected: 2}, wantSizes: []int{2}},
+		{name: "Hub failing", positions: 2, status: http.StatusInternalServerError, wantErr: true, wantLeft: 2, wantSizes: []int{2}},
+		{name: "invalid result", positions: 2, status: http.StatusOK, result: `accepted`, wantErr: true, wantSizes: []int{2}},
+		{name: "nothing buffered", status: http.StatusOK, wantSizes: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := []int{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Api-Key") != "key" {
+					t.Errorf("X-Api-Key = %q", r.Header.Get("X-Api-Key"))
+				}
+				var batch []BusPosition
+				if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+					t.Errorf("batch body: %v", err)
+				}
+				if len(batch) > 0 && batch[0].Sequence != int64(sum(sizes)+1) {
+					t.Errorf("batch starts at sequence %d, want %d", batch[0].Sequence, sum(sizes)+1)
+				}
+				sizes = append(sizes, len(batch))
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.result)
+			}))
+			defer server.Close()
+
+			b := &positionBuffer{size: maxBatchSize * 2}
+			for i := 1; i <= tt.positions; i++ {
+				b.add(BusPosition{BusId: "492", Sequence: int64(i)})
+			}
+			got, err := b.flush(context.Background(), server.Client(), server.URL, "key")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("flush() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("flush() = %+v, want %+v", got, tt.want)
+			}
+			if len(b.positions) != tt.wantLeft {
+				t.Errorf("%d positions left, want %d", len(b.positions), tt.wantLeft)
+			}
+			if !reflect.DeepEqual(sizes, tt.wantSizes) {
+				t.Errorf("batch sizes = %v, want %v", sizes, tt.wantSizes)
+			}
+		})
+	}
+}
+
+func TestPositionBufferFlushUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	b := &positionBuffer{size: 10}
+	b.add(BusPosition{BusId: "492", Sequence: 1})
+	if _, err := b.flush(context.Background(), http.DefaultClient, url, "key"); err == nil {
+		t.Fatal("flush() to an unreachable Hub succeeded")
+	}
+	if len(b.positions) != 1 {
+		t.Errorf("%d positions left, want 1", len(b.positions))
+	}
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
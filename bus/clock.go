@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock is the virtual clock driving the simulation. Simulated time runs
+// speed times faster than the wall clock; at max speed (speed 0) the
+// simulation never waits and simulated time only advances tick by tick.
+type Clock struct {
+	start time.Time
+	speed float64
+}
+
+func NewClock(speed float64) *Clock {
+	return &Clock{
+		start: time.Now(),
+		speed: speed,
+	}
+}
+
+// Time returns the simulated time reached once the given simulated duration has elapsed.
+func (c *Clock) Time(elapsed time.Duration) time.Time {
+	return c.start.Add(elapsed)
+}
+
+// WaitUntil blocks until the given simulated duration has elapsed since the
+// start of the simulation, and reports false if the context was cancelled first.
+// A caller that is late returns immediately, so the simulation catches up.
+func (c *Clock) WaitUntil(ctx context.Context, elapsed time.Duration) bool {
+	if c.speed == 0 {
+		return ctx.Err() == nil
+	}
+	deadline := c.start.Add(time.Duration(float64(elapsed) / c.speed))
+	return sleep(ctx, time.Until(deadline))
+}
+
+func (c *Clock) String() string {
+	if c.speed == 0 {
+		return "max speed"
+	}
+	return strconv.FormatFloat(c.speed, 'f', -1, 64) + "x"
+}
+
+// parseSpeed parses a speed multiplier such as "0.5", "10", "100x" or "max".
+// Max speed is returned as 0.
+func parseSpeed(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid speed %q: must be a positive number or max", value)
+	}
+	if math.IsNaN(speed) || math.IsInf(speed, 0) || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed %q: must be positive", value)
+	}
+	return speed, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseSpeed(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "1", want: 1},
+		{value: "0.5", want: 0.5},
+		{value: "100x", want: 100},
+		{value: " 10X ", want: 10},
+		{value: "max", want: 0},
+		{value: "MAX", want: 0},
+		{value: "0", wantErr: true},
+		{value: "-2", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "fast", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSpeed(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSpeed(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseSpeed(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestClockWaitUntil(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		speed   float64
+		elapsed time.Duration
+		ctx     context.Context
+		want    bool
+		maxWait time.Duration
+	}{
+		{name: "max speed never waits", speed: 0, elapsed: 24 * time.Hour, ctx: context.Background(), want: true, maxWait: 50 * time.Millisecond},
+		{name: "max speed stops when cancelled", speed: 0, elapsed: time.Second, ctx: cancelled, want: false, maxWait: 50 * time.Millisecond},
+		{name: "late caller returns at once", speed: 1, elapsed: -time.Hour, ctx: context.Background(), want: true, maxWait: 50 * time.Millisecond},
+		{name: "scaled wait", speed: 100, elapsed: 2 * time.Second, ctx: context.Background(), want: true, maxWait: 500 * time.Millisecond},
+		{name: "cancelled while waiting", speed: 1, elapsed: time.Hour, ctx: cancelled, want: false, maxWait: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewClock(tt.speed)
+			start := time.Now()
+			if got := clock.WaitUntil(tt.ctx, tt.elapsed); got != tt.want {
+				t.Errorf("WaitUntil() = %v, want %v", got, tt.want)
+			}
+			if waited := time.Since(start); waited > tt.maxWait {
+				t.Errorf("WaitUntil() waited %s, want at most %s", waited, tt.maxWait)
+			}
+		})
+	}
+}
+
+func TestClockTimeAndString(t *testing.T) {
+	clock := NewClock(0)
+	if got := clock.Time(90 * time.Second).Sub(clock.Time(0)); got != 90*time.Second {
+		t.Errorf("Time(90s) - Time(0) = %s, want 1m30s", got)
+	}
+	tests := []struct {
+		speed float64
+		want  string
+	}{
+		{speed: 0, want: "max speed"},
+		{speed: 1, want: "1x"},
+		{speed: 2.5, want: "2.5x"},
+	}
+	for _, tt := range tests {
+		if got := NewClock(tt.speed).String(); got != tt.want {
+			t.Errorf("NewClock(%v).String() = %q, want %q", tt.speed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the simulator settings. Every setting can be given as a
+// command-line flag; the matching environment variable provides its default.
+type Config struct {
+	HubUrl        string
+	HubToken      string
+	PositionUrl   string
+	BatchUrl      string
+	HealthUrl     string
+	FleetPath     string
+	BusId         string
+	Source        string
+	DatasetPath   string
+	Tick          time.Duration
+	Speed         float64
+	Trips         int
+	HubRetries    int
+	HubRetryDelay time.Duration
+	BufferSize    int
+	ApiKeys       map[string]string
+}
+
+func loadConfig(args []string) (cfg Config, err error) {
+	fs := flag.NewFlagSet("bus", flag.ContinueOnError)
+	fs.StringVar(&cfg.HubUrl, "hub-url", envString("HUB_URL", "http://hub:9090"), "base URL of the Hub (env HUB_URL)")
+	fs.StringVar(&cfg.HubToken, "hub-token", envString("HUB_TOKEN", ""), "token of a Hub dispatcher, used to register the buses (env HUB_TOKEN)")
+	fs.StringVar(&cfg.PositionUrl, "position-url", envString("HUB_POSITION_URL", ""), "URL of the v2 ingestion API receiving the bus positions, defaults to <hub-url>/hub/v2/bus/position (env HUB_POSITION_URL)")
+	fs.StringVar(&cfg.BatchUrl, "batch-url", envString("HUB_BATCH_URL", ""), "URL of the batch ingestion API receiving the buffered positions, defaults to <hub-url>/hub/v2/bus/position/batch (env HUB_BATCH_URL)")
+	fs.StringVar(&cfg.HealthUrl, "health-url", envString("HUB_HEALTH_URL", ""), "URL of the Hub health check, defaults to <hub-url>/hub/health (env HUB_HEALTH_URL)")
+	fs.StringVar(&cfg.FleetPath, "fleet", envString("BUS_FLEET", "fleet.json"), "fleet config file, empty to simulate the single bus -bus-id (env BUS_FLEET)")
+	fs.StringVar(&cfg.BusId, "bus-id", envString("BUS_ID", "492"), "bus ID simulated when no fleet config is given (env BUS_ID)")
+	fs.StringVar(&cfg.Source, "source", envString("BUS_SOURCE", sourceDataset), "trip source of buses that don't set their own: dataset, or hub to generate the trip from the Hub time table (env BUS_SOURCE)")
+	fs.StringVar(&cfg.DatasetPath, "dataset", envString("BUS_DATASET", "dataset.json"), "dataset replayed by buses that don't set their own (env BUS_DATASET)")
+	tick, err := envDuration("BUS_TICK", 1*time.Second)
+	if err != nil {
+		return
+	}
+	fs.DurationVar(&cfg.Tick, "tick", tick, "interval between two dataset points (env BUS_TICK)")
+	speed := envString("BUS_SPEED", "1")
+	fs.StringVar(&speed, "speed", speed, "replay speed multiplier such as 0.5, 10 or 100, or max to replay without waiting (env BUS_SPEED)")
+	trips, err := envInt("BUS_TRIPS", 1)
+	if err != nil {
+		return
+	}
+	fs.IntVar(&cfg.Trips, "trips", trips, "times each bus replays its dataset when the fleet config doesn't say (env BUS_TRIPS)")
+	retries, err := envInt("HUB_RETRIES", 20)
+	if err != nil {
+		return
+	}
+	fs.IntVar(&cfg.HubRetries, "hub-retries", retries, "health checks before giving up on the Hub (env HUB_RETRIES)")
+	retryDelay, err := envDuration("HUB_RETRY_DELAY", 2*time.Second)
+	if err != nil {
+		return
+	}
+	fs.DurationVar(&cfg.HubRetryDelay, "hub-retry-delay", retryDelay, "delay between two health checks (env HUB_RETRY_DELAY)")
+	bufferSize, err := envInt("BUS_BUFFER_SIZE", 1000)
+	if err != nil {
+		return
+	}
+	fs.IntVar(&cfg.BufferSize, "buffer-size", bufferSize, "positions kept per bus while the Hub can't be reached, 0 to drop them (env BUS_BUFFER_SIZE)")
+	apiKeys := envString("BUS_API_KEYS", "")
+	fs.StringVar(&apiKeys, "api-keys", apiKeys, "API keys of the buses already registered on the Hub, as comma-separated bus_id=key pairs (env BUS_API_KEYS)")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if cfg.Speed, err = parseSpeed(speed); err != nil {
+		return
+	}
+	if cfg.ApiKeys, err = parseApiKeys(apiKeys); err != nil {
+		return
+	}
+	cfg.HubUrl = strings.TrimSuffix(cfg.HubUrl, "/")
+	if cfg.PositionUrl == "" {
+		cfg.PositionUrl = cfg.HubUrl + "/hub/v2/bus/position"
+	}
+	if cfg.BatchUrl == "" {
+		cfg.BatchUrl = cfg.HubUrl + "/hub/v2/bus/position/batch"
+	}
+	if cfg.HealthUrl == "" {
+		cfg.HealthUrl = cfg.HubUrl + "/hub/health"
+	}
+	err = cfg.validate()
+	return
+}
+
+func (cfg Config) validate() error {
+	urls := []struct{ name, value string }{
+		{"hub-url", cfg.HubUrl},
+		{"position-url", cfg.PositionUrl},
+		{"batch-url", cfg.BatchUrl},
+		{"health-url", cfg.HealthUrl},
+	}
+	for _, u := range urls {
+		if err := validateUrl(u.value); err != nil {
+			return fmt.Errorf("invalid -%s %q: %w", u.name, u.value, err)
+		}
+	}
+	if cfg.FleetPath == "" && cfg.BusId == "" {
+		return fmt.Errorf("either -fleet or -bus-id is required")
+	}
+	if err := validateSource(cfg.Source); err != nil {
+		return fmt.Errorf("invalid -source: %w", err)
+	}
+	if cfg.DatasetPath == "" {
+		return fmt.Errorf("-dataset is required")
+	}
+	if cfg.Tick <= 0 {
+		return fmt.Errorf("invalid -tick %s: must be positive", cfg.Tick)
+	}
+	if cfg.Trips < 1 {
+		return fmt.Errorf("invalid -trips %d: must be at least 1", cfg.Trips)
+	}
+	if cfg.HubRetries < 1 {
+		return fmt.Errorf("invalid -hub-retries %d: must be at least 1", cfg.HubRetries)
+	}
+	if cfg.HubRetryDelay < 0 {
+		return fmt.Errorf("invalid -hub-retry-delay %s: must not be negative", cfg.HubRetryDelay)
+	}
+	if cfg.BufferSize < 0 {
+		return fmt.Errorf("invalid -buffer-size %d: must not be negative", cfg.BufferSize)
+	}
+	return nil
+}
+
+// parseApiKeys reads comma-separated bus_id=key pairs.
+func parseApiKeys(value string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		busId, key, ok := strings.Cut(pair, "=")
+		if !ok || busId == "" || key == "" {
+			return nil, fmt.Errorf("invalid -api-keys entry %q: must be bus_id=key", pair)
+		}
+		keys[busId] = key
+	}
+	return keys, nil
+}
+
+func validateUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+func envString(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return i, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets the environment variables of the configuration for the
+// duration of the test.
+func clearEnv(t *testing.T) {
+	keys := []string{"HUB_URL", "HUB_TOKEN", "HUB_POSITION_URL", "HUB_BATCH_URL", "HUB_HEALTH_URL", "BUS_FLEET", "BUS_ID", "BUS_SOURCE", "BUS_DATASET",
+		"BUS_TICK", "BUS_SPEED", "BUS_TRIPS", "HUB_RETRIES", "HUB_RETRY_DELAY", "BUS_BUFFER_SIZE", "BUS_API_KEYS"}
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		check   func(Config) bool
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			check: func(cfg Config) bool {
+				return cfg.HubUrl == "http://hub:9090" && cfg.PositionUrl == "http://hub:9090/hub/v2/bus/position" &&
+					cfg.BatchUrl == "http://hub:9090/hub/v2/bus/position/batch" && cfg.HealthUrl == "http://hub:9090/hub/health" &&
+					cfg.FleetPath == "fleet.json" && cfg.BusId == "492" && cfg.Tick == time.Second && cfg.Speed == 1 && cfg.Trips == 1 &&
+					cfg.BufferSize == 1000 && len(cfg.ApiKeys) == 0
+			},
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"HUB_URL": "http://localhost:9090/", "BUS_TICK": "500ms", "BUS_SPEED": "max", "BUS_API_KEYS": "492=a, 493=b"},
+			check: func(cfg Config) bool {
+				return cfg.HubUrl == "http://localhost:9090" && cfg.HealthUrl == "http://localhost:9090/hub/health" && cfg.Tick == 500*time.Millisecond &&
+					cfg.Speed == 0 && reflect.DeepEqual(cfg.ApiKeys, map[string]string{"492": "a", "493": "b"})
+			},
+		},
+		{
+			name: "flags over the environment",
+			env:  map[string]string{"BUS_ID": "493", "BUS_TRIPS": "3"},
+			args: []string{"-fleet", "", "-bus-id", "494", "-position-url", "https://gateway.example.com/positions"},
+			check: func(cfg Config) bool {
+				return cfg.FleetPath == "" && cfg.BusId == "494" && cfg.Trips == 3 && cfg.PositionUrl == "https://gateway.example.com/positions"
+			},
+		},
+		{name: "no buffer", args: []string{"-buffer-size", "0"}, check: func(cfg Config) bool { return cfg.BufferSize == 0 }},
+		{name: "invalid environment number", env: map[string]string{"BUS_TRIPS": "two"}, wantErr: true},
+		{name: "invalid environment duration", env: map[string]string{"BUS_TICK": "1"}, wantErr: true},
+		{name: "unknown flag", args: []string{"-verbose"}, wantErr: true},
+		{name: "unexpected argument", args: []string{"dataset.json"}, wantErr: true},
+		{name: "URL without host", args: []string{"-hub-url", "http://"}, wantErr: true},
+		{name: "URL scheme", args: []string{"-health-url", "ftp://hub/health"}, wantErr: true},
+		{name: "no fleet nor bus", args: []string{"-fleet", "", "-bus-id", ""}, wantErr: true},
+		{name: "unknown source", args: []string{"-source", "gps"}, wantErr: true},
+		{name: "no dataset", args: []string{"-dataset", ""}, wantErr: true},
+		{name: "zero tick", args: []string{"-tick", "0s"}, wantErr: true},
+		{name: "invalid speed", args: []string{"-speed", "fast"}, wantErr: true},
+		{name: "no trips", args: []string{"-trips", "0"}, wantErr: true},
+		{name: "no retries", args: []string{"-hub-retries", "0"}, wantErr: true},
+		{name: "negative retry delay", args: []string{"-hub-retry-delay", "-1s"}, wantErr: true},
+		{name: "negative buffer size", args: []string{"-buffer-size", "-1"}, wantErr: true},
+		{name: "invalid API key", args: []string{"-api-keys", "492"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := loadConfig(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			}
+			if !tt.wantErr && !tt.check(cfg) {
+				t.Errorf("loadConfig(%q) = %+v", tt.args, cfg)
+			}
+		})
+	}
+}
+
+func TestParseApiKeys(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "492=a", want: map[string]string{"492": "a"}},
+		{value: " 492=a , ,493=b=c ", want: map[string]string{"492": "a", "493": "b=c"}},
+		{value: "492", wantErr: true},
+		{value: "=a", wantErr: true},
+		{value: "492=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseApiKeys(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseApiKeys(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseApiKeys(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
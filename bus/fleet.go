@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// FleetBus describes a simulated bus: its ID, where its trip comes from, how
+// many times it replays it and how long it waits before starting. The trip
+// is either a recorded dataset or, with the hub source, generated from the
+// time table of TimeTableBusId. Empty fields mean the defaults from the configuration.
+type FleetBus struct {
+	BusId              string `json:"bus_id"`
+	Source             string `json:"source"`
+	Dataset            string `json:"dataset"`
+	TimeTableBusId     string `json:"time_table_bus_id"`
+	StartOffsetSeconds int    `json:"start_offset_seconds"`
+	Trips              int    `json:"trips"`
+}
+
+// Fleet is the composition of the simulated fleet, read from the fleet config file.
+type Fleet struct {
+	Buses []FleetBus `json:"buses"`
+}
+
+func loadFleet(path string, cfg Config) (fleet Fleet, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &fleet); err != nil {
+		return
+	}
+	if len(fleet.Buses) == 0 {
+		return fleet, fmt.Errorf("no buses configured in %s", path)
+	}
+	busIds := make(map[string]bool)
+	for i, bus := range fleet.Buses {
+		if bus.BusId == "" {
+			return fleet, fmt.Errorf("bus %d: missing bus_id", i)
+		}
+		if busIds[bus.BusId] {
+			return fleet, fmt.Errorf("bus %s: duplicate bus_id", bus.BusId)
+		}
+		busIds[bus.BusId] = true
+		if bus.StartOffsetSeconds < 0 {
+			return fleet, fmt.Errorf("bus %s: negative start_offset_seconds", bus.BusId)
+		}
+		if bus.Trips < 0 {
+			return fleet, fmt.Errorf("bus %s: negative trips", bus.BusId)
+		}
+		fleet.Buses[i] = bus.withDefaults(cfg)
+		if err = validateSource(fleet.Buses[i].Source); err != nil {
+			return fleet, fmt.Errorf("bus %s: %w", bus.BusId, err)
+		}
+	}
+	return
+}
+
+// singleBusFleet returns the fleet made of the bus given in the configuration.
+func singleBusFleet(cfg Config) Fleet {
+	bus := FleetBus{BusId: cfg.BusId}
+	return Fleet{Buses: []FleetBus{bus.withDefaults(cfg)}}
+}
+
+func (bus FleetBus) withDefaults(cfg Config) FleetBus {
+	if bus.Source == "" {
+		bus.Source = cfg.Source
+	}
+	if bus.Dataset == "" {
+		bus.Dataset = cfg.DatasetPath
+	}
+	if bus.TimeTableBusId == "" {
+		bus.TimeTableBusId = bus.BusId
+	}
+	if bus.Trips == 0 {
+		bus.Trips = cfg.Trips
+	}
+	return bus
+}
+
+func validateSource(source string) error {
+	if source != sourceDataset && source != sourceHub {
+		return fmt.Errorf("invalid source %q: must be %s or %s", source, sourceDataset, sourceHub)
+	}
+	return nil
+}
+
+func loadDataset(path string) (locations []Location, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &locations); err != nil {
+		return
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("dataset %s is empty", path)
+	}
+	return
+}
+
+// runFleet loads the trip of every bus, then starts one goroutine per bus
+// and blocks until every bus has finished its trips or the context is cancelled.
+func runFleet(ctx context.Context, fleet Fleet, cfg Config) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	datasets := make(map[string][]Location)
+	routes := &hubRoutes{client: client, hubUrl: cfg.HubUrl, tick: cfg.Tick}
+	trips := make(map[string][]Location)
+	for _, bus := range fleet.Buses {
+		var locations []Location
+		var err error
+		switch bus.Source {
+		case sourceHub:
+			locations, err = routes.Route(ctx, bus.TimeTableBusId)
+		default:
+			if _, ok := datasets[bus.Dataset]; !ok {
+				datasets[bus.Dataset], err = loadDataset(bus.Dataset)
+			}
+			locations = datasets[bus.Dataset]
+		}
+		if err != nil {
+			return fmt.Errorf("bus %s: %w", bus.BusId, err)
+		}
+		trips[bus.BusId] = locations
+	}
+
+	clock := NewClock(cfg.Speed)
+
+	log.Printf("Starting a fleet of %d buses at %s", len(fleet.Buses), clock)
+	var wg sync.WaitGroup
+	for _, bus := range fleet.Buses {
+		wg.Add(1)
+		go func(bus FleetBus) {
+			defer wg.Done()
+			simulateBus(ctx, client, clock, cfg, bus, trips[bus.BusId])
+		}(bus)
+	}
+	wg.Wait()
+	return nil
+}
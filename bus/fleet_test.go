@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadFleet(t *testing.T) {
+	cfg := Config{Source: sourceDataset, DatasetPath: "dataset.json", Trips: 2}
+	tests := []struct {
+		name    string
+		json    string
+		want    []FleetBus
+		wantErr bool
+	}{
+		{
+			name: "defaults from the configuration",
+			json: `{"buses": [{"bus_id": "492"}, {"bus_id": "493", "source": "hub", "dataset": "other.json", "time_table_bus_id": "492", "start_offset_seconds": 30, "trips": 1}]}`,
+			want: []FleetBus{
+				{BusId: "492", Source: sourceDataset, Dataset: "dataset.json", TimeTableBusId: "492", Trips: 2},
+				{BusId: "493", Source: sourceHub, Dataset: "other.json", TimeTableBusId: "492", StartOffsetSeconds: 30, Trips: 1},
+			},
+		},
+		{name: "no buses", json: `{"buses": []}`, wantErr: true},
+		{name: "not JSON", json: `buses: 492`, wantErr: true},
+		{name: "missing bus_id", json: `{"buses": [{"dataset": "dataset.json"}]}`, wantErr: true},
+		{name: "duplicate bus_id", json: `{"buses": [{"bus_id": "492"}, {"bus_id": "492"}]}`, wantErr: true},
+		{name: "negative start offset", json: `{"buses": [{"bus_id": "492", "start_offset_seconds": -1}]}`, wantErr: true},
+		{name: "negative trips", json: `{"buses": [{"bus_id": "492", "trips": -1}]}`, wantErr: true},
+		{name: "unknown source", json: `{"buses": [{"bus_id": "492", "source": "gps"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "fleet.json")
+		if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fleet, err := loadFleet(path, cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadFleet() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(fleet.Buses, tt.want) {
+			t.Errorf("%s: loadFleet() = %+v, want %+v", tt.name, fleet.Buses, tt.want)
+		}
+	}
+	if _, err := loadFleet(filepath.Join(t.TempDir(), "missing.json"), cfg); err == nil {
+		t.Errorf("loadFleet() of a missing file: no error")
+	}
+}
+
+func TestSingleBusFleet(t *testing.T) {
+	fleet := singleBusFleet(Config{BusId: "492", Source: sourceHub, DatasetPath: "dataset.json", Trips: 1})
+	want := []FleetBus{{BusId: "492", Source: sourceHub, Dataset: "dataset.json", TimeTableBusId: "492", Trips: 1}}
+	if !reflect.DeepEqual(fleet.Buses, want) {
+		t.Errorf("singleBusFleet() = %+v, want %+v", fleet.Buses, want)
+	}
+}
+
+func TestLoadDataset(t *testing.T) {
+	locations, err := loadDataset("dataset.json")
+	if err != nil || len(locations) == 0 {
+		t.Fatalf("loadDataset(dataset.json) = %d locations, error %v", len(locations), err)
+	}
+	path := filepath.Join(t.TempDir(), "empty.json")
+	if err := os.WriteFile(path, []byte("[]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDataset(path); err == nil {
+		t.Errorf("loadDataset() of an empty dataset: no error")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "math"
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// distance returns the great-circle distance in meters between two locations, using the haversine formula.
+func distance(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	phi1 := latitude1 * math.Pi / 180
+	phi2 := latitude2 * math.Pi / 180
+	deltaPhi := (latitude2 - latitude1) * math.Pi / 180
+	deltaLambda := (longitude2 - longitude1) * math.Pi / 180
+	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// bearing returns the initial direction from the first location to the
+// second, in degrees clockwise from north, from 0 up to 360 excluded.
+func bearing(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	phi1 := latitude1 * math.Pi / 180
+	phi2 := latitude2 * math.Pi / 180
+	deltaLambda := (longitude2 - longitude1) * math.Pi / 180
+	y := math.Sin(deltaLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(deltaLambda)
+	degrees := math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+	if degrees >= 360 {
+		degrees = 0
+	}
+	return degrees
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -18,73 +19,65 @@ type Location struct {
 	IsStop        string `json:"is_stop"`
 }
 
-type BusPostion struct {
-	BusId         string `json:"bus_id"`
-	Latitude      string `json:"latitude"`
-	Longitude     string `json:"longitude"`
-	NextBusStopId string `json:"next_bus_stop_id"`
-	IsBusStop     bool   `json:"is_bus_stop"`
+// BusPosition is a position sent to the Hub v2 ingestion API. The timestamp
+// is the wall clock time of the position, the simulated time is only kept
+// locally; speed and heading are measured in simulated time from the previous
+// position of the trip and left out on its first position.
+type BusPosition struct {
+	BusId         string    `json:"bus_id"`
+	Timestamp     time.Time `json:"timestamp"`
+	SimulatedTime time.Time `json:"-"`
+	Latitude      float64   `json:"latitude"`
+	Longitude     float64   `json:"longitude"`
+	Speed         *float64  `json:"speed,omitempty"`
+	Heading       *float64  `json:"heading,omitempty"`
+	Sequence      int64     `json:"sequence"`
+	NextBusStopId string    `json:"next_bus_stop_id"`
+	IsBusStop     bool      `json:"is_bus_stop"`
 }
 
 func waitForHub(url string, retries int, delay time.Duration) {
-    for i := 0; i < retries; i++ {
-        resp, err := http.Get(url)
-        if err == nil && resp.StatusCode == 200 {
-            log.Println("Hub is ready")
-            return
-        }
-        log.Println("Hub not ready, retrying...")
-        time.Sleep(delay)
-    }
-    log.Fatal("Hub service not available")
+	for i := 0; i < retries; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode == 200 {
+			log.Println("Hub is ready")
+			return
+		}
+		log.Println("Hub not ready, retrying...")
+		time.Sleep(delay)
+	}
+	log.Fatal("Hub service not available")
 }
 
 func main() {
-	data, err := ioutil.ReadFile("dataset.json")
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("Error reading file: %v", err)
+		log.Fatalf("Error reading configuration: %v", err)
 	}
 
-	var locations []Location
-
-	if err := json.Unmarshal(data, &locations); err != nil {
-		log.Fatalf("Error unmarshaling JSON: %v", err)
+	var fleet Fleet
+	if cfg.FleetPath == "" {
+		fleet = singleBusFleet(cfg)
+	} else {
+		fleet, err = loadFleet(cfg.FleetPath, cfg)
+		if err != nil {
+			log.Fatalf("Error loading fleet: %v", err)
+		}
 	}
 
-	waitForHub("http://hub:9090/hub/health", 20, 2*time.Second)
+	waitForHub(cfg.HealthUrl, cfg.HubRetries, cfg.HubRetryDelay)
 
-	// Dev environment: url := "http://localhost:9090/hub/bus/position"
-	url := "http://hub:9090/hub/bus/position"
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for _, loc := range locations {
-		fmt.Printf("Latitude: %s, Longitude: %s\n", loc.Latitude, loc.Longitude)
-		isBusStop, err := strconv.ParseBool(loc.IsStop)
-		if err != nil {
-			panic(err)
-		}
-		payload := BusPostion{
-			BusId:         "492",
-			Latitude:      loc.Latitude,
-			Longitude:     loc.Longitude,
-			NextBusStopId: loc.NextBusStopId,
-			IsBusStop:     isBusStop,
-		}
-		jsonData, err := json.Marshal(payload)
-		if err != nil {
-			panic(err)
-		}
-
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			panic(err)
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println("Status:", resp.Status)
-		fmt.Println("Response:", string(body))
-		time.Sleep(1 * time.Second)
+	if err := runFleet(ctx, fleet, cfg); err != nil {
+		log.Fatalf("Error running fleet: %v", err)
 	}
+	log.Println("Simulation stopped")
 }
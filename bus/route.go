@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	sourceDataset = "dataset"
+	sourceHub     = "hub"
+)
+
+type hubBusStop struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+}
+
+type hubTimeTableEntry struct {
+	BusId       string `json:"bus_id"`
+	BusStopId   string `json:"bus_stop_id"`
+	TimeSeconds int    `json:"time_seconds"`
+}
+
+type routeStop struct {
+	id        string
+	latitude  float64
+	longitude float64
+	time      time.Duration
+}
+
+// hubRoutes builds simulated trips from the bus stops and time tables
+// configured in the Hub. The bus stops are fetched once and shared by all buses.
+type hubRoutes struct {
+	client *http.Client
+	hubUrl string
+	tick   time.Duration
+	stops  map[string]hubBusStop
+}
+
+// Route fetches the time table of the given bus and interpolates one
+// position per tick between consecutive stops, so that the simulated bus
+// reaches each stop time_seconds after the start of the trip.
+func (hr *hubRoutes) Route(ctx context.Context, timeTableBusId string) ([]Location, error) {
+	if hr.stops == nil {
+		var stops []hubBusStop
+		if err := getJSON(ctx, hr.client, hr.hubUrl+"/hub/bus_stop", &stops); err != nil {
+			return nil, fmt.Errorf("error retrieving bus stops: %w", err)
+		}
+		hr.stops = make(map[string]hubBusStop, len(stops))
+		for _, stop := range stops {
+			hr.stops[stop.Id] = stop
+		}
+	}
+
+	var timeTable []hubTimeTableEntry
+	if err := getJSON(ctx, hr.client, hr.hubUrl+"/hub/bus/"+url.PathEscape(timeTableBusId)+"/time_table", &timeTable); err != nil {
+		return nil, fmt.Errorf("error retrieving time table of bus %s: %w", timeTableBusId, err)
+	}
+
+	routeStops := make([]routeStop, 0, len(timeTable))
+	for _, entry := range timeTable {
+		stop, ok := hr.stops[entry.BusStopId]
+		if !ok {
+			return nil, fmt.Errorf("time table of bus %s references unknown bus stop %s", timeTableBusId, entry.BusStopId)
+		}
+		latitude, err := strconv.ParseFloat(stop.Latitude, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bus stop %s: invalid latitude %q", stop.Id, stop.Latitude)
+		}
+		longitude, err := strconv.ParseFloat(stop.Longitude, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bus stop %s: invalid longitude %q", stop.Id, stop.Longitude)
+		}
+		routeStops = append(routeStops, routeStop{
+			id:        stop.Id,
+			latitude:  latitude,
+			longitude: longitude,
+			time:      time.Duration(entry.TimeSeconds) * time.Second,
+		})
+	}
+	if len(routeStops) < 2 {
+		return nil, fmt.Errorf("time table of bus %s has fewer than two stops", timeTableBusId)
+	}
+	sort.Slice(routeStops, func(i, j int) bool {
+		return routeStops[i].time < routeStops[j].time
+	})
+	for i := 1; i < len(routeStops); i++ {
+		if routeStops[i].time == routeStops[i-1].time {
+			return nil, fmt.Errorf("time table of bus %s reaches bus stops %s and %s at the same time", timeTableBusId, routeStops[i-1].id, routeStops[i].id)
+		}
+	}
+	return interpolateRoute(routeStops, hr.tick), nil
+}
+
+// interpolateRoute returns one location per tick. The first tick at or
+// after the arrival time of a stop is reported at the stop itself; the other
+// ticks are placed on the straight line towards the next stop.
+func interpolateRoute(stops []routeStop, tick time.Duration) []Location {
+	var locations []Location
+	last := stops[len(stops)-1]
+	segment := 0
+	for t := stops[0].time; ; t += tick {
+		if t >= last.time {
+			locations = append(locations, stopLocation(last))
+			return locations
+		}
+		for stops[segment+1].time <= t {
+			segment++
+		}
+		from, to := stops[segment], stops[segment+1]
+		if t-from.time < tick {
+			locations = append(locations, stopLocation(from))
+			continue
+		}
+		fraction := float64(t-from.time) / float64(to.time-from.time)
+		locations = append(locations, Location{
+			Latitude:      formatCoordinate(from.latitude + (to.latitude-from.latitude)*fraction),
+			Longitude:     formatCoordinate(from.longitude + (to.longitude-from.longitude)*fraction),
+			NextBusStopId: to.id,
+			IsStop:        "false",
+		})
+	}
+}
+
+func stopLocation(stop routeStop) Location {
+	return Location{
+		Latitude:      formatCoordinate(stop.latitude),
+		Longitude:     formatCoordinate(stop.longitude),
+		NextBusStopId: stop.id,
+		IsStop:        "true",
+	}
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', 6, 64)
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterpolateRoute(t *testing.T) {
+	a := routeStop{id: "A", latitude: 41.0, longitude: 12.0, time: 0}
+	tests := []struct {
+		name  string
+		stops []routeStop
+		tick  time.Duration
+		want  []Location
+	}{
+		{
+			name: "ticks dividing the segments",
+			stops: []routeStop{
+				a,
+				{id: "B", latitude: 41.1, longitude: 12.2, time: 10 * time.Second},
+				{id: "C", latitude: 41.3, longitude: 12.2, time: 20 * time.Second},
+			},
+			tick: 5 * time.Second,
+			want: []Location{
+				{Latitude: "41.000000", Longitude: "12.000000", NextBusStopId: "A", IsStop: "true"},
+				{Latitude: "41.050000", Longitude: "12.100000", NextBusStopId: "B", IsStop: "false"},
+				{Latitude: "41.100000", Longitude: "12.200000", NextBusStopId: "B", IsStop: "true"},
+				{Latitude: "41.200000", Longitude: "12.200000", NextBusStopId: "C", IsStop: "false"},
+				{Latitude: "41.300000", Longitude: "12.200000", NextBusStopId: "C", IsStop: "true"},
+			},
+		},
+		{
+			name: "first tick after an arrival is at the stop",
+			stops: []routeStop{
+				a,
+				{id: "B", latitude: 41.7, longitude: 12.0, time: 7 * time.Second},
+				{id: "C", latitude: 41.7, longitude: 12.7, time: 14 * time.Second},
+			},
+			tick: 5 * time.Second,
+			want: []Location{
+				{Latitude: "41.000000", Longitude: "12.000000", NextBusStopId: "A", IsStop: "true"},
+				{Latitude: "41.500000", Longitude: "12.000000", NextBusStopId: "B", IsStop: "false"},
+				{Latitude: "41.700000", Longitude: "12.000000", NextBusStopId: "B", IsStop: "true"},
+				{Latitude: "41.700000", Longitude: "12.700000", NextBusStopId: "C", IsStop: "true"},
+			},
+		},
+		{
+			name: "tick longer than the trip",
+			stops: []routeStop{
+				a,
+				{id: "B", latitude: 41.1, longitude: 12.1, time: 3 * time.Second},
+			},
+			tick: time.Minute,
+			want: []Location{
+				{Latitude: "41.000000", Longitude: "12.000000", NextBusStopId: "A", IsStop: "true"},
+				{Latitude: "41.100000", Longitude: "12.100000", NextBusStopId: "B", IsStop: "true"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interpolateRoute(tt.stops, tt.tick); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("interpolateRoute() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
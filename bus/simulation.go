@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// busRegistration is a bus registered on the Hub. The Hub answers with the
+// API key of the bus device.
+type busRegistration struct {
+	Id        string `json:"id"`
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+	ApiKey    string `json:"api_key,omitempty"`
+}
+
+// simulateBus registers the bus and replays its dataset trips times, one
+// point per tick of simulated time, until the last trip ends or the context
+// is cancelled.
+func simulateBus(ctx context.Context, client *http.Client, clock *Clock, cfg Config, bus FleetBus, locations []Location) {
+	elapsed := time.Duration(bus.StartOffsetSeconds) * time.Second
+	if elapsed > 0 {
+		log.Printf("Bus %s: starting at %s", bus.BusId, clock.Time(elapsed).Format(time.TimeOnly))
+		if !clock.WaitUntil(ctx, elapsed) {
+			log.Printf("Bus %s: stopped before start", bus.BusId)
+			return
+		}
+	}
+
+	apiKey, err := registerBus(ctx, client, cfg.HubUrl, cfg.HubToken, bus.BusId, locations[0])
+	if err != nil {
+		log.Printf("Bus %s: registration failed: %v", bus.BusId, err)
+		return
+	}
+	if apiKey == "" {
+		apiKey = cfg.ApiKeys[bus.BusId]
+	}
+	if apiKey == "" {
+		log.Printf("Bus %s: already registered and no API key given with -api-keys", bus.BusId)
+		return
+	}
+
+	buffer := &positionBuffer{size: cfg.BufferSize}
+	var sequence int64
+	var timestamp time.Time
+	rejected := 0
+	for trip := 1; trip <= bus.Trips; trip++ {
+		var previous *BusPosition
+		for i, loc := range locations {
+			if trip > 1 || i > 0 {
+				elapsed += cfg.Tick
+				if !clock.WaitUntil(ctx, elapsed) {
+					log.Printf("Bus %s: stopped", bus.BusId)
+					return
+				}
+			}
+			sequence++
+			timestamp = deviceTime(timestamp)
+			payload, err := newBusPosition(bus.BusId, timestamp, clock.Time(elapsed), sequence, loc, previous)
+			if err != nil {
+				log.Printf("Bus %s: skipping point %d: %v", bus.BusId, i, err)
+				continue
+			}
+			previous = &payload
+			if len(buffer.positions) > 0 {
+				buffer.add(payload)
+				if !flushBuffer(ctx, client, cfg, bus.BusId, apiKey, buffer) && ctx.Err() != nil {
+					log.Printf("Bus %s: stopped", bus.BusId)
+					return
+				}
+				continue
+			}
+			statusCode, body, err := postJSON(ctx, client, cfg.PositionUrl, deviceHeader(apiKey), payload)
+			if err == nil && statusCode >= http.StatusInternalServerError {
+				err = fmt.Errorf("unexpected status %d: %s", statusCode, body)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Printf("Bus %s: stopped", bus.BusId)
+					return
+				}
+				if buffer.size <= 0 {
+					log.Printf("Bus %s: error sending position: %v", bus.BusId, err)
+					continue
+				}
+				log.Printf("Bus %s: error sending position, buffering until the Hub is back: %v", bus.BusId, err)
+				buffer.add(payload)
+				continue
+			}
+			if statusCode < 200 || statusCode >= 300 {
+				// The Hub refused the position: resending it wouldn't help.
+				rejected++
+				log.Printf("Bus %s: error sending position, rejected with status %d: %s", bus.BusId, statusCode, body)
+				continue
+			}
+			log.Printf("Bus %s: %s latitude %s, longitude %s, status %d", bus.BusId, clock.Time(elapsed).Format(time.TimeOnly), loc.Latitude, loc.Longitude, statusCode)
+		}
+		log.Printf("Bus %s: trip %d/%d completed", bus.BusId, trip, bus.Trips)
+	}
+	if len(buffer.positions) > 0 && !flushBuffer(ctx, client, cfg, bus.BusId, apiKey, buffer) {
+		log.Printf("Bus %s: %d buffered positions lost", bus.BusId, len(buffer.positions))
+	}
+	if rejected > 0 {
+		log.Printf("Bus %s: %d positions rejected by the Hub", bus.BusId, rejected)
+	}
+}
+
+// deviceTime returns the wall clock time at which a device takes a position,
+// after the time of its previous position. The Hub rejects positions ahead of
+// its clock, so the simulated time, which runs faster, isn't sent.
+func deviceTime(previous time.Time) time.Time {
+	now := time.Now().Truncate(time.Microsecond)
+	if !now.After(previous) {
+		// The Hub stores microseconds: two positions in the same one would be out of order.
+		return previous.Add(time.Microsecond)
+	}
+	return now
+}
+
+// flushBuffer uploads the buffered positions of the bus and reports whether
+// the buffer is empty.
+func flushBuffer(ctx context.Context, client *http.Client, cfg Config, busId string, apiKey string, buffer *positionBuffer) bool {
+	result, err := buffer.flush(ctx, client, cfg.BatchUrl, apiKey)
+	if result.Accepted > 0 || result.Rejected > 0 {
+		log.Printf("Bus %s: uploaded buffered positions, %d accepted, %d rejected", busId, result.Accepted, result.Rejected)
+	}
+	if buffer.dropped > 0 {
+		log.Printf("Bus %s: %d positions dropped from the full buffer", busId, buffer.dropped)
+		buffer.dropped = 0
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Bus %s: %d positions buffered, error sending them: %v", busId, len(buffer.positions), err)
+	}
+	return err == nil
+}
+
+// newBusPosition returns the position of the bus at the dataset point, taken
+// at the wall clock timestamp and at the simulated time. Its speed and
+// heading are measured in simulated time from the previous position when
+// there is one.
+func newBusPosition(busId string, timestamp time.Time, simulatedTime time.Time, sequence int64, loc Location, previous *BusPosition) (BusPosition, error) {
+	isBusStop, err := strconv.ParseBool(loc.IsStop)
+	if err != nil {
+		return BusPosition{}, err
+	}
+	latitude, err := strconv.ParseFloat(loc.Latitude, 64)
+	if err != nil {
+		return BusPosition{}, fmt.Errorf("invalid latitude %q", loc.Latitude)
+	}
+	longitude, err := strconv.ParseFloat(loc.Longitude, 64)
+	if err != nil {
+		return BusPosition{}, fmt.Errorf("invalid longitude %q", loc.Longitude)
+	}
+	position := BusPosition{
+		BusId:         busId,
+		Timestamp:     timestamp,
+		SimulatedTime: simulatedTime,
+		Latitude:      latitude,
+		Longitude:     longitude,
+		Sequence:      sequence,
+		NextBusStopId: loc.NextBusStopId,
+		IsBusStop:     isBusStop,
+	}
+	if previous != nil {
+		if seconds := simulatedTime.Sub(previous.SimulatedTime).Seconds(); seconds > 0 {
+			meters := distance(previous.Latitude, previous.Longitude, latitude, longitude)
+			speed := meters / seconds
+			position.Speed = &speed
+			if meters > 0 {
+				heading := bearing(previous.Latitude, previous.Longitude, latitude, longitude)
+				position.Heading = &heading
+			}
+		}
+	}
+	return position, nil
+}
+
+// registerBus creates the bus on the Hub with the token of a dispatcher, and
+// returns the API key of its device. A bus that is already registered is not
+// an error: its key is then empty.
+func registerBus(ctx context.Context, client *http.Client, hubUrl string, token string, busId string, start Location) (apiKey string, err error) {
+	payload := busRegistration{
+		Id:        busId,
+		Latitude:  start.Latitude,
+		Longitude: start.Longitude,
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	statusCode, body, err := postJSON(ctx, client, hubUrl+"/hub/bus/register", header, payload)
+	if err != nil {
+		return "", err
+	}
+	switch statusCode {
+	case http.StatusCreated:
+		var registered busRegistration
+		if err := json.Unmarshal(body, &registered); err != nil {
+			return "", fmt.Errorf("invalid registration: %w", err)
+		}
+		return registered.ApiKey, nil
+	case http.StatusConflict:
+		return "", nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("status %d, -hub-token must be the token of a dispatcher: %s", statusCode, body)
+	default:
+		return "", fmt.Errorf("unexpected status %d: %s", statusCode, body)
+	}
+}
+
+// deviceHeader returns the header authenticating the requests of a bus device.
+func deviceHeader(apiKey string) http.Header {
+	header := http.Header{}
+	header.Set("X-Api-Key", apiKey)
+	return header
+}
+
+// postJSON posts the payload with the extra header.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, payload any) (statusCode int, body []byte, err error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	return resp.StatusCode, body, nil
+}
+
+// sleep waits for the given duration and reports false if the context was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceTime(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	tests := []struct {
+		name     string
+		previous time.Time
+		min, max time.Time
+	}{
+		{name: "first position", min: now.Add(-time.Second), max: now.Add(time.Second)},
+		{name: "previous position in the past", previous: now.Add(-time.Hour), min: now.Add(-time.Second), max: now.Add(time.Second)},
+		{name: "previous position in the same microsecond", previous: now.Add(time.Hour), min: now.Add(time.Hour + time.Microsecond), max: now.Add(time.Hour + time.Microsecond)},
+	}
+	for _, tt := range tests {
+		got := deviceTime(tt.previous)
+		if got.Before(tt.min) || got.After(tt.max) || !got.After(tt.previous) {
+			t.Errorf("%s: deviceTime() = %v, want between %v and %v", tt.name, got, tt.min, tt.max)
+		}
+		if got.Nanosecond()%1000 != 0 {
+			t.Errorf("%s: deviceTime() = %v, want whole microseconds", tt.name, got)
+		}
+	}
+}
+
+func TestNewBusPositionSpeed(t *testing.T) {
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	from := Location{Latitude: "0", Longitude: "0", IsStop: "false"}
+	to := Location{Latitude: "0.001", Longitude: "0", IsStop: "false"}
+	previous, err := newBusPosition("492", start, start, 1, from, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ten seconds of simulated time, in a millisecond of wall clock time.
+	got, err := newBusPosition("492", start.Add(time.Millisecond), start.Add(10*time.Second), 2, to, &previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := distance(0, 0, 0.001, 0) / 10
+	if got.Speed == nil || *got.Speed != want {
+		t.Errorf("speed = %v, want %v", got.Speed, want)
+	}
+	if got.Heading == nil || *got.Heading != 0 {
+		t.Errorf("heading = %v, want 0", got.Heading)
+	}
+	if !got.Timestamp.Equal(start.Add(time.Millisecond)) {
+		t.Errorf("timestamp = %v, want the wall clock time", got.Timestamp)
+	}
+}
@@ -8,12 +8,9 @@ import io.r2dbc.postgresql.api.PostgresqlConnection;
 import io.r2dbc.postgresql.api.PostgresqlResult;
 import jakarta.annotation.PostConstruct;
 import jakarta.annotation.PreDestroy;
-import java.util.Set;
-import java.util.concurrent.ConcurrentHashMap;
 import org.slf4j.Logger;
 import org.slf4j.LoggerFactory;
 import org.springframework.data.r2dbc.repository.config.EnableR2dbcRepositories;
-import org.springframework.scheduling.annotation.Scheduled;
 import org.springframework.stereotype.Service;
 import reactor.core.publisher.Flux;
 import reactor.core.publisher.Mono;
@@ -28,14 +25,11 @@ public class BusPositionService {
 
   private final Logger logger;
 
-  private final Set<Long> seenIds;
-
   BusPositionService(PostgresqlConnectionFactory connectionFactory, ObjectMapper objectMapper) {
     this.connection =
         Mono.from(connectionFactory.create()).cast(PostgresqlConnection.class).block();
     this.objectMapper = objectMapper;
     this.logger = LoggerFactory.getLogger(BusPositionService.class);
-    this.seenIds = ConcurrentHashMap.newKeySet();
   }
 
   @PostConstruct
@@ -52,11 +46,6 @@ public class BusPositionService {
     connection.close().subscribe();
   }
 
-  @Scheduled(fixedRate = 1000)
-  private void cleanSeenIds() {
-    this.seenIds.clear();
-  }
-
   public Flux<BusPosition> streamBusPositions() {
     return connection
         .getNotifications()
@@ -73,6 +62,6 @@ public class BusPositionService {
               }
               return null;
             })
-        .filter(busPosition -> busPosition != null && seenIds.add(busPosition.id()));
+        .filter(busPosition -> busPosition != null);
   }
 }
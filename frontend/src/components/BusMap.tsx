@@ -16,6 +16,18 @@ function BusMap() {
     isBusStop: boolean;
   }
 
+  interface BusState {
+    bus_id: string;
+    position_id: string;
+    timestamp: string;
+    // The Hub sends the coordinates as decimal strings.
+    latitude: string;
+    longitude: string;
+    next_bus_stop_id: string;
+    is_bus_stop: boolean;
+    staleness_seconds: number;
+  }
+
   interface BusPositionDisplay extends BusPosition {
     position: LatLngTuple;
     time: string;
@@ -29,6 +41,14 @@ function BusMap() {
     position: LatLngTuple;
   }
 
+  interface BusStopNotification {
+    operation: 'INSERT' | 'UPDATE' | 'DELETE';
+    id: string;
+    name: string;
+    latitude: number;
+    longitude: number;
+  }
+
   interface Bus {
     id: string;
     latitude: number;
@@ -145,6 +165,45 @@ function BusMap() {
     return busTimeTables;
   };
 
+  const getLatestBusPositions = async (signal: AbortSignal) => {
+    const headers = {
+      Accepted: 'application/json',
+    };
+    // Dev environment prefix: "http://localhost:9090"
+    const response = await fetch('/hub/bus/position/latest', {
+      method: 'GET',
+      headers,
+      signal,
+    });
+    if (!response.ok) {
+      throw new Error(JSON.stringify(response));
+    }
+    const responseData: BusState[] = await response.json();
+    const latestBusPositions: BusPositionDisplay[] = responseData.map((bs: BusState) => {
+      const latitude = Number(bs.latitude);
+      const longitude = Number(bs.longitude);
+      return {
+        id: Number(bs.position_id),
+        creationtime: bs.timestamp,
+        busId: bs.bus_id,
+        latitude,
+        longitude,
+        nextBusStopId: bs.next_bus_stop_id,
+        isBusStop: bs.is_bus_stop,
+        time: new Date(bs.timestamp).toLocaleTimeString(),
+        position: [latitude, longitude] as LatLngTuple,
+      };
+    });
+    // Positions received from the stream meanwhile are more recent than the snapshot.
+    setBusPositions((current: BusPositionDisplay[]) => [
+      ...current,
+      ...latestBusPositions.filter(
+        (lbp: BusPositionDisplay) =>
+          !current.some((item: BusPositionDisplay) => item.busId === lbp.busId),
+      ),
+    ]);
+  };
+
   const diffInSeconds = (a: Date, b: Date): number => {
     return Math.floor((b.getTime() - a.getTime()) / 1000);
   };
@@ -231,6 +290,10 @@ function BusMap() {
         console.log('Cannot retrieve the Bus entries ' + err.message);
       });
 
+    getLatestBusPositions(signal).catch((err) => {
+      console.log('Cannot retrieve the latest Bus positions ' + err.message);
+    });
+
     // Dev environment: prefix: "http://localhost:8080"
     const busPositionEventSource = new EventSource('/api/bus/position');
     busPositionEventSource.onmessage = (event) => {
@@ -241,20 +304,47 @@ function BusMap() {
           time: new Date(busPosition.creationtime).toLocaleTimeString(),
           position: [busPosition.latitude, busPosition.longitude] as LatLngTuple,
         };
-        if (!busPositions.some((item: BusPositionDisplay) => busPosition.busId === item.busId)) {
-          setBusPositions([...busPositions, busPositionDisplay]);
-        } else {
-          const cleanedBusPositions = busPositions.filter(
-            (item: BusPositionDisplay) => busPosition.busId !== item.busId,
-          );
-          setBusPositions([...cleanedBusPositions, busPositionDisplay]);
-        }
+        setBusPositions((current: BusPositionDisplay[]) => [
+          ...current.filter((item: BusPositionDisplay) => busPosition.busId !== item.busId),
+          busPositionDisplay,
+        ]);
         if (busPositionDisplay.isBusStop) {
           calculateBusTimeDelay(busPositionDisplay);
         }
       }
     };
-    return () => controller.abort();
+
+    // Dev environment prefix: "http://localhost:9090"
+    const busStopEventSource = new EventSource('/hub/bus_stop/stream');
+    const updateBusStop = (event: MessageEvent) => {
+      const busStop: BusStopNotification = JSON.parse(event.data);
+      setBusStopEntries((current: BusStopDisplay[]) => {
+        const existing = current.find((bs: BusStopDisplay) => bs.id === busStop.id);
+        const others = current.filter((bs: BusStopDisplay) => bs.id !== busStop.id);
+        if (busStop.operation === 'DELETE') {
+          return others;
+        }
+        return [
+          ...others,
+          {
+            id: busStop.id,
+            name: busStop.name,
+            latitude: busStop.latitude,
+            longitude: busStop.longitude,
+            position: [busStop.latitude, busStop.longitude] as LatLngTuple,
+            busTimeTables: existing ? existing.busTimeTables : [],
+          },
+        ];
+      });
+    };
+    busStopEventSource.addEventListener('created', updateBusStop);
+    busStopEventSource.addEventListener('updated', updateBusStop);
+    busStopEventSource.addEventListener('deleted', updateBusStop);
+
+    return () => {
+      controller.abort();
+      busStopEventSource.close();
+    };
   }, []);
 
   return (
@@ -0,0 +1,251 @@
+// Package adherence compares the arrivals of the buses at their stops with
+// their time tables.
+//
+// A position linked to a trip is compared with the scheduled time of the trip
+// at the stop. Otherwise the time table of the bus is used, which holds the
+// offset of each stop from the start of the trip: a trip starts when the bus
+// arrives at the first stop of its time table, and the scheduled time of the
+// following stops is the trip start plus their offset. Arrivals before the
+// first trip start of a bus without trips are ignored.
+//
+// The delay is the difference between the arrival and the scheduled time.
+package adherence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"hub/start/database"
+)
+
+const (
+	// queueSize is the number of positions waiting to be tracked before new ones are dropped.
+	queueSize = 1024
+	// timeTableTtl is how long the time tables are cached.
+	timeTableTtl = time.Minute
+	// maxCachedTrips is the number of trip schedules cached before the cache is cleared.
+	maxCachedTrips = 1000
+)
+
+// Position is a bus position, decoded from a bus_position_notification payload.
+type Position struct {
+	Id            json.Number `json:"id"`
+	CreationTime  string      `json:"creationtime"`
+	BusId         string      `json:"busId"`
+	Latitude      float64     `json:"latitude"`
+	Longitude     float64     `json:"longitude"`
+	NextBusStopId string      `json:"nextBusStopId"`
+	IsBusStop     bool        `json:"isBusStop"`
+	TripId        json.Number `json:"tripId"`
+}
+
+// tripSchedule is the scheduled time of a trip at its stops.
+type tripSchedule struct {
+	start time.Time
+	stops map[string]time.Time
+}
+
+// busState is what the tracker knows about a bus.
+type busState struct {
+	atStop    bool
+	stopId    string
+	tripStart time.Time
+}
+
+// Tracker detects the arrivals of the buses at their stops and stores their
+// delay. OnDelay is called with every new delay and the position of the arrival.
+type Tracker struct {
+	dc        *database.DatabaseConnection
+	onDelay   func(delay database.BusStopDelay, position Position)
+	positions chan Position
+
+	// The state is only used by Run.
+	buses      map[string]*busState
+	timeTables map[string]map[string]time.Duration
+	firstStops map[string]string
+	loadedAt   time.Time
+	trips      map[string]tripSchedule
+}
+
+func NewTracker(dc *database.DatabaseConnection, onDelay func(delay database.BusStopDelay, position Position)) *Tracker {
+	return &Tracker{
+		dc:        dc,
+		onDelay:   onDelay,
+		positions: make(chan Position, queueSize),
+		buses:     make(map[string]*busState),
+		trips:     make(map[string]tripSchedule),
+	}
+}
+
+// Observe queues the position of a bus_position_notification payload
+// without blocking. It returns an error if the payload can't be decoded or
+// the queue is full.
+func (t *Tracker) Observe(payload string) error {
+	var position Position
+	if err := json.Unmarshal([]byte(payload), &position); err != nil {
+		return err
+	}
+	select {
+	case t.positions <- position:
+		return nil
+	default:
+		return fmt.Errorf("adherence queue full, position %s dropped", position.Id)
+	}
+}
+
+// Run tracks the queued positions until the context is cancelled.
+func (t *Tracker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case position := <-t.positions:
+			if err := t.track(position); err != nil {
+				fmt.Println("Error while tracking the adherence of bus", position.BusId, err)
+			}
+		}
+	}
+}
+
+func (t *Tracker) track(position Position) error {
+	delay, ok, err := t.arrival(position)
+	if err != nil || !ok {
+		return err
+	}
+	err, delay, created := t.dc.CreateBusStopDelay(delay)
+	if err != nil {
+		return err
+	}
+	if created && t.onDelay != nil {
+		t.onDelay(delay, position)
+	}
+	return nil
+}
+
+// arrival updates the state of the bus with the position and returns the
+// delay to store when the position is an arrival at a scheduled stop.
+func (t *Tracker) arrival(position Position) (database.BusStopDelay, bool, error) {
+	state, err := t.busState(position.BusId)
+	if err != nil {
+		return database.BusStopDelay{}, false, err
+	}
+	arrived := position.IsBusStop && !(state.atStop && state.stopId == position.NextBusStopId)
+	state.atStop, state.stopId = position.IsBusStop, position.NextBusStopId
+	if !arrived {
+		return database.BusStopDelay{}, false, nil
+	}
+
+	arrival, err := time.Parse(time.RFC3339Nano, position.CreationTime)
+	if err != nil {
+		return database.BusStopDelay{}, false, fmt.Errorf("invalid creation time %q", position.CreationTime)
+	}
+
+	var tripStart, scheduled time.Time
+	if tripId := position.TripId.String(); tripId != "" {
+		trip, err := t.tripSchedule(tripId)
+		if err != nil {
+			return database.BusStopDelay{}, false, err
+		}
+		stopTime, ok := trip.stops[position.NextBusStopId]
+		if !ok {
+			return database.BusStopDelay{}, false, nil
+		}
+		tripStart, scheduled = trip.start, stopTime
+	} else {
+		if err := t.loadTimeTables(); err != nil {
+			return database.BusStopDelay{}, false, err
+		}
+		offset, ok := t.timeTables[position.BusId][position.NextBusStopId]
+		if !ok {
+			return database.BusStopDelay{}, false, nil
+		}
+		if position.NextBusStopId == t.firstStops[position.BusId] {
+			state.tripStart = arrival
+		}
+		if state.tripStart.IsZero() {
+			return database.BusStopDelay{}, false, nil
+		}
+		tripStart, scheduled = state.tripStart, state.tripStart.Add(offset)
+	}
+
+	return database.BusStopDelay{
+		BusId:         position.BusId,
+		BusStopId:     position.NextBusStopId,
+		PositionId:    position.Id.String(),
+		TripStart:     tripStart,
+		ScheduledTime: scheduled,
+		ArrivalTime:   arrival,
+		DelaySeconds:  int(arrival.Sub(scheduled).Round(time.Second) / time.Second),
+		TripId:        position.TripId.String(),
+	}, true, nil
+}
+
+// busState returns the state of the bus, resuming its latest trip from the stored delays.
+func (t *Tracker) busState(busId string) (*busState, error) {
+	if state, ok := t.buses[busId]; ok {
+		return state, nil
+	}
+	state := &busState{}
+	err, delays := t.dc.GetBusTripDelays(busId)
+	if err != nil {
+		return nil, err
+	}
+	if len(delays) > 0 {
+		state.tripStart = delays[0].TripStart
+	}
+	t.buses[busId] = state
+	return state, nil
+}
+
+// tripSchedule returns the cached schedule of the trip. A stop visited twice keeps its first visit.
+func (t *Tracker) tripSchedule(tripId string) (tripSchedule, error) {
+	if trip, ok := t.trips[tripId]; ok {
+		return trip, nil
+	}
+	err, trip := t.dc.GetTrip(tripId)
+	if err != nil {
+		return tripSchedule{}, err
+	}
+	schedule := tripSchedule{start: trip.ScheduledStart, stops: make(map[string]time.Time, len(trip.Stops))}
+	for _, ts := range trip.Stops {
+		if _, ok := schedule.stops[ts.BusStopId]; !ok {
+			schedule.stops[ts.BusStopId] = ts.ScheduledTime
+		}
+	}
+	if len(t.trips) >= maxCachedTrips {
+		t.trips = make(map[string]tripSchedule)
+	}
+	t.trips[tripId] = schedule
+	return schedule, nil
+}
+
+// loadTimeTables caches the stop offsets and the first stop of every bus time table.
+func (t *Tracker) loadTimeTables() error {
+	if t.timeTables != nil && time.Since(t.loadedAt) < timeTableTtl {
+		return nil
+	}
+	err, entries := t.dc.GetAllBusTimeTableEntries()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].BusId != entries[j].BusId {
+			return entries[i].BusId < entries[j].BusId
+		}
+		return entries[i].TimeSeconds < entries[j].TimeSeconds
+	})
+	t.timeTables = make(map[string]map[string]time.Duration)
+	t.firstStops = make(map[string]string)
+	for _, btt := range entries {
+		if t.timeTables[btt.BusId] == nil {
+			t.timeTables[btt.BusId] = make(map[string]time.Duration)
+			t.firstStops[btt.BusId] = btt.BusStopId
+		}
+		t.timeTables[btt.BusId][btt.BusStopId] = btt.TimeSeconds * time.Second
+	}
+	t.loadedAt = time.Now()
+	return nil
+}
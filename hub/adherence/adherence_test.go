@@ -0,0 +1,104 @@
+package adherence
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTrackerArrival(t *testing.T) {
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute, second int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second)
+	}
+	// The state is filled in advance so that the tracker doesn't query the database.
+	tracker := &Tracker{
+		buses: map[string]*busState{"1": {}, "2": {}},
+		trips: map[string]tripSchedule{
+			"7": {start: at(9, 0, 0), stops: map[string]time.Time{"A": at(9, 0, 0), "B": at(9, 3, 0)}},
+		},
+		timeTables: map[string]map[string]time.Duration{
+			"1": {"A": 0, "B": 2 * time.Minute, "C": 5 * time.Minute},
+		},
+		firstStops: map[string]string{"1": "A"},
+		loadedAt:   time.Now(),
+	}
+
+	steps := []struct {
+		name      string
+		busId     string
+		tripId    string
+		stopId    string
+		atStop    bool
+		time      time.Time
+		wantDelay int
+		wantStart time.Time
+		want      bool
+	}{
+		{name: "arrival before the first trip start", busId: "1", stopId: "B", atStop: true, time: at(7, 50, 0)},
+		{name: "driving to the first stop", busId: "1", stopId: "A", time: at(7, 58, 0)},
+		{name: "trip start", busId: "1", stopId: "A", atStop: true, time: at(8, 0, 0), want: true, wantDelay: 0, wantStart: at(8, 0, 0)},
+		{name: "still at the stop", busId: "1", stopId: "A", atStop: true, time: at(8, 0, 20)},
+		{name: "driving", busId: "1", stopId: "B", time: at(8, 1, 0)},
+		{name: "late arrival", busId: "1", stopId: "B", atStop: true, time: at(8, 2, 30), want: true, wantDelay: 30, wantStart: at(8, 0, 0)},
+		{name: "stop not in the time table", busId: "1", stopId: "Z", atStop: true, time: at(8, 3, 0)},
+		{name: "early arrival", busId: "1", stopId: "C", atStop: true, time: at(8, 4, 50), want: true, wantDelay: -10, wantStart: at(8, 0, 0)},
+		{name: "next trip start", busId: "1", stopId: "A", atStop: true, time: at(9, 0, 0).Add(600 * time.Millisecond), want: true, wantDelay: 0, wantStart: at(9, 0, 0).Add(600 * time.Millisecond)},
+		{name: "trip arrival", busId: "2", tripId: "7", stopId: "B", atStop: true, time: at(9, 4, 0), want: true, wantDelay: 60, wantStart: at(9, 0, 0)},
+		{name: "stop not in the trip", busId: "2", tripId: "7", stopId: "C", atStop: true, time: at(9, 6, 0)},
+	}
+	for _, step := range steps {
+		position := Position{
+			Id:            "10",
+			CreationTime:  step.time.Format(time.RFC3339Nano),
+			BusId:         step.busId,
+			NextBusStopId: step.stopId,
+			IsBusStop:     step.atStop,
+			TripId:        json.Number(step.tripId),
+		}
+		delay, ok, err := tracker.arrival(position)
+		if err != nil {
+			t.Fatalf("%s: arrival() error = %v", step.name, err)
+		}
+		if ok != step.want {
+			t.Errorf("%s: arrival() = %v, want %v", step.name, ok, step.want)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if delay.DelaySeconds != step.wantDelay || !delay.TripStart.Equal(step.wantStart) {
+			t.Errorf("%s: delay %d s from trip start %v, want %d s from %v", step.name, delay.DelaySeconds, delay.TripStart, step.wantDelay, step.wantStart)
+		}
+		if delay.BusId != step.busId || delay.BusStopId != step.stopId || delay.TripId != step.tripId || delay.PositionId != "10" || !delay.ArrivalTime.Equal(step.time) {
+			t.Errorf("%s: delay = %+v", step.name, delay)
+		}
+	}
+}
+
+func TestTrackerArrivalInvalidTime(t *testing.T) {
+	tracker := &Tracker{buses: map[string]*busState{"1": {}}}
+	_, _, err := tracker.arrival(Position{BusId: "1", NextBusStopId: "A", IsBusStop: true, CreationTime: "yesterday"})
+	if err == nil {
+		t.Error("arrival() with an invalid creation time succeeded")
+	}
+}
+
+func TestTrackerObserve(t *testing.T) {
+	tracker := NewTracker(nil, nil)
+	if err := tracker.Observe(`{"id": 1, "busId": "1", "creationtime": "2026-03-01T08:00:00Z", "isBusStop": true, "tripId": null}`); err != nil {
+		t.Fatalf("Observe() error = %v", err)
+	}
+	if position := <-tracker.positions; position.BusId != "1" || !position.IsBusStop || position.TripId.String() != "" {
+		t.Errorf("Observe() queued %+v", position)
+	}
+	if err := tracker.Observe("{"); err == nil {
+		t.Error("Observe() of an invalid payload succeeded")
+	}
+	for i := 0; i < queueSize; i++ {
+		tracker.positions <- Position{}
+	}
+	if err := tracker.Observe(`{"id": 2}`); err == nil {
+		t.Error("Observe() with a full queue succeeded")
+	}
+}
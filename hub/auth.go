@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/auth"
+)
+
+// requireRole returns a middleware that answers 401 to the requests without
+// a valid bearer token, and 403 to the users whose role doesn't include role.
+func (h *Handler) requireRole(role auth.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.authorize(c, role) {
+			c.Next()
+		}
+	}
+}
+
+// authorize checks the bearer token of the request as requireRole. It
+// aborts the request and reports false when the user isn't allowed.
+func (h *Handler) authorize(c *gin.Context, role auth.Role) bool {
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="hub"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "bearer token required"})
+		return false
+	}
+	claims, err := h.Auth.Validate(strings.TrimSpace(token))
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="hub", error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token", "detail": err.Error()})
+		return false
+	}
+	if !claims.Role.Includes(role) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("role %s required", role)})
+		return false
+	}
+	return true
+}
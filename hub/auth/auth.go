@@ -0,0 +1,122 @@
+// Package auth issues and validates the tokens of the Hub users.
+//
+// A token is a JWT signed with HS256 and the local secret of the Hub. It
+// names its user in the subject and carries one role: a viewer reads the
+// operational data, a dispatcher also runs the fleet and its schedules, and
+// an admin also manages the bus stops and deletes buses. Every role includes
+// the permissions of the roles before it.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// issuer identifies the tokens of the Hub.
+	issuer = "hub"
+	// MinSecretLength is the length in bytes of the shortest secret accepted, the size of a SHA-256 hash.
+	MinSecretLength = 32
+)
+
+// Role is the set of permissions of a user.
+type Role string
+
+// The roles, from the least to the most permissive.
+const (
+	RoleViewer     Role = "viewer"
+	RoleDispatcher Role = "dispatcher"
+	RoleAdmin      Role = "admin"
+)
+
+// ranks orders the roles, each one including the permissions of the lower ones.
+var ranks = map[Role]int{
+	RoleViewer:     1,
+	RoleDispatcher: 2,
+	RoleAdmin:      3,
+}
+
+// ParseRole returns the role of the name.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := ranks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, must be viewer, dispatcher or admin", name)
+	}
+	return role, nil
+}
+
+// Includes reports whether the role has the permissions of the other one.
+func (r Role) Includes(other Role) bool {
+	return ranks[r] > 0 && ranks[r] >= ranks[other]
+}
+
+// Claims are the claims of a token.
+type Claims struct {
+	Role Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Authenticator issues and validates tokens with a secret.
+type Authenticator struct {
+	secret []byte
+}
+
+// NewAuthenticator returns an authenticator using the secret, which must
+// have at least MinSecretLength bytes.
+func NewAuthenticator(secret string) (*Authenticator, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("the secret must have at least %d bytes", MinSecretLength)
+	}
+	return &Authenticator{secret: []byte(secret)}, nil
+}
+
+// Issue returns a token of the subject with the role, valid for ttl.
+func (a *Authenticator) Issue(subject string, role Role, ttl time.Duration) (string, error) {
+	if subject == "" {
+		return "", errors.New("the subject is required")
+	}
+	if _, ok := ranks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+	if ttl <= 0 {
+		return "", errors.New("the validity must be positive")
+	}
+	now := time.Now()
+	claims := Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+// Validate returns the claims of the token if it is signed with the secret,
+// issued by the Hub, not expired and has a known role.
+func (a *Authenticator) Validate(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return a.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ranks[claims.Role]; !ok {
+		return nil, fmt.Errorf("unknown role %q", claims.Role)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
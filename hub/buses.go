@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"hub/start/database"
+)
+
+// maxBusLabelLength is the size of the varchar column of the bus label.
+const maxBusLabelLength = 255
+
+// busPatch holds the fields of a bus to change. A bus put out of service is
+// decommissioned: it can't send positions and can be deleted.
+type busPatch struct {
+	Label     *string      `json:"label"`
+	Latitude  *json.Number `json:"latitude"`
+	Longitude *json.Number `json:"longitude"`
+	InService *bool        `json:"in_service"`
+}
+
+// apply returns the bus with the fields of the patch changed.
+func (p busPatch) apply(b database.Bus) database.Bus {
+	if p.Label != nil {
+		b.Label = *p.Label
+	}
+	if p.Latitude != nil {
+		b.Latitude = p.Latitude.String()
+	}
+	if p.Longitude != nil {
+		b.Longitude = p.Longitude.String()
+	}
+	if p.InService != nil {
+		b.InService = *p.InService
+	}
+	return b
+}
+
+// validateBus checks the label length and the coordinate ranges of a bus.
+func validateBus(b database.Bus) error {
+	if utf8.RuneCountInString(b.Label) > maxBusLabelLength {
+		return fmt.Errorf("label must have at most %d characters", maxBusLabelLength)
+	}
+	latitude, err := strconv.ParseFloat(b.Latitude, 64)
+	if err != nil || math.IsNaN(latitude) || latitude < -90 || latitude > 90 {
+		return fmt.Errorf("latitude must be a number between -90 and 90")
+	}
+	longitude, err := strconv.ParseFloat(b.Longitude, 64)
+	if err != nil || math.IsNaN(longitude) || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("longitude must be a number between -180 and 180")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"hub/start/database"
+)
+
+func TestBusPatchApply(t *testing.T) {
+	stored := database.Bus{Id: "492", Latitude: "41.9096", Longitude: "12.52975", Label: "Line 492", InService: true}
+	tests := []struct {
+		name  string
+		patch string
+		want  database.Bus
+	}{
+		{name: "empty patch", patch: `{}`, want: stored},
+		{name: "label", patch: `{"label": ""}`, want: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "12.52975", InService: true}},
+		{name: "coordinates", patch: `{"latitude": 41.901, "longitude": "12.5016"}`, want: database.Bus{Id: "492", Latitude: "41.901", Longitude: "12.5016", Label: "Line 492", InService: true}},
+		{name: "decommissioned", patch: `{"in_service": false}`, want: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "12.52975", Label: "Line 492"}},
+	}
+	for _, tt := range tests {
+		var p busPatch
+		if err := json.Unmarshal([]byte(tt.patch), &p); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := p.apply(stored); got != tt.want {
+			t.Errorf("%s: apply() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBus(t *testing.T) {
+	tests := []struct {
+		name    string
+		bus     database.Bus
+		wantErr string
+	}{
+		{name: "valid", bus: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "12.52975"}},
+		{name: "longest label", bus: database.Bus{Id: "492", Latitude: "90", Longitude: "-180", Label: strings.Repeat("é", maxBusLabelLength)}},
+		{name: "label too long", bus: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "12.52975", Label: strings.Repeat("é", maxBusLabelLength+1)}, wantErr: "label must have at most 255 characters"},
+		{name: "latitude out of range", bus: database.Bus{Id: "492", Latitude: "-90.5", Longitude: "12.52975"}, wantErr: "latitude must be a number between -90 and 90"},
+		{name: "latitude not a number", bus: database.Bus{Id: "492", Latitude: "north", Longitude: "12.52975"}, wantErr: "latitude must be a number between -90 and 90"},
+		{name: "longitude out of range", bus: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "180.1"}, wantErr: "longitude must be a number between -180 and 180"},
+		{name: "longitude not a number", bus: database.Bus{Id: "492", Latitude: "41.9096", Longitude: "NaN"}, wantErr: "longitude must be a number between -180 and 180"},
+	}
+	for _, tt := range tests {
+		err := validateBus(tt.bus)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: validateBus() error = %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("%s: validateBus() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
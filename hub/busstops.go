@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"hub/start/database"
+)
+
+// maxBusStopLength is the size of the varchar columns of the bus stop ID and name.
+const maxBusStopLength = 36
+
+// busStop is a bus stop sent by the clients. The coordinates can be numbers or strings.
+type busStop struct {
+	Id        string      `json:"id"`
+	Name      string      `json:"name"`
+	Latitude  json.Number `json:"latitude"`
+	Longitude json.Number `json:"longitude"`
+}
+
+// busStopPatch holds the fields of a bus stop to change.
+type busStopPatch struct {
+	Name      *string      `json:"name"`
+	Latitude  *json.Number `json:"latitude"`
+	Longitude *json.Number `json:"longitude"`
+}
+
+func (bs busStop) toDatabase() database.BusStop {
+	return database.BusStop{
+		Id:        bs.Id,
+		Name:      bs.Name,
+		Latitude:  bs.Latitude.String(),
+		Longitude: bs.Longitude.String(),
+	}
+}
+
+// apply returns the bus stop with the fields of the patch changed.
+func (p busStopPatch) apply(bs database.BusStop) database.BusStop {
+	if p.Name != nil {
+		bs.Name = *p.Name
+	}
+	if p.Latitude != nil {
+		bs.Latitude = p.Latitude.String()
+	}
+	if p.Longitude != nil {
+		bs.Longitude = p.Longitude.String()
+	}
+	return bs
+}
+
+// validateBusStop checks the ID and name lengths and the coordinate ranges of a bus stop.
+func validateBusStop(bs database.BusStop) error {
+	if bs.Id == "" || utf8.RuneCountInString(bs.Id) > maxBusStopLength {
+		return fmt.Errorf("id must have 1 to %d characters", maxBusStopLength)
+	}
+	if bs.Name == "" || utf8.RuneCountInString(bs.Name) > maxBusStopLength {
+		return fmt.Errorf("name must have 1 to %d characters", maxBusStopLength)
+	}
+	latitude, err := strconv.ParseFloat(bs.Latitude, 64)
+	if err != nil || math.IsNaN(latitude) || latitude < -90 || latitude > 90 {
+		return fmt.Errorf("latitude must be a number between -90 and 90")
+	}
+	longitude, err := strconv.ParseFloat(bs.Longitude, 64)
+	if err != nil || math.IsNaN(longitude) || longitude < -180 || longitude > 180 {
+		return fmt.Errorf("longitude must be a number between -180 and 180")
+	}
+	return nil
+}
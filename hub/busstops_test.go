@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"hub/start/database"
+)
+
+func TestValidateBusStop(t *testing.T) {
+	valid := database.BusStop{Id: "1", Name: "Tiburtina", Latitude: "41.9096", Longitude: "12.52975"}
+	with := func(change func(*database.BusStop)) database.BusStop {
+		bs := valid
+		change(&bs)
+		return bs
+	}
+	tests := []struct {
+		name    string
+		busStop database.BusStop
+		wantErr string
+	}{
+		{name: "valid", busStop: valid},
+		{name: "longest id and name", busStop: with(func(bs *database.BusStop) {
+			bs.Id, bs.Name = strings.Repeat("é", maxBusStopLength), strings.Repeat("é", maxBusStopLength)
+		})},
+		{name: "poles and antimeridian", busStop: with(func(bs *database.BusStop) { bs.Latitude, bs.Longitude = "-90", "180" })},
+		{name: "no id", busStop: with(func(bs *database.BusStop) { bs.Id = "" }), wantErr: "id must have 1 to 36 characters"},
+		{name: "id too long", busStop: with(func(bs *database.BusStop) { bs.Id = strings.Repeat("é", maxBusStopLength+1) }), wantErr: "id must have 1 to 36 characters"},
+		{name: "no name", busStop: with(func(bs *database.BusStop) { bs.Name = "" }), wantErr: "name must have 1 to 36 characters"},
+		{name: "latitude out of range", busStop: with(func(bs *database.BusStop) { bs.Latitude = "90.1" }), wantErr: "latitude must be a number between -90 and 90"},
+		{name: "latitude not a number", busStop: with(func(bs *database.BusStop) { bs.Latitude = "NaN" }), wantErr: "latitude must be a number between -90 and 90"},
+		{name: "no longitude", busStop: with(func(bs *database.BusStop) { bs.Longitude = "" }), wantErr: "longitude must be a number between -180 and 180"},
+		{name: "longitude out of range", busStop: with(func(bs *database.BusStop) { bs.Longitude = "-180.5" }), wantErr: "longitude must be a number between -180 and 180"},
+	}
+	for _, tt := range tests {
+		err := validateBusStop(tt.busStop)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: validateBusStop() error = %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("%s: validateBusStop() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBusStopPatchApply(t *testing.T) {
+	stored := database.BusStop{Id: "1", Name: "Tiburtina", Latitude: "41.9096", Longitude: "12.52975"}
+	tests := []struct {
+		name  string
+		patch string
+		want  database.BusStop
+	}{
+		{name: "empty patch", patch: `{}`, want: stored},
+		{name: "name", patch: `{"name": "Termini"}`, want: database.BusStop{Id: "1", Name: "Termini", Latitude: "41.9096", Longitude: "12.52975"}},
+		{name: "number coordinates", patch: `{"latitude": 41.901, "longitude": 12.5016}`, want: database.BusStop{Id: "1", Name: "Tiburtina", Latitude: "41.901", Longitude: "12.5016"}},
+		{name: "string coordinate", patch: `{"latitude": "41.901"}`, want: database.BusStop{Id: "1", Name: "Tiburtina", Latitude: "41.901", Longitude: "12.52975"}},
+	}
+	for _, tt := range tests {
+		var p busStopPatch
+		if err := json.Unmarshal([]byte(tt.patch), &p); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := p.apply(stored); got != tt.want {
+			t.Errorf("%s: apply() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
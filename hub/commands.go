@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+	"hub/start/auth"
+	"hub/start/database"
+	"hub/start/gtfs"
+)
+
+// runCommand runs a hub subcommand instead of starting the server.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import-gtfs":
+		return importGtfs(args)
+	case "token":
+		return issueToken(args)
+	default:
+		return fmt.Errorf("unknown command %q, available commands: import-gtfs, token", name)
+	}
+}
+
+// go run . import-gtfs [-dry-run] feed.zip
+func importGtfs(args []string) error {
+	fs := flag.NewFlagSet("import-gtfs", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "validate the feed and report the changes without saving them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hub import-gtfs [-dry-run] feed.zip")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the path of a GTFS zip file")
+	}
+
+	feed, err := gtfs.ReadZip(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid GTFS feed: %w", err)
+	}
+
+	dc, err := database.NewDatabaseConnection()
+	if err != nil {
+		return fmt.Errorf("error while connecting to the database: %w", err)
+	}
+	defer dc.Close()
+	if err := dc.InitDatabase(); err != nil {
+		return fmt.Errorf("error while initializing the database: %w", err)
+	}
+
+	err, report := dc.ImportGtfsFeed(feed, *dryRun)
+	if err != nil {
+		return fmt.Errorf("error while importing the GTFS feed, no change saved: %w", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(report)
+}
+
+// go run . token -subject alice -role dispatcher [-ttl 24h]
+func issueToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	subject := fs.String("subject", "", "user the token is issued to")
+	roleName := fs.String("role", string(auth.RoleViewer), "role of the user: viewer, dispatcher or admin")
+	ttl := fs.Duration("ttl", 24*time.Hour, "validity of the token")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hub token -subject name [-role viewer|dispatcher|admin] [-ttl 24h]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *subject == "" {
+		fs.Usage()
+		return fmt.Errorf("expected a subject and no arguments")
+	}
+	role, err := auth.ParseRole(*roleName)
+	if err != nil {
+		return err
+	}
+
+	_ = godotenv.Load()
+	authenticator, err := auth.NewAuthenticator(os.Getenv("AUTH_JWT_SECRET"))
+	if err != nil {
+		return fmt.Errorf("invalid AUTH_JWT_SECRET: %w", err)
+	}
+	token, err := authenticator.Issue(*subject, role, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
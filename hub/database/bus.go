@@ -0,0 +1,200 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// ErrBusInService is returned when deleting a bus that hasn't been decommissioned.
+var ErrBusInService = errors.New("bus is in service")
+
+// BusArchive is a deleted bus. Its time table, positions and delays are
+// archived with the same ArchiveId.
+type BusArchive struct {
+	ArchiveId string `json:"archive_id"`
+	BusId     string `json:"bus_id"`
+	Positions int    `json:"positions"`
+	Delays    int    `json:"delays"`
+}
+
+// createBusServiceColumns adds the label of the buses and whether they are in service.
+func (dc DatabaseConnection) createBusServiceColumns() (err error) {
+	sqlStmt := `ALTER TABLE bus ADD COLUMN IF NOT EXISTS label varchar (255) NOT NULL DEFAULT '';
+				ALTER TABLE bus ADD COLUMN IF NOT EXISTS in_service bool NOT NULL DEFAULT true;
+				ALTER TABLE bus ADD COLUMN IF NOT EXISTS decommissioned_at timestamp;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createBusArchiveTables creates the tables keeping the deleted buses and
+// their history. They don't reference the live tables, so that the bus
+// stops and trips of an archived bus can be deleted. The archived positions
+// keep the device columns of createBusPositionDeviceColumns.
+func (dc DatabaseConnection) createBusArchiveTables() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_archive
+				(
+					archive_id bigserial NOT NULL,
+					archived_at timestamp NOT NULL DEFAULT NOW(),
+					id varchar (36) NOT NULL,
+					latitude DOUBLE PRECISION NOT NULL,
+					longitude DOUBLE PRECISION NOT NULL,
+					route_id varchar (36),
+					label varchar (255) NOT NULL,
+					decommissioned_at timestamp,
+					PRIMARY KEY(archive_id)
+				);
+				CREATE TABLE IF NOT EXISTS bus_time_table_archive
+				(
+					archive_id bigint NOT NULL REFERENCES bus_archive(archive_id) ON DELETE CASCADE,
+					bus_stop_id varchar (36) NOT NULL,
+					time_seconds INTEGER NOT NULL,
+					PRIMARY KEY(archive_id, bus_stop_id)
+				);
+				CREATE TABLE IF NOT EXISTS bus_position_archive
+				(
+					archive_id bigint NOT NULL REFERENCES bus_archive(archive_id) ON DELETE CASCADE,
+					id bigint NOT NULL,
+					creationtime timestamp NOT NULL,
+					latitude DOUBLE PRECISION NOT NULL,
+					longitude DOUBLE PRECISION NOT NULL,
+					next_bus_stop_id varchar (36) NOT NULL,
+					is_bus_stop bool NOT NULL,
+					trip_id bigint,
+					PRIMARY KEY(archive_id, id)
+				);
+				ALTER TABLE bus_position_archive ADD COLUMN IF NOT EXISTS received_time timestamp;
+				UPDATE bus_position_archive SET received_time = creationtime WHERE received_time IS NULL;
+				ALTER TABLE bus_position_archive ALTER COLUMN received_time SET NOT NULL;
+				ALTER TABLE bus_position_archive ADD COLUMN IF NOT EXISTS speed DOUBLE PRECISION;
+				ALTER TABLE bus_position_archive ADD COLUMN IF NOT EXISTS heading DOUBLE PRECISION;
+				ALTER TABLE bus_position_archive ADD COLUMN IF NOT EXISTS accuracy DOUBLE PRECISION;
+				ALTER TABLE bus_position_archive ADD COLUMN IF NOT EXISTS sequence bigint;
+				CREATE TABLE IF NOT EXISTS bus_stop_delay_archive
+				(
+					archive_id bigint NOT NULL REFERENCES bus_archive(archive_id) ON DELETE CASCADE,
+					id bigint NOT NULL,
+					bus_stop_id varchar (36) NOT NULL,
+					position_id bigint NOT NULL,
+					trip_start timestamp NOT NULL,
+					scheduled_time timestamp NOT NULL,
+					arrival_time timestamp NOT NULL,
+					delay_seconds INTEGER NOT NULL,
+					trip_id bigint,
+					PRIMARY KEY(archive_id, id)
+				);`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// GetBus returns the bus, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) GetBus(busId string) (err error, b Bus) {
+	err = dc.Db.QueryRow("SELECT id, latitude, longitude, COALESCE(route_id, ''), label, in_service, decommissioned_at FROM bus WHERE id = $1", busId).Scan(
+		&b.Id,
+		&b.Latitude,
+		&b.Longitude,
+		&b.RouteId,
+		&b.Label,
+		&b.InService,
+		&b.DecommissionedAt,
+	)
+	return
+}
+
+// GetBusesInService returns whether each of the buses that exist is in service.
+func (dc DatabaseConnection) GetBusesInService(busIds []string) (error, map[string]bool) {
+	rows, err := dc.Db.Query("SELECT id, in_service FROM bus WHERE id = ANY($1::varchar[])", pq.Array(busIds))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	inService := make(map[string]bool)
+	for rows.Next() {
+		var busId string
+		var active bool
+		if err := rows.Scan(&busId, &active); err != nil {
+			return err, nil
+		}
+		inService[busId] = active
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, inService
+}
+
+// UpdateBus replaces the location, label and service state of the bus. The
+// decommission time is set when the bus goes out of service and cleared when
+// it comes back. It returns sql.ErrNoRows if the bus doesn't exist.
+func (dc DatabaseConnection) UpdateBus(b Bus) error {
+	result, err := dc.Db.Exec(`UPDATE bus SET latitude = $2, longitude = $3, label = $4, in_service = $5,
+					decommissioned_at = CASE WHEN $5 THEN NULL WHEN in_service THEN LOCALTIMESTAMP ELSE decommissioned_at END
+				WHERE id = $1`, b.Id, b.Latitude, b.Longitude, b.Label, b.InService)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteBus archives the bus with its time table, positions and delays, and
+// deletes them with its trips. The bus must be out of service: it returns
+// ErrBusInService otherwise, and sql.ErrNoRows if the bus doesn't exist.
+func (dc DatabaseConnection) DeleteBus(busId string) (err error, archive BusArchive) {
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		var inService bool
+		if err := tx.QueryRow("SELECT in_service FROM bus WHERE id = $1 FOR UPDATE", busId).Scan(&inService); err != nil {
+			return err
+		}
+		if inService {
+			return ErrBusInService
+		}
+		archive.BusId = busId
+		err := tx.QueryRow(`INSERT INTO bus_archive (id, latitude, longitude, route_id, label, decommissioned_at)
+				SELECT id, latitude, longitude, route_id, label, decommissioned_at FROM bus WHERE id = $1
+				RETURNING archive_id`, busId).Scan(&archive.ArchiveId)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO bus_time_table_archive (archive_id, bus_stop_id, time_seconds)
+				SELECT $1, bus_stop_id, time_seconds FROM bus_time_table WHERE bus_id = $2`, archive.ArchiveId, busId); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`INSERT INTO bus_position_archive (archive_id, id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, trip_id, received_time, speed, heading, accuracy, sequence)
+				SELECT $1, id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, trip_id, received_time, speed, heading, accuracy, sequence FROM bus_position WHERE bus_id = $2`, archive.ArchiveId, busId)
+		if err != nil {
+			return err
+		}
+		positions, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		archive.Positions = int(positions)
+		result, err = tx.Exec(`INSERT INTO bus_stop_delay_archive (archive_id, id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, trip_id)
+				SELECT $1, id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, trip_id FROM bus_stop_delay WHERE bus_id = $2`, archive.ArchiveId, busId)
+		if err != nil {
+			return err
+		}
+		delays, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		archive.Delays = int(delays)
+
+		for _, table := range []string{"bus_stop_delay", "bus_latest_position", "bus_position", "trip", "bus_time_table"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE bus_id = $1", busId); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("DELETE FROM bus WHERE id = $1", busId)
+		return err
+	})
+	return
+}
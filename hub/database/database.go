@@ -2,18 +2,27 @@
 package database
 
 import (
+   "context"
    "database/sql"
+   "errors"
    "fmt"
    "github.com/joho/godotenv"
-   _ "github.com/lib/pq"
+   "github.com/lib/pq"
    "os"
    "strconv"
    "time"
 )
 
+// ErrBusStopExists is returned when creating a bus stop with the ID of an existing one.
+var ErrBusStopExists = errors.New("bus stop already exists")
+
+// ErrBusStopReferenced is returned when deleting a bus stop still referenced by other rows.
+var ErrBusStopReferenced = errors.New("bus stop is referenced")
+
 // DatabaseConnection implements the PostgreSQL client.
 type DatabaseConnection struct {
-	Db *sql.DB
+	Db  *sql.DB
+	url string
 }
 
 type BusStop struct {
@@ -27,6 +36,10 @@ type Bus struct {
 	Id string `json:"id"`
 	Latitude string `json:"latitude"`
     Longitude string `json:"longitude"`
+	RouteId string `json:"route_id,omitempty"`
+	Label string `json:"label"`
+	InService bool `json:"in_service"`
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"`
 }
 
 type BusTimeTable struct {
@@ -34,6 +47,58 @@ type BusTimeTable struct {
 	BusStopId string `json:"bus_stop_id"`
 	TimeSeconds time.Duration `json:"time_seconds"`
 	Timestamp time.Time `json:"timestamp"`
+	TripId string `json:"trip_id,omitempty"`
+}
+
+// BusState is the latest position of a bus. StalenessSeconds is the time
+// elapsed since the position was taken.
+type BusState struct {
+	BusId string `json:"bus_id"`
+	PositionId string `json:"position_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Latitude string `json:"latitude"`
+	Longitude string `json:"longitude"`
+	NextBusStopId string `json:"next_bus_stop_id"`
+	IsBusStop bool `json:"is_bus_stop"`
+	TripId string `json:"trip_id,omitempty"`
+	StalenessSeconds float64 `json:"staleness_seconds"`
+}
+
+// BusPositionKey identifies a position in the order of the positions of a bus.
+type BusPositionKey struct {
+	CreationTime time.Time
+	Id int64
+}
+
+// BusPositionQuery selects the positions of a bus created in [From, To),
+// zero values meaning unbounded, following the position After when set.
+type BusPositionQuery struct {
+	From time.Time
+	To time.Time
+	After *BusPositionKey
+	Limit int
+	Descending bool
+}
+
+// BusStopArrival is the time a bus reached a bus stop.
+type BusStopArrival struct {
+	BusStopId string `json:"bus_stop_id"`
+	Time time.Time `json:"time"`
+}
+
+// BusStopDelay is the delay of a bus arriving at a bus stop, compared with
+// the time scheduled by its time table for the trip started at TripStart.
+// A negative delay is an early arrival.
+type BusStopDelay struct {
+	Id string `json:"id"`
+	BusId string `json:"bus_id"`
+	BusStopId string `json:"bus_stop_id"`
+	PositionId string `json:"position_id"`
+	TripStart time.Time `json:"trip_start"`
+	ScheduledTime time.Time `json:"scheduled_time"`
+	ArrivalTime time.Time `json:"arrival_time"`
+	DelaySeconds int `json:"delay_seconds"`
+	TripId string `json:"trip_id,omitempty"`
 }
 
 type BusPosition struct {
@@ -44,6 +109,12 @@ type BusPosition struct {
     Longitude string `json:"longitude"`
 	NextBusStopId string `json:"next_bus_stop_id"`
 	IsBusStop bool `json:"is_bus_stop"`
+	TripId string `json:"trip_id,omitempty"`
+	ReceivedTime *time.Time `json:"received_time,omitempty"`
+	Speed *float64 `json:"speed,omitempty"`
+	Heading *float64 `json:"heading,omitempty"`
+	Accuracy *float64 `json:"accuracy,omitempty"`
+	Sequence *int64 `json:"sequence,omitempty"`
 }
 
 // NewDatabaseConnection creates a new connection to PostgreSQL.
@@ -66,7 +137,7 @@ func NewDatabaseConnection() (databaseConnection DatabaseConnection, err error)
 		if err == nil {
 			break
 		}
-		fmt.Println("Database not ready, retrying in 2s... (%d/10)", i+1)
+		fmt.Printf("Database not ready, retrying in 2s... (%d/10)\n", i+1)
 		time.Sleep(2 * time.Second)
 	}
 
@@ -77,7 +148,8 @@ func NewDatabaseConnection() (databaseConnection DatabaseConnection, err error)
 	db.SetMaxIdleConns(40)
 	db.SetConnMaxLifetime(time.Duration(60) * time.Minute)
 	databaseConnection = DatabaseConnection{
-		Db: db,
+		Db:  db,
+		url: dbUrl,
 	}
 	return
 }
@@ -92,6 +164,10 @@ func (dc DatabaseConnection) InitDatabase() error {
 	if err != nil {
 		return err
 	}
+	err = dc.createBusStopTrigger()
+	if err != nil {
+		return err
+	}
 	err = dc.createBusTable()
 	if err != nil {
 		return err
@@ -108,14 +184,74 @@ func (dc DatabaseConnection) InitDatabase() error {
 	if err != nil {
 		return err
 	}
+	err = dc.createRouteTables()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusServiceColumns()
+	if err != nil {
+		return err
+	}
+	err = dc.createRouteEntries()
+	if err != nil {
+		return err
+	}
 	err = dc.createBusPositionTable()
 	if err != nil {
 		return err
 	}
+	err = dc.createBusPositionDeviceColumns()
+	if err != nil {
+		return err
+	}
+	err = dc.createTripTables()
+	if err != nil {
+		return err
+	}
 	err = dc.createFunction()
 	if err != nil {
 		return err
 	}
+	err = dc.createBusPositionIndex()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusLatestPositionTable()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusLatestPositionFunction()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusLatestPositionTrigger()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusLatestPositionEntries()
+	if err != nil {
+		return err
+	}
+	err = dc.createSpatialIndexes()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusStopDelayTable()
+	if err != nil {
+		return err
+	}
+	err = dc.createBusArchiveTables()
+	if err != nil {
+		return err
+	}
+	err = dc.createTimeTableUploadTables()
+	if err != nil {
+		return err
+	}
+	err = dc.createDeviceKeyTable()
+	if err != nil {
+		return err
+	}
 	err = dc.dropTrigger()
 	if err != nil {
 		return err
@@ -128,6 +264,39 @@ func (dc DatabaseConnection) Close() error {
 	return dc.Db.Close()
 }
 
+// Listen passes the payload of the notifications sent on the given channels
+// to notify, until the context is cancelled. The listener reconnects by
+// itself when the connection is lost; notifications sent meanwhile are lost.
+func (dc DatabaseConnection) Listen(ctx context.Context, notify func(channel string, payload string), channels ...string) error {
+	listener := pq.NewListener(dc.url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Println("Database listener:", err)
+		}
+	})
+	defer listener.Close()
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			return err
+		}
+	}
+
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// A nil notification signals a reconnection.
+			if n != nil {
+				notify(n.Channel, n.Extra)
+			}
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
+
 func (dc DatabaseConnection) executeTransaction(sqlStmt string) (err error) {
 	tx, err := dc.Db.Begin()
 	if err != nil {
@@ -151,6 +320,23 @@ func (dc DatabaseConnection) executeTransaction(sqlStmt string) (err error) {
 	return
 }
 
+// withTransaction runs fn in a transaction, committed if fn succeeds and rolled back otherwise.
+func (dc DatabaseConnection) withTransaction(fn func(tx *sql.Tx) error) (err error) {
+	tx, err := dc.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	err = fn(tx)
+	return
+}
+
 func (dc DatabaseConnection) createBusStopTable() (err error) {
 	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_stop
 				(
@@ -211,6 +397,39 @@ func (dc DatabaseConnection) createBusStopEntries() (err error) {
 	return
 }
 
+// createBusStopTrigger notifies the changes of the bus stops on the bus_stop_notification channel.
+func (dc DatabaseConnection) createBusStopTrigger() (err error) {
+	sqlStmt := `CREATE OR REPLACE FUNCTION notify_bus_stop_event() RETURNS TRIGGER AS
+				$$
+				DECLARE
+					stop bus_stop;
+				BEGIN
+					IF TG_OP = 'DELETE' THEN
+						stop := OLD;
+					ELSE
+						stop := NEW;
+					END IF;
+					PERFORM pg_notify('bus_stop_notification', json_build_object(
+					'operation', TG_OP,
+					'id', stop.id,
+					'name', stop.name,
+					'latitude', stop.latitude,
+					'longitude', stop.longitude
+					)::text);
+					RETURN NULL;
+				END;
+				$$
+				LANGUAGE plpgsql;
+				DROP TRIGGER IF EXISTS notify_bus_stop ON bus_stop;
+				CREATE TRIGGER notify_bus_stop
+					AFTER INSERT OR UPDATE OR DELETE
+					ON bus_stop
+					FOR EACH ROW
+				EXECUTE PROCEDURE notify_bus_stop_event();`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
 func (dc DatabaseConnection) createBusTable() (err error) {
 	sqlStmt := `CREATE TABLE IF NOT EXISTS bus
 				(
@@ -317,7 +536,11 @@ func (dc DatabaseConnection) createFunction() (err error) {
 					'latitude', NEW.latitude,
 					'longitude', NEW.longitude,
 					'nextBusStopId', NEW.next_bus_stop_id,
-					'isBusStop', NEW.is_bus_stop
+					'isBusStop', NEW.is_bus_stop,
+					'tripId', NEW.trip_id,
+					'speed', NEW.speed,
+					'heading', NEW.heading,
+					'sequence', NEW.sequence
 					)::text);
 					RETURN NULL;
 				END;
@@ -343,6 +566,103 @@ func (dc DatabaseConnection) createTrigger() (err error) {
 	return
 }
 
+// createBusPositionIndex creates the index used to read the positions of a bus in a time range.
+func (dc DatabaseConnection) createBusPositionIndex() (err error) {
+	sqlStmt := `CREATE INDEX IF NOT EXISTS bus_position_bus_id_creationtime_idx ON bus_position (bus_id, creationtime, id);`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createBusLatestPositionTable creates the table holding the latest position of every bus.
+func (dc DatabaseConnection) createBusLatestPositionTable() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_latest_position
+				(
+					bus_id varchar (36) NOT NULL REFERENCES bus(id),
+					position_id bigint NOT NULL,
+					creationtime timestamp NOT NULL,
+					latitude DOUBLE PRECISION NOT NULL,
+					longitude DOUBLE PRECISION NOT NULL,
+					next_bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					is_bus_stop bool NOT NULL,
+					PRIMARY KEY(bus_id)
+				);
+				ALTER TABLE bus_latest_position ADD COLUMN IF NOT EXISTS trip_id bigint;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createBusLatestPositionFunction keeps bus_latest_position and the location
+// of the bus current on every position insert. A position older than the
+// stored one doesn't replace it.
+func (dc DatabaseConnection) createBusLatestPositionFunction() (err error) {
+	sqlStmt := `CREATE OR REPLACE FUNCTION update_bus_latest_position() RETURNS TRIGGER AS
+				$$
+				BEGIN
+					INSERT INTO bus_latest_position (bus_id, position_id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, trip_id)
+					VALUES (NEW.bus_id, NEW.id, NEW.creationtime, NEW.latitude, NEW.longitude, NEW.next_bus_stop_id, NEW.is_bus_stop, NEW.trip_id)
+					ON CONFLICT (bus_id) DO UPDATE SET
+						position_id = EXCLUDED.position_id,
+						creationtime = EXCLUDED.creationtime,
+						latitude = EXCLUDED.latitude,
+						longitude = EXCLUDED.longitude,
+						next_bus_stop_id = EXCLUDED.next_bus_stop_id,
+						is_bus_stop = EXCLUDED.is_bus_stop,
+						trip_id = EXCLUDED.trip_id
+					WHERE (bus_latest_position.creationtime, bus_latest_position.position_id) < (EXCLUDED.creationtime, EXCLUDED.position_id);
+					IF FOUND THEN
+						UPDATE bus SET latitude = NEW.latitude, longitude = NEW.longitude WHERE id = NEW.bus_id;
+					END IF;
+					RETURN NULL;
+				END;
+				$$
+				LANGUAGE plpgsql;;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+func (dc DatabaseConnection) createBusLatestPositionTrigger() (err error) {
+	sqlStmt := `DROP TRIGGER IF EXISTS update_bus_latest_position ON bus_position;
+				CREATE TRIGGER update_bus_latest_position
+					AFTER INSERT
+					ON bus_position
+					FOR EACH ROW
+				EXECUTE PROCEDURE update_bus_latest_position();;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createBusLatestPositionEntries fills bus_latest_position with the positions stored before the table existed.
+func (dc DatabaseConnection) createBusLatestPositionEntries() (err error) {
+	sqlStmt := `INSERT INTO bus_latest_position (bus_id, position_id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, trip_id)
+					SELECT DISTINCT ON (bus_id) bus_id, id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, trip_id
+					FROM bus_position
+					ORDER BY bus_id, creationtime DESC, id DESC
+					ON CONFLICT (bus_id) DO NOTHING;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createBusStopDelayTable creates the table of the delays of the buses at
+// their bus stops. A position is the arrival of at most one delay.
+func (dc DatabaseConnection) createBusStopDelayTable() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_stop_delay
+				(
+					id bigserial NOT NULL,
+					bus_id varchar (36) NOT NULL REFERENCES bus(id),
+					bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					position_id bigint NOT NULL UNIQUE,
+					trip_start timestamp NOT NULL,
+					scheduled_time timestamp NOT NULL,
+					arrival_time timestamp NOT NULL,
+					delay_seconds INTEGER NOT NULL,
+					PRIMARY KEY(id)
+				);
+				CREATE INDEX IF NOT EXISTS bus_stop_delay_bus_id_arrival_time_idx ON bus_stop_delay (bus_id, arrival_time, id);
+				ALTER TABLE bus_stop_delay ADD COLUMN IF NOT EXISTS trip_id bigint REFERENCES trip(id) ON DELETE SET NULL;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
 func (dc DatabaseConnection) GetBusStopEntries() (error, []BusStop) {
 	sqlStmt, err := dc.Db.Prepare("SELECT id, name, latitude, longitude FROM bus_stop")
 	if err != nil {
@@ -376,8 +696,116 @@ func (dc DatabaseConnection) GetBusStopEntries() (error, []BusStop) {
 	return nil, busStopEntries
 }
 
+// GetBusStop returns the bus stop, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) GetBusStop(busStopId string) (err error, bs BusStop) {
+	sqlStmt, err := dc.Db.Prepare("SELECT id, name, latitude, longitude FROM bus_stop WHERE id = $1")
+	if err != nil {
+		return
+	}
+	defer sqlStmt.Close()
+	err = sqlStmt.QueryRow(busStopId).Scan(
+		&bs.Id,
+		&bs.Name,
+		&bs.Latitude,
+		&bs.Longitude,
+	)
+	return
+}
+
+// CreateBusStop creates the bus stop, ErrBusStopExists if its ID is taken.
+func (dc DatabaseConnection) CreateBusStop(bs BusStop) (err error) {
+	sqlStmt, err := dc.Db.Prepare("INSERT INTO bus_stop (id, name, latitude, longitude) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		return
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(bs.Id, bs.Name, bs.Latitude, bs.Longitude)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrBusStopExists
+	}
+	return
+}
+
+// UpdateBusStop replaces the name and location of the bus stop, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) UpdateBusStop(bs BusStop) (err error) {
+	sqlStmt, err := dc.Db.Prepare("UPDATE bus_stop SET name = $2, latitude = $3, longitude = $4 WHERE id = $1")
+	if err != nil {
+		return
+	}
+	defer sqlStmt.Close()
+	result, err := sqlStmt.Exec(bs.Id, bs.Name, bs.Latitude, bs.Longitude)
+	if err != nil {
+		return
+	}
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+// GetBusStopReferences returns, for every table referencing the bus stop, the number of referencing rows.
+func (dc DatabaseConnection) GetBusStopReferences(busStopId string) (error, map[string]int) {
+	var timeTables, routeTimeTables, uploads, routes, trips, positions, delays int
+	err := dc.Db.QueryRow(`SELECT
+					(SELECT COUNT(*) FROM bus_time_table WHERE bus_stop_id = $1),
+					(SELECT COUNT(*) FROM route_time_table WHERE bus_stop_id = $1),
+					(SELECT COUNT(*) FROM bus_time_table_upload_stop WHERE bus_stop_id = $1),
+					(SELECT COUNT(*) FROM route_stop WHERE bus_stop_id = $1),
+					(SELECT COUNT(*) FROM trip_stop WHERE bus_stop_id = $1),
+					(SELECT COUNT(*) FROM bus_position WHERE next_bus_stop_id = $1),
+					(SELECT COUNT(*) FROM bus_stop_delay WHERE bus_stop_id = $1)`, busStopId).Scan(&timeTables, &routeTimeTables, &uploads, &routes, &trips, &positions, &delays)
+	if err != nil {
+		return err, nil
+	}
+	return nil, referencingTables(map[string]int{
+		"bus_time_table":             timeTables,
+		"route_time_table":           routeTimeTables,
+		"bus_time_table_upload_stop": uploads,
+		"route_stop":                 routes,
+		"trip_stop":                  trips,
+		"bus_position":               positions,
+		"bus_stop_delay":             delays,
+	})
+}
+
+// referencingTables returns the tables of counts with at least one referencing row.
+func referencingTables(counts map[string]int) map[string]int {
+	references := make(map[string]int)
+	for table, count := range counts {
+		if count > 0 {
+			references[table] = count
+		}
+	}
+	return references
+}
+
+// DeleteBusStop deletes the bus stop, sql.ErrNoRows if it doesn't exist and
+// ErrBusStopReferenced if other rows still reference it.
+func (dc DatabaseConnection) DeleteBusStop(busStopId string) (err error) {
+	sqlStmt, err := dc.Db.Prepare("DELETE FROM bus_stop WHERE id = $1")
+	if err != nil {
+		return
+	}
+	defer sqlStmt.Close()
+	result, err := sqlStmt.Exec(busStopId)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrBusStopReferenced
+	}
+	if err != nil {
+		return
+	}
+	deleted, err := result.RowsAffected()
+	if err == nil && deleted == 0 {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
 func (dc DatabaseConnection) GetBusEntries() (error, []Bus) {
-	sqlStmt, err := dc.Db.Prepare("SELECT id, latitude, longitude FROM bus")
+	sqlStmt, err := dc.Db.Prepare("SELECT id, latitude, longitude, COALESCE(route_id, ''), label, in_service, decommissioned_at FROM bus")
 	if err != nil {
 		return err, nil
     }
@@ -396,6 +824,10 @@ func (dc DatabaseConnection) GetBusEntries() (error, []Bus) {
 			&b.Id,
 			&b.Latitude,
 			&b.Longitude,
+			&b.RouteId,
+			&b.Label,
+			&b.InService,
+			&b.DecommissionedAt,
 		)
 		if err != nil {
 			return err, nil
@@ -409,7 +841,7 @@ func (dc DatabaseConnection) GetBusEntries() (error, []Bus) {
 }
 
 func (dc DatabaseConnection) GetBusTimeTableEntries(busId string) (error, []BusTimeTable) {
-	sqlStmt, err := dc.Db.Prepare("SELECT bus_id, bus_stop_id, time_seconds FROM bus_time_table WHERE bus_id LIKE $1")
+	sqlStmt, err := dc.Db.Prepare("SELECT bus_id, bus_stop_id, time_seconds FROM bus_schedule WHERE bus_id = $1 ORDER BY time_seconds")
 	if err != nil {
 		return err, nil
     }
@@ -422,11 +854,11 @@ func (dc DatabaseConnection) GetBusTimeTableEntries(busId string) (error, []BusT
 	if err != nil {
 		return err, nil
     }
+	defer rows.Close()
 
 	var currentTime = time.Now().Local()
 
 	for rows.Next() {
-		fmt.Println("scam row")
 		var btt BusTimeTable
 		err := rows.Scan(
 			&btt.BusId,
@@ -446,7 +878,7 @@ func (dc DatabaseConnection) GetBusTimeTableEntries(busId string) (error, []BusT
 }
 
 func (dc DatabaseConnection) BusExists(busId string) (err error, exists bool) {
-	sqlStmt, err := dc.Db.Prepare("SELECT COUNT(*) FROM bus WHERE id LIKE $1")
+	sqlStmt, err := dc.Db.Prepare("SELECT COUNT(*) FROM bus WHERE id = $1")
 	if err != nil {
 		return
     }
@@ -466,30 +898,369 @@ func (dc DatabaseConnection) BusExists(busId string) (err error, exists bool) {
 	return
 }
 
-func (dc DatabaseConnection) CreateBus(busId string, latitude string, longitude string) (err error) {
-	sqlStmt, err := dc.Db.Prepare("INSERT INTO bus (id, latitude, longitude) VALUES ($1, $2, $3)")
+// CreateBus creates the bus with the device key of hash keyHash.
+func (dc DatabaseConnection) CreateBus(busId string, latitude string, longitude string, keyHash string) (err error) {
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO bus (id, latitude, longitude) VALUES ($1, $2, $3)", busId, latitude, longitude); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO bus_device_key (bus_id, key_hash) VALUES ($1, $2)", busId, keyHash)
+		return err
+	})
+	return
+}
+
+// GetLatestBusPositions returns the most recent position of every bus.
+func (dc DatabaseConnection) GetLatestBusPositions() (error, []BusPosition) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT position_id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, '')
+				FROM bus_latest_position
+				ORDER BY bus_id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	var busPositions []BusPosition
+
+	rows, err := sqlStmt.Query()
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bp BusPosition
+		err := rows.Scan(
+			&bp.Id,
+			&bp.CreationTime,
+			&bp.BusId,
+			&bp.Latitude,
+			&bp.Longitude,
+			&bp.NextBusStopId,
+			&bp.IsBusStop,
+			&bp.TripId,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busPositions = append(busPositions, bp)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busPositions
+}
+
+// GetBusPositions returns the positions of the bus matching the query,
+// ordered by creation time and id. From and To are converted to the time
+// zone of the database session, in which the creation time is stored.
+func (dc DatabaseConnection) GetBusPositions(busId string, query BusPositionQuery) (error, []BusPosition) {
+	conditions := "bus_id = $1"
+	args := []any{busId}
+	if !query.From.IsZero() {
+		args = append(args, query.From)
+		conditions += fmt.Sprintf(" AND creationtime >= $%d::timestamptz::timestamp", len(args))
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To)
+		conditions += fmt.Sprintf(" AND creationtime < $%d::timestamptz::timestamp", len(args))
+	}
+	order, comparison := "ASC", ">"
+	if query.Descending {
+		order, comparison = "DESC", "<"
+	}
+	if query.After != nil {
+		args = append(args, query.After.CreationTime.Format("2006-01-02 15:04:05.999999"), query.After.Id)
+		conditions += fmt.Sprintf(" AND (creationtime, id) %s ($%d::timestamp, $%d)", comparison, len(args)-1, len(args))
+	}
+	args = append(args, query.Limit)
+	sqlStmt, err := dc.Db.Prepare(fmt.Sprintf(`SELECT id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					received_time, speed, heading, accuracy, sequence
+				FROM bus_position
+				WHERE %s
+				ORDER BY creationtime %s, id %s
+				LIMIT $%d`, conditions, order, order, len(args)))
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	busPositions := []BusPosition{}
+
+	rows, err := sqlStmt.Query(args...)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bp BusPosition
+		err := rows.Scan(
+			&bp.Id,
+			&bp.CreationTime,
+			&bp.BusId,
+			&bp.Latitude,
+			&bp.Longitude,
+			&bp.NextBusStopId,
+			&bp.IsBusStop,
+			&bp.TripId,
+			&bp.ReceivedTime,
+			&bp.Speed,
+			&bp.Heading,
+			&bp.Accuracy,
+			&bp.Sequence,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busPositions = append(busPositions, bp)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busPositions
+}
+
+// GetBusStates returns the latest position of every bus that sent one.
+// The staleness is computed by the database clock; a position timestamped
+// ahead of it by its device isn't stale.
+func (dc DatabaseConnection) GetBusStates() (error, []BusState) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT bus_id, position_id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					GREATEST(0, EXTRACT(EPOCH FROM (LOCALTIMESTAMP - creationtime)))::float8
+				FROM bus_latest_position
+				ORDER BY bus_id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	busStates := []BusState{}
+
+	rows, err := sqlStmt.Query()
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bs BusState
+		err := rows.Scan(
+			&bs.BusId,
+			&bs.PositionId,
+			&bs.Timestamp,
+			&bs.Latitude,
+			&bs.Longitude,
+			&bs.NextBusStopId,
+			&bs.IsBusStop,
+			&bs.TripId,
+			&bs.StalenessSeconds,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busStates = append(busStates, bs)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busStates
+}
+
+// GetBusState returns the latest position of the bus, sql.ErrNoRows if the bus didn't send any.
+func (dc DatabaseConnection) GetBusState(busId string) (err error, bs BusState) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT bus_id, position_id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					GREATEST(0, EXTRACT(EPOCH FROM (LOCALTIMESTAMP - creationtime)))::float8
+				FROM bus_latest_position
+				WHERE bus_id = $1`)
 	if err != nil {
 		return
-    }
-    defer sqlStmt.Close()
-	_, err = sqlStmt.Exec(busId, latitude, longitude)
+	}
+	defer sqlStmt.Close()
+	err = sqlStmt.QueryRow(busId).Scan(
+		&bs.BusId,
+		&bs.PositionId,
+		&bs.Timestamp,
+		&bs.Latitude,
+		&bs.Longitude,
+		&bs.NextBusStopId,
+		&bs.IsBusStop,
+		&bs.TripId,
+		&bs.StalenessSeconds,
+	)
 	return
 }
 
-func (dc DatabaseConnection) CreateBusPosition(busId string, latitude string, longitude string, nextBusStopId string, isBusStop bool) (err error, bp BusPosition) {
-	sqlStmt, err := dc.Db.Prepare("INSERT INTO bus_position (bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop) VALUES ($1, $2, $3, $4, $5) RETURNING id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop")
+// GetBusStopArrivals returns the arrivals of the bus at its bus stops within
+// its last positions, ordered by time. An arrival is the first position at a
+// bus stop after a position elsewhere.
+func (dc DatabaseConnection) GetBusStopArrivals(busId string, positions int) (error, []BusStopArrival) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT next_bus_stop_id, creationtime
+				FROM (
+					SELECT next_bus_stop_id, creationtime, id, is_bus_stop,
+						LAG(is_bus_stop) OVER w AS was_bus_stop,
+						LAG(next_bus_stop_id) OVER w AS previous_bus_stop_id
+					FROM (
+						SELECT id, creationtime, next_bus_stop_id, is_bus_stop
+						FROM bus_position
+						WHERE bus_id = $1
+						ORDER BY creationtime DESC, id DESC
+						LIMIT $2
+					) recent
+					WINDOW w AS (ORDER BY creationtime, id)
+				) transitions
+				WHERE is_bus_stop AND (was_bus_stop IS NOT TRUE OR previous_bus_stop_id <> next_bus_stop_id)
+				ORDER BY creationtime, id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	var arrivals []BusStopArrival
+
+	rows, err := sqlStmt.Query(busId, positions)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a BusStopArrival
+		err := rows.Scan(
+			&a.BusStopId,
+			&a.Time,
+		)
+		if err != nil {
+			return err, nil
+		}
+		arrivals = append(arrivals, a)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, arrivals
+}
+
+// CreateBusStopDelay stores the delay. created is false if the delay of the position was already stored.
+func (dc DatabaseConnection) CreateBusStopDelay(delay BusStopDelay) (err error, bsd BusStopDelay, created bool) {
+	sqlStmt, err := dc.Db.Prepare(`INSERT INTO bus_stop_delay (bus_id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, trip_id)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')::bigint)
+				ON CONFLICT (position_id) DO NOTHING
+				RETURNING id, bus_id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, COALESCE(trip_id::text, '')`)
 	if err != nil {
 		return
-    }
-    defer sqlStmt.Close()
-	err = sqlStmt.QueryRow(busId, latitude, longitude, nextBusStopId, isBusStop).Scan(
-		&bp.Id,
-		&bp.CreationTime,
-		&bp.BusId,
-		&bp.Latitude,
-		&bp.Longitude,
-		&bp.NextBusStopId,
-		&bp.IsBusStop,
+	}
+	defer sqlStmt.Close()
+	err = sqlStmt.QueryRow(delay.BusId, delay.BusStopId, delay.PositionId, delay.TripStart, delay.ScheduledTime, delay.ArrivalTime, delay.DelaySeconds, delay.TripId).Scan(
+		&bsd.Id,
+		&bsd.BusId,
+		&bsd.BusStopId,
+		&bsd.PositionId,
+		&bsd.TripStart,
+		&bsd.ScheduledTime,
+		&bsd.ArrivalTime,
+		&bsd.DelaySeconds,
+		&bsd.TripId,
 	)
-	return
+	if err == sql.ErrNoRows {
+		return nil, delay, false
+	}
+	return err, bsd, err == nil
+}
+
+// GetLatestBusStopDelays returns the latest delay of every bus.
+func (dc DatabaseConnection) GetLatestBusStopDelays() (error, []BusStopDelay) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT DISTINCT ON (bus_id) id, bus_id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, COALESCE(trip_id::text, '')
+				FROM bus_stop_delay
+				ORDER BY bus_id, arrival_time DESC, id DESC`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+	rows, err := sqlStmt.Query()
+	if err != nil {
+		return err, nil
+	}
+	return scanBusStopDelays(rows)
+}
+
+// GetBusTripDelays returns the delays of the latest trip of the bus, ordered by arrival.
+func (dc DatabaseConnection) GetBusTripDelays(busId string) (error, []BusStopDelay) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT id, bus_id, bus_stop_id, position_id, trip_start, scheduled_time, arrival_time, delay_seconds, COALESCE(trip_id::text, '')
+				FROM bus_stop_delay
+				WHERE bus_id = $1 AND trip_start = (
+					SELECT trip_start FROM bus_stop_delay WHERE bus_id = $1 ORDER BY arrival_time DESC, id DESC LIMIT 1
+				)
+				ORDER BY arrival_time, id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+	rows, err := sqlStmt.Query(busId)
+	if err != nil {
+		return err, nil
+	}
+	return scanBusStopDelays(rows)
+}
+
+func scanBusStopDelays(rows *sql.Rows) (error, []BusStopDelay) {
+	defer rows.Close()
+
+	busStopDelays := []BusStopDelay{}
+
+	for rows.Next() {
+		var bsd BusStopDelay
+		err := rows.Scan(
+			&bsd.Id,
+			&bsd.BusId,
+			&bsd.BusStopId,
+			&bsd.PositionId,
+			&bsd.TripStart,
+			&bsd.ScheduledTime,
+			&bsd.ArrivalTime,
+			&bsd.DelaySeconds,
+			&bsd.TripId,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busStopDelays = append(busStopDelays, bsd)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busStopDelays
+}
+
+// GetAllBusTimeTableEntries returns the time table entries of every bus, ordered by bus and time.
+func (dc DatabaseConnection) GetAllBusTimeTableEntries() (error, []BusTimeTable) {
+	sqlStmt, err := dc.Db.Prepare("SELECT bus_id, bus_stop_id, time_seconds FROM bus_schedule ORDER BY bus_id, time_seconds")
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	var busTimeTableEntries []BusTimeTable
+
+	rows, err := sqlStmt.Query()
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var btt BusTimeTable
+		err := rows.Scan(
+			&btt.BusId,
+			&btt.BusStopId,
+			&btt.TimeSeconds,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busTimeTableEntries = append(busTimeTableEntries, btt)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busTimeTableEntries
 }
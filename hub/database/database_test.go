@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReferencingTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts map[string]int
+		want   map[string]int
+	}{
+		{name: "not referenced", counts: map[string]int{"bus_time_table": 0, "route_stop": 0}, want: map[string]int{}},
+		{name: "referenced", counts: map[string]int{"bus_time_table": 2, "route_stop": 0, "bus_position": 40}, want: map[string]int{"bus_time_table": 2, "bus_position": 40}},
+	}
+	for _, tt := range tests {
+		if got := referencingTables(tt.counts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: referencingTables() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetBusState(t *testing.T) {
+	dc := testDatabase(t)
+	err, busStops := dc.GetBusStopEntries()
+	if err != nil || len(busStops) == 0 {
+		t.Fatalf("bus stops: %v, %d", err, len(busStops))
+	}
+	busId := fmt.Sprintf("test-%d", time.Now().UnixNano()%1e12)
+	if err := dc.CreateBus(busId, "41.9096", "12.52975", fmt.Sprintf("%064d", time.Now().UnixNano())); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err, b := dc.GetBus(busId); err == nil {
+			b.InService = false
+			dc.UpdateBus(b)
+			dc.DeleteBus(busId)
+		}
+	})
+	if err, _ := dc.GetBusState(busId); err != sql.ErrNoRows {
+		t.Fatalf("GetBusState() before any position: error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	start := time.Now().Add(-time.Minute).UTC().Truncate(time.Microsecond)
+	at := func(d time.Duration) *time.Time {
+		timestamp := start.Add(d)
+		return &timestamp
+	}
+	tests := []struct {
+		name     string
+		position NewBusPosition
+		wantErr  error
+		// want is the latitude of the latest position once the position is sent.
+		want string
+	}{
+		{name: "first position", position: NewBusPosition{Timestamp: at(0), Latitude: 41.9, Longitude: 12.5}, want: "41.9"},
+		{name: "newer position", position: NewBusPosition{Timestamp: at(time.Second), Latitude: 41.91, Longitude: 12.5, IsBusStop: true}, want: "41.91"},
+		{name: "older position", position: NewBusPosition{Timestamp: at(time.Second / 2), Latitude: 41.92, Longitude: 12.5}, wantErr: ErrPositionOutOfOrder, want: "41.91"},
+		{name: "copy of the latest position", position: NewBusPosition{Timestamp: at(time.Second), Latitude: 41.91, Longitude: 12.5, IsBusStop: true}, want: "41.91"},
+		{name: "position ahead of the database clock", position: NewBusPosition{Timestamp: at(2 * time.Minute), Latitude: 41.93, Longitude: 12.5}, want: "41.93"},
+	}
+	for _, tt := range tests {
+		p := tt.position
+		p.BusId = busId
+		p.NextBusStopId = busStops[0].Id
+		if err, _, _ := dc.CreateBusPosition(p); !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: CreateBusPosition() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		err, bs := dc.GetBusState(busId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bs.Latitude != tt.want || bs.NextBusStopId != busStops[0].Id || bs.StalenessSeconds < 0 {
+			t.Errorf("%s: GetBusState() = %+v, want latitude %s", tt.name, bs, tt.want)
+		}
+	}
+
+	err, bs := dc.GetBusState(busId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bs.Timestamp.Equal(*at(2 * time.Minute)) || bs.StalenessSeconds != 0 {
+		t.Errorf("GetBusState() = %s, %v seconds stale, want the device timestamp and no staleness", bs.Timestamp, bs.StalenessSeconds)
+	}
+	err, busStates := dc.GetBusStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range busStates {
+		found = found || s.BusId == busId && s.PositionId == bs.PositionId
+	}
+	if !found {
+		t.Errorf("GetBusStates() doesn't return %+v", bs)
+	}
+}
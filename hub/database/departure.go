@@ -0,0 +1,141 @@
+package database
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The departures of a bus stop are predicted for all the buses stopping
+// there at once: each query below answers for a set of buses or trips in a
+// single round trip instead of one per bus.
+
+// GetBusStatesOf returns the latest position of each of the buses that has one.
+func (dc DatabaseConnection) GetBusStatesOf(busIds []string) (error, map[string]BusState) {
+	rows, err := dc.Db.Query(`SELECT bus_id, position_id, creationtime, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					GREATEST(0, EXTRACT(EPOCH FROM (LOCALTIMESTAMP - creationtime)))::float8
+				FROM bus_latest_position
+				WHERE bus_id = ANY($1::varchar[])`, pq.Array(busIds))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	busStates := make(map[string]BusState)
+	for rows.Next() {
+		var bs BusState
+		err := rows.Scan(
+			&bs.BusId,
+			&bs.PositionId,
+			&bs.Timestamp,
+			&bs.Latitude,
+			&bs.Longitude,
+			&bs.NextBusStopId,
+			&bs.IsBusStop,
+			&bs.TripId,
+			&bs.StalenessSeconds,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busStates[bs.BusId] = bs
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busStates
+}
+
+// GetBusesStopArrivals returns the arrivals of each of the buses at its bus
+// stops within its last positions, ordered by time, as GetBusStopArrivals.
+// A bus without arrival is left out.
+func (dc DatabaseConnection) GetBusesStopArrivals(busIds []string, positions int) (error, map[string][]BusStopArrival) {
+	rows, err := dc.Db.Query(`SELECT b.bus_id, a.next_bus_stop_id, a.creationtime
+				FROM UNNEST($1::varchar[]) AS b(bus_id)
+				CROSS JOIN LATERAL (
+					SELECT next_bus_stop_id, creationtime, id
+					FROM (
+						SELECT next_bus_stop_id, creationtime, id, is_bus_stop,
+							LAG(is_bus_stop) OVER w AS was_bus_stop,
+							LAG(next_bus_stop_id) OVER w AS previous_bus_stop_id
+						FROM (
+							SELECT id, creationtime, next_bus_stop_id, is_bus_stop
+							FROM bus_position
+							WHERE bus_id = b.bus_id
+							ORDER BY creationtime DESC, id DESC
+							LIMIT $2
+						) recent
+						WINDOW w AS (ORDER BY creationtime, id)
+					) transitions
+					WHERE is_bus_stop AND (was_bus_stop IS NOT TRUE OR previous_bus_stop_id <> next_bus_stop_id)
+				) a
+				ORDER BY b.bus_id, a.creationtime, a.id`, pq.Array(busIds), positions)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	arrivals := make(map[string][]BusStopArrival)
+	for rows.Next() {
+		var busId string
+		var a BusStopArrival
+		if err := rows.Scan(&busId, &a.BusStopId, &a.Time); err != nil {
+			return err, nil
+		}
+		arrivals[busId] = append(arrivals[busId], a)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, arrivals
+}
+
+// GetTripsScheduledTimes returns the scheduled time at the bus stop of each
+// of the trips that stops there.
+func (dc DatabaseConnection) GetTripsScheduledTimes(tripIds []string, busStopId string) (error, map[string]time.Time) {
+	rows, err := dc.Db.Query(`SELECT trip_id::text, MIN(scheduled_time)
+				FROM trip_stop
+				WHERE trip_id = ANY($1::bigint[]) AND bus_stop_id = $2
+				GROUP BY trip_id`, pq.Array(tripIds), busStopId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	scheduledTimes := make(map[string]time.Time)
+	for rows.Next() {
+		var tripId string
+		var scheduledTime time.Time
+		if err := rows.Scan(&tripId, &scheduledTime); err != nil {
+			return err, nil
+		}
+		scheduledTimes[tripId] = scheduledTime
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, scheduledTimes
+}
+
+// GetLatestTripStarts returns the start of the latest trip of each of the
+// buses with a delay, the trip of GetBusTripDelays.
+func (dc DatabaseConnection) GetLatestTripStarts(busIds []string) (error, map[string]time.Time) {
+	rows, err := dc.Db.Query(`SELECT DISTINCT ON (bus_id) bus_id, trip_start
+				FROM bus_stop_delay
+				WHERE bus_id = ANY($1::varchar[])
+				ORDER BY bus_id, arrival_time DESC, id DESC`, pq.Array(busIds))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	tripStarts := make(map[string]time.Time)
+	for rows.Next() {
+		var busId string
+		var tripStart time.Time
+		if err := rows.Scan(&busId, &tripStart); err != nil {
+			return err, nil
+		}
+		tripStarts[busId] = tripStart
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, tripStarts
+}
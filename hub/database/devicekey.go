@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// DeviceKey is an API key of a bus device. Only the hash of the key is
+// stored. A key replaced by a newer one stays valid until ExpiresAt.
+type DeviceKey struct {
+	Id        string     `json:"id"`
+	BusId     string     `json:"bus_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// createDeviceKeyTable creates the table of the device keys. The keys of a
+// bus are deleted with it.
+func (dc DatabaseConnection) createDeviceKeyTable() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_device_key
+				(
+					id bigserial NOT NULL,
+					bus_id varchar (36) NOT NULL REFERENCES bus(id) ON DELETE CASCADE,
+					key_hash char (64) NOT NULL UNIQUE,
+					created_at timestamp NOT NULL DEFAULT LOCALTIMESTAMP,
+					expires_at timestamp,
+					PRIMARY KEY(id)
+				);
+				CREATE INDEX IF NOT EXISTS bus_device_key_bus_id_idx ON bus_device_key (bus_id);`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// GetDeviceKeyBus returns the bus of the valid device key of hash keyHash,
+// sql.ErrNoRows if there is none.
+func (dc DatabaseConnection) GetDeviceKeyBus(keyHash string) (err error, busId string) {
+	err = dc.Db.QueryRow(`SELECT bus_id FROM bus_device_key
+				WHERE key_hash = $1 AND (expires_at IS NULL OR expires_at > LOCALTIMESTAMP)`, keyHash).Scan(&busId)
+	return
+}
+
+// RotateDeviceKey adds the device key of hash keyHash to the bus. Its other
+// keys expire after the grace period, or earlier if they were already
+// expiring; the expired keys are deleted. It returns sql.ErrNoRows if the bus
+// doesn't exist.
+func (dc DatabaseConnection) RotateDeviceKey(busId string, keyHash string, grace time.Duration) (err error, key DeviceKey) {
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT id FROM bus WHERE id = $1 FOR UPDATE", busId).Scan(&key.BusId); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE bus_device_key
+				SET expires_at = LEAST(COALESCE(expires_at, 'infinity'), LOCALTIMESTAMP + make_interval(secs => $2))
+				WHERE bus_id = $1`, busId, grace.Seconds())
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM bus_device_key WHERE bus_id = $1 AND expires_at <= LOCALTIMESTAMP", busId); err != nil {
+			return err
+		}
+		return tx.QueryRow(`INSERT INTO bus_device_key (bus_id, key_hash) VALUES ($1, $2)
+				RETURNING id, created_at`, busId, keyHash).Scan(&key.Id, &key.CreatedAt)
+	})
+	return
+}
+
+// GetDeviceKeys returns the valid device keys of the bus, newest first.
+func (dc DatabaseConnection) GetDeviceKeys(busId string) (error, []DeviceKey) {
+	rows, err := dc.Db.Query(`SELECT id, bus_id, created_at, expires_at FROM bus_device_key
+				WHERE bus_id = $1 AND (expires_at IS NULL OR expires_at > LOCALTIMESTAMP)
+				ORDER BY created_at DESC, id DESC`, busId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	keys := []DeviceKey{}
+	for rows.Next() {
+		var key DeviceKey
+		if err := rows.Scan(&key.Id, &key.BusId, &key.CreatedAt, &key.ExpiresAt); err != nil {
+			return err, nil
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, keys
+}
+
+// RevokeDeviceKey deletes the device key of the bus, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) RevokeDeviceKey(busId string, keyId string) error {
+	result, err := dc.Db.Exec("DELETE FROM bus_device_key WHERE bus_id = $1 AND id::text = $2", busId, keyId)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ProvisionDeviceKeys stores the device keys, given as the bus of every key
+// hash, of the existing buses that have no key yet. The buses that already
+// have one keep theirs, so that a key rotated or revoked isn't restored. It
+// returns the buses provisioned.
+func (dc DatabaseConnection) ProvisionDeviceKeys(keys map[string]string) (err error, busIds []string) {
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		busKeys := make(map[string][]string)
+		for keyHash, busId := range keys {
+			busKeys[busId] = append(busKeys[busId], keyHash)
+		}
+		for busId, keyHashes := range busKeys {
+			var provision bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM bus WHERE id = $1)
+					AND NOT EXISTS (SELECT 1 FROM bus_device_key WHERE bus_id = $1)`, busId).Scan(&provision)
+			if err != nil {
+				return err
+			}
+			if !provision {
+				continue
+			}
+			for _, keyHash := range keyHashes {
+				_, err := tx.Exec(`INSERT INTO bus_device_key (bus_id, key_hash) VALUES ($1, $2)
+						ON CONFLICT (key_hash) DO NOTHING`, busId, keyHash)
+				if err != nil {
+					return err
+				}
+			}
+			busIds = append(busIds, busId)
+		}
+		sort.Strings(busIds)
+		return nil
+	})
+	return
+}
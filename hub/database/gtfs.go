@@ -0,0 +1,269 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"hub/start/gtfs"
+)
+
+// ImportCount counts the rows of a table touched by a GTFS import.
+type ImportCount struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+	Rejected  int `json:"rejected"`
+}
+
+// ImportReport describes the outcome of a GTFS import.
+type ImportReport struct {
+	DryRun          bool             `json:"dry_run"`
+	BusStops        ImportCount      `json:"bus_stop"`
+	Routes          ImportCount      `json:"route"`
+	RouteTimeTables ImportCount      `json:"route_time_table"`
+	Ignored         map[string]int   `json:"ignored"`
+	Rejected        []gtfs.Rejection `json:"rejected"`
+}
+
+var errDryRun = errors.New("dry run")
+
+// ImportGtfsFeed loads a validated GTFS feed in a single transaction. Stops
+// are loaded as bus stops and routes as routes; in each direction of a route,
+// the trip serving the most stops gives the route stops and shape, and the
+// trip of the first direction gives the route time table. The feed doesn't
+// describe the vehicles: no bus is created, the buses follow the time table of
+// the route they are assigned to, and their trips are scheduled per bus. The
+// other GTFS trips and the service calendars are rejected. With dryRun the
+// transaction is rolled back, and the report describes what would have
+// changed.
+func (dc DatabaseConnection) ImportGtfsFeed(feed *gtfs.Feed, dryRun bool) (error, ImportReport) {
+	timeTables := feed.TimeTables()
+	report := ImportReport{
+		DryRun:  dryRun,
+		Ignored: map[string]int{},
+	}
+	for _, calendar := range feed.Calendars {
+		report.Rejected = append(report.Rejected, gtfs.Rejection{
+			File:   "calendar.txt",
+			Reason: "service " + calendar.ServiceId + ": not imported, the trips are scheduled per bus",
+		})
+	}
+
+	err := dc.withTransaction(func(tx *sql.Tx) error {
+		if err := importBusStops(tx, feed.Stops, &report.BusStops); err != nil {
+			return err
+		}
+		usedShapePoints, err := importRoutes(tx, feed, timeTables, &report)
+		if err != nil {
+			return err
+		}
+		if err := importRouteTimeTables(tx, timeTables, &report); err != nil {
+			return err
+		}
+		report.Ignored["shapes.txt"] = len(feed.ShapePoints) - usedShapePoints
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return err, report
+	}
+
+	report.BusStops.Rejected = feed.RejectedIn("stops.txt")
+	report.Routes.Rejected += feed.RejectedIn("routes.txt")
+	report.RouteTimeTables.Rejected += feed.RejectedIn("trips.txt") + feed.RejectedIn("stop_times.txt")
+	report.Rejected = append(feed.Rejected, report.Rejected...)
+	return nil, report
+}
+
+// upsertCount executes an upsert statement returning whether the row was
+// inserted, and counts the row as created, updated or unchanged.
+func upsertCount(stmt *sql.Stmt, count *ImportCount, args ...any) error {
+	var inserted bool
+	err := stmt.QueryRow(args...).Scan(&inserted)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		count.Unchanged++
+	case err != nil:
+		return err
+	case inserted:
+		count.Created++
+	default:
+		count.Updated++
+	}
+	return nil
+}
+
+func importBusStops(tx *sql.Tx, stops []gtfs.Stop, count *ImportCount) error {
+	stmt, err := tx.Prepare(`INSERT INTO bus_stop (id, name, latitude, longitude) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude
+				WHERE (bus_stop.name, bus_stop.latitude, bus_stop.longitude) IS DISTINCT FROM (EXCLUDED.name, EXCLUDED.latitude, EXCLUDED.longitude)
+				RETURNING (xmax = 0)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, stop := range stops {
+		if err := upsertCount(stmt, count, stop.Id, stop.Name, stop.Latitude, stop.Longitude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importRouteTimeTables replaces the time table of every imported route with
+// the time table of its first direction. A route has a single time table: the
+// time table of its other direction is rejected.
+func importRouteTimeTables(tx *sql.Tx, timeTables []gtfs.TimeTable, report *ImportReport) error {
+	count := &report.RouteTimeTables
+	upsertStmt, err := tx.Prepare(`INSERT INTO route_time_table (route_id, bus_stop_id, time_seconds) VALUES ($1, $2, $3)
+				ON CONFLICT (route_id, bus_stop_id) DO UPDATE SET time_seconds = EXCLUDED.time_seconds
+				WHERE route_time_table.time_seconds IS DISTINCT FROM EXCLUDED.time_seconds
+				RETURNING (xmax = 0)`)
+	if err != nil {
+		return err
+	}
+	defer upsertStmt.Close()
+	deleteStmt, err := tx.Prepare("DELETE FROM route_time_table WHERE route_id = $1 AND NOT (bus_stop_id = ANY($2))")
+	if err != nil {
+		return err
+	}
+	defer deleteStmt.Close()
+
+	imported := make(map[string]gtfs.TimeTable, len(timeTables))
+	for _, tt := range timeTables {
+		if first, ok := imported[tt.RouteId]; ok {
+			count.Rejected++
+			report.Rejected = append(report.Rejected, gtfs.Rejection{
+				File:   "trips.txt",
+				Reason: fmt.Sprintf("trip %s: times not imported, route %s follows the time table of direction %d", tt.TripId, tt.RouteId, first.DirectionId),
+			})
+			continue
+		}
+		imported[tt.RouteId] = tt
+		stopIds := make([]string, 0, len(tt.Stops))
+		for _, stop := range tt.Stops {
+			if err := upsertCount(upsertStmt, count, tt.RouteId, stop.StopId, int(stop.Offset/time.Second)); err != nil {
+				return err
+			}
+			stopIds = append(stopIds, stop.StopId)
+		}
+		result, err := deleteStmt.Exec(tt.RouteId, pq.Array(stopIds))
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		count.Deleted += int(deleted)
+	}
+	return nil
+}
+
+// importRoutes creates or updates the route of every time table, and
+// replaces its stops and shape in the direction of the time table. The
+// shape of the trip is used when the feed has one, otherwise the shape joins
+// the stops. Routes without a time table are rejected. It returns the number
+// of shape points loaded.
+func importRoutes(tx *sql.Tx, feed *gtfs.Feed, timeTables []gtfs.TimeTable, report *ImportReport) (int, error) {
+	count := &report.Routes
+	withTimeTable := make(map[string]bool, len(timeTables))
+	for _, tt := range timeTables {
+		withTimeTable[tt.RouteId] = true
+	}
+	routes := make(map[string]gtfs.Route, len(feed.Routes))
+	for _, route := range feed.Routes {
+		routes[route.Id] = route
+		if !withTimeTable[route.Id] {
+			count.Rejected++
+			report.Rejected = append(report.Rejected, gtfs.Rejection{File: "routes.txt", Reason: "route " + route.Id + ": no trip with usable stop times"})
+		}
+	}
+	trips := make(map[string]gtfs.Trip, len(feed.Trips))
+	for _, trip := range feed.Trips {
+		trips[trip.Id] = trip
+	}
+	stops := make(map[string]gtfs.Stop, len(feed.Stops))
+	for _, stop := range feed.Stops {
+		stops[stop.Id] = stop
+	}
+	shapes := make(map[string][]gtfs.ShapePoint)
+	for _, sp := range feed.ShapePoints {
+		shapes[sp.ShapeId] = append(shapes[sp.ShapeId], sp)
+	}
+
+	routeStmt, err := tx.Prepare(`INSERT INTO route (id, short_name, long_name) VALUES ($1, $2, $3)
+				ON CONFLICT (id) DO UPDATE SET short_name = EXCLUDED.short_name, long_name = EXCLUDED.long_name
+				WHERE (route.short_name, route.long_name) IS DISTINCT FROM (EXCLUDED.short_name, EXCLUDED.long_name)
+				RETURNING (xmax = 0)`)
+	if err != nil {
+		return 0, err
+	}
+	defer routeStmt.Close()
+	stopStmt, err := tx.Prepare("INSERT INTO route_stop (route_id, direction_id, stop_sequence, bus_stop_id) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		return 0, err
+	}
+	defer stopStmt.Close()
+	shapeStmt, err := tx.Prepare("INSERT INTO route_shape (route_id, direction_id, point_sequence, latitude, longitude) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		return 0, err
+	}
+	defer shapeStmt.Close()
+
+	usedShapes := make(map[string]bool)
+	usedShapePoints := 0
+	upserted := make(map[string]bool, len(timeTables))
+	for _, tt := range timeTables {
+		route, trip := routes[tt.RouteId], trips[tt.TripId]
+		if !upserted[route.Id] {
+			upserted[route.Id] = true
+			shortName := route.ShortName
+			if shortName == "" {
+				shortName = route.Id
+			}
+			if err := upsertCount(routeStmt, count, route.Id, shortName, route.LongName); err != nil {
+				return 0, err
+			}
+		}
+		for _, table := range []string{"route_stop", "route_shape"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE route_id = $1 AND direction_id = $2", route.Id, trip.DirectionId); err != nil {
+				return 0, err
+			}
+		}
+		for i, stop := range tt.Stops {
+			if _, err := stopStmt.Exec(route.Id, trip.DirectionId, i+1, stop.StopId); err != nil {
+				return 0, err
+			}
+		}
+		shape := shapes[trip.ShapeId]
+		if len(shape) > 0 {
+			sort.Slice(shape, func(i, j int) bool {
+				return shape[i].Sequence < shape[j].Sequence
+			})
+			if !usedShapes[trip.ShapeId] {
+				usedShapes[trip.ShapeId] = true
+				usedShapePoints += len(shape)
+			}
+			for i, sp := range shape {
+				if _, err := shapeStmt.Exec(route.Id, trip.DirectionId, i+1, sp.Latitude, sp.Longitude); err != nil {
+					return 0, err
+				}
+			}
+		} else {
+			for i, stop := range tt.Stops {
+				if _, err := shapeStmt.Exec(route.Id, trip.DirectionId, i+1, stops[stop.StopId].Latitude, stops[stop.StopId].Longitude); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return usedShapePoints, nil
+}
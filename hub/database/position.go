@@ -0,0 +1,340 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrPositionOutOfOrder is returned for a position that isn't newer than the
+// latest position of its bus, and isn't a copy of a stored one.
+var ErrPositionOutOfOrder = errors.New("position is older than the latest position of the bus")
+
+// storedTimeLayout formats a creation time as stored, without time zone.
+const storedTimeLayout = "2006-01-02 15:04:05.999999"
+
+// NewBusPosition is a position sent by a bus. Timestamp is the time the
+// device took the position, nil for the clients that don't send it: the
+// position is then timestamped when received. Speed is in meters per second,
+// Heading in degrees clockwise from north and Accuracy in meters; Sequence
+// is a counter increasing with every position of the device.
+type NewBusPosition struct {
+	BusId         string
+	Timestamp     *time.Time
+	Latitude      float64
+	Longitude     float64
+	Speed         *float64
+	Heading       *float64
+	Accuracy      *float64
+	Sequence      *int64
+	NextBusStopId string
+	IsBusStop     bool
+}
+
+// createBusPositionDeviceColumns adds the time a position was received and
+// the speed, heading, accuracy and sequence reported by the device. The
+// creation time holds the device time; the positions stored before are
+// considered received at their creation time. A position is identified by its
+// bus, creation time and sequence: the unique index backs the lookup of the
+// copies in CreateBusPositions, should a position ever bypass the bus lock.
+func (dc DatabaseConnection) createBusPositionDeviceColumns() (err error) {
+	sqlStmt := `ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS received_time timestamp;
+				UPDATE bus_position SET received_time = creationtime WHERE received_time IS NULL;
+				ALTER TABLE bus_position ALTER COLUMN received_time SET DEFAULT LOCALTIMESTAMP;
+				ALTER TABLE bus_position ALTER COLUMN received_time SET NOT NULL;
+				ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS speed DOUBLE PRECISION;
+				ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS heading DOUBLE PRECISION;
+				ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS accuracy DOUBLE PRECISION;
+				ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS sequence bigint;
+				CREATE UNIQUE INDEX IF NOT EXISTS bus_position_bus_id_creationtime_sequence_key ON bus_position (bus_id, creationtime, sequence) NULLS NOT DISTINCT;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// BusPositionResult is the outcome of storing a position: the position
+// created, or the stored copy of a position sent again with Created false.
+// Err is ErrPositionOutOfOrder when the position was rejected.
+type BusPositionResult struct {
+	Position BusPosition
+	Created  bool
+	Err      error
+}
+
+// CreateBusPosition stores the position and returns it, linked to the active
+// trip of the bus. A position sent again is returned as stored, with created
+// false. It returns ErrPositionOutOfOrder if the position is older than the
+// latest position of the bus, and ErrUnknownBusStop if the next bus stop doesn't exist.
+func (dc DatabaseConnection) CreateBusPosition(p NewBusPosition) (err error, bp BusPosition, created bool) {
+	err, results := dc.CreateBusPositions([]NewBusPosition{p})
+	if err != nil {
+		return err, bp, false
+	}
+	return results[0].Err, results[0].Position, results[0].Created
+}
+
+// CreateBusPositions stores the positions in their order with a single
+// insert, and returns the outcome of each one. The buses are locked while
+// their positions are checked, so that the positions of a bus are only
+// stored in time order: a position with the bus and device time of a stored
+// one, and the same sequence, is a copy sent again; any other position not
+// newer than the latest one of its bus is rejected. The positions without
+// device time are timestamped now. Either all the accepted positions are
+// stored or none: it returns ErrUnknownBusStop if a next bus stop doesn't exist.
+func (dc DatabaseConnection) CreateBusPositions(positions []NewBusPosition) (err error, results []BusPositionResult) {
+	n := len(positions)
+	busIds := make([]string, n)
+	timestamps := make([]sql.NullString, n)
+	for i, p := range positions {
+		busIds[i] = p.BusId
+		if p.Timestamp != nil {
+			timestamps[i] = sql.NullString{String: p.Timestamp.Format(time.RFC3339Nano), Valid: true}
+		}
+	}
+
+	results = make([]BusPositionResult, n)
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("SELECT 1 FROM bus WHERE id = ANY($1::varchar[]) ORDER BY id FOR UPDATE", pq.Array(busIds)); err != nil {
+			return err
+		}
+
+		// The device times are converted to the time zone of the database, as stored.
+		creationTimes := make([]time.Time, 0, n)
+		rows, err := tx.Query(`SELECT COALESCE(t.timestamp::timestamptz::timestamp, LOCALTIMESTAMP)
+				FROM UNNEST($1::text[]) WITH ORDINALITY AS t(timestamp, n) ORDER BY t.n`, pq.Array(timestamps))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var creationTime time.Time
+			if err := rows.Scan(&creationTime); err != nil {
+				return err
+			}
+			creationTimes = append(creationTimes, creationTime)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		latest := make(map[string]time.Time)
+		rows, err = tx.Query("SELECT bus_id, creationtime FROM bus_latest_position WHERE bus_id = ANY($1::varchar[])", pq.Array(busIds))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var busId string
+			var creationTime time.Time
+			if err := rows.Scan(&busId, &creationTime); err != nil {
+				return err
+			}
+			latest[busId] = creationTime
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// A position that isn't newer than the latest one may be a copy of a stored position.
+		var copyBusIds, copyTimes []string
+		for i, p := range positions {
+			if latestTime, ok := latest[p.BusId]; ok && !creationTimes[i].After(latestTime) {
+				copyBusIds = append(copyBusIds, p.BusId)
+				copyTimes = append(copyTimes, creationTimes[i].Format(storedTimeLayout))
+			}
+		}
+		var stored []BusPosition
+		if len(copyBusIds) > 0 {
+			rows, err = tx.Query(`SELECT id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					received_time, speed, heading, accuracy, sequence
+				FROM bus_position
+				WHERE (bus_id, creationtime) IN (SELECT * FROM UNNEST($1::varchar[], $2::timestamp[]))`, pq.Array(copyBusIds), pq.Array(copyTimes))
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			if stored, err = scanBusPositions(rows); err != nil {
+				return err
+			}
+		}
+
+		accepted, copies := orderBusPositions(positions, creationTimes, latest, stored, results)
+		if len(accepted) == 0 {
+			return nil
+		}
+
+		inserted, err := insertBusPositions(tx, positions, creationTimes, accepted)
+		if err != nil {
+			return err
+		}
+		for k, i := range accepted {
+			results[i] = BusPositionResult{Position: inserted[k], Created: true}
+		}
+		for i, j := range copies {
+			results[i].Position = results[j].Position
+		}
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+	return nil, results
+}
+
+// orderBusPositions sorts out the positions, created at creationTimes, in
+// their order. A position newer than the latest one of its bus is accepted
+// and becomes the latest one; a position with the bus, creation time and
+// sequence of a stored position or of a position accepted before is a copy;
+// any other position is rejected with ErrPositionOutOfOrder. It returns the
+// indexes of the accepted positions, and copies maps the index of a copy of
+// an accepted position to the index of the latter. The copies of stored
+// positions and the rejections are set in results; latest is updated.
+func orderBusPositions(positions []NewBusPosition, creationTimes []time.Time, latest map[string]time.Time, stored []BusPosition, results []BusPositionResult) (accepted []int, copies map[int]int) {
+	// copyOf returns the index in accepted of the position of which p is a copy, or -1.
+	copyOf := func(p NewBusPosition, creationTime time.Time) int {
+		for _, j := range accepted {
+			if positions[j].BusId == p.BusId && creationTimes[j].Equal(creationTime) && sameSequence(positions[j].Sequence, p.Sequence) {
+				return j
+			}
+		}
+		return -1
+	}
+	copies = make(map[int]int)
+	for i, p := range positions {
+		if latestTime, ok := latest[p.BusId]; ok && !creationTimes[i].After(latestTime) {
+			results[i].Err = ErrPositionOutOfOrder
+			if j := copyOf(p, creationTimes[i]); j >= 0 {
+				results[i].Err, copies[i] = nil, j
+				continue
+			}
+			for _, bp := range stored {
+				if bp.BusId == p.BusId && bp.CreationTime.Equal(creationTimes[i]) && sameSequence(bp.Sequence, p.Sequence) {
+					results[i].Err, results[i].Position = nil, bp
+					break
+				}
+			}
+			continue
+		}
+		latest[p.BusId] = creationTimes[i]
+		accepted = append(accepted, i)
+	}
+	return accepted, copies
+}
+
+// insertBusPositions inserts the positions at the indexes, and returns them
+// as stored in the same order.
+func insertBusPositions(tx *sql.Tx, positions []NewBusPosition, creationTimes []time.Time, indexes []int) ([]BusPosition, error) {
+	n := len(indexes)
+	creationTimeValues := make([]string, n)
+	busIds := make([]string, n)
+	latitudes := make([]float64, n)
+	longitudes := make([]float64, n)
+	speeds := make([]sql.NullFloat64, n)
+	headings := make([]sql.NullFloat64, n)
+	accuracies := make([]sql.NullFloat64, n)
+	sequences := make([]sql.NullInt64, n)
+	nextBusStopIds := make([]string, n)
+	isBusStops := make([]bool, n)
+	for k, i := range indexes {
+		p := positions[i]
+		creationTimeValues[k] = creationTimes[i].Format(storedTimeLayout)
+		busIds[k] = p.BusId
+		latitudes[k], longitudes[k] = p.Latitude, p.Longitude
+		if p.Speed != nil {
+			speeds[k] = sql.NullFloat64{Float64: *p.Speed, Valid: true}
+		}
+		if p.Heading != nil {
+			headings[k] = sql.NullFloat64{Float64: *p.Heading, Valid: true}
+		}
+		if p.Accuracy != nil {
+			accuracies[k] = sql.NullFloat64{Float64: *p.Accuracy, Valid: true}
+		}
+		if p.Sequence != nil {
+			sequences[k] = sql.NullInt64{Int64: *p.Sequence, Valid: true}
+		}
+		nextBusStopIds[k], isBusStops[k] = p.NextBusStopId, p.IsBusStop
+	}
+
+	// The IDs are taken beforehand to match the returned rows with the positions.
+	ids := make([]int64, 0, n)
+	rows, err := tx.Query("SELECT nextval(pg_get_serial_sequence('bus_position', 'id')) FROM generate_series(1, $1)", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, n)
+	for k, id := range ids {
+		index[strconv.FormatInt(id, 10)] = k
+	}
+
+	rows, err = tx.Query(`INSERT INTO bus_position (id, creationtime, bus_id, latitude, longitude, speed, heading, accuracy, sequence, next_bus_stop_id, is_bus_stop)
+				SELECT p.id, p.creationtime, p.bus_id, p.latitude, p.longitude, p.speed, p.heading, p.accuracy, p.sequence, p.next_bus_stop_id, p.is_bus_stop
+				FROM UNNEST($1::bigint[], $2::timestamp[], $3::varchar[], $4::float8[], $5::float8[], $6::float8[], $7::float8[], $8::float8[], $9::bigint[], $10::varchar[], $11::bool[])
+					WITH ORDINALITY AS p(id, creationtime, bus_id, latitude, longitude, speed, heading, accuracy, sequence, next_bus_stop_id, is_bus_stop, n)
+				ORDER BY p.n
+				RETURNING id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					received_time, speed, heading, accuracy, sequence`,
+		pq.Array(ids), pq.Array(creationTimeValues), pq.Array(busIds), pq.Array(latitudes), pq.Array(longitudes),
+		pq.Array(speeds), pq.Array(headings), pq.Array(accuracies), pq.Array(sequences), pq.Array(nextBusStopIds), pq.Array(isBusStops))
+	if err != nil {
+		return nil, unknownBusStop(err)
+	}
+	defer rows.Close()
+	inserted, err := scanBusPositions(rows)
+	if err != nil {
+		return nil, unknownBusStop(err)
+	}
+	busPositions := make([]BusPosition, n)
+	for _, bp := range inserted {
+		busPositions[index[bp.Id]] = bp
+	}
+	return busPositions, nil
+}
+
+// scanBusPositions reads the rows of positions selected with their device columns.
+func scanBusPositions(rows *sql.Rows) ([]BusPosition, error) {
+	busPositions := []BusPosition{}
+	for rows.Next() {
+		var bp BusPosition
+		err := rows.Scan(
+			&bp.Id,
+			&bp.CreationTime,
+			&bp.BusId,
+			&bp.Latitude,
+			&bp.Longitude,
+			&bp.NextBusStopId,
+			&bp.IsBusStop,
+			&bp.TripId,
+			&bp.ReceivedTime,
+			&bp.Speed,
+			&bp.Heading,
+			&bp.Accuracy,
+			&bp.Sequence,
+		)
+		if err != nil {
+			return nil, err
+		}
+		busPositions = append(busPositions, bp)
+	}
+	return busPositions, rows.Err()
+}
+
+// sameSequence reports whether two sequences are equal, or both missing.
+func sameSequence(a *int64, b *int64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
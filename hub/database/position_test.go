@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOrderBusPositions(t *testing.T) {
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	sequence := func(n int64) *int64 { return &n }
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	stored := []BusPosition{
+		{Id: "7", BusId: "492", CreationTime: at(0), Sequence: sequence(1)},
+		{Id: "8", BusId: "492", CreationTime: at(10), Sequence: sequence(2)},
+	}
+	latest := map[string]time.Time{"492": at(10)}
+
+	type position struct {
+		busId    string
+		seconds  int
+		sequence *int64
+	}
+	tests := []struct {
+		name         string
+		positions    []position
+		wantAccepted []int
+		wantCopies   map[int]int
+		// wantStored is the ID of the stored position returned per index, "" for none.
+		wantStored []string
+		// wantRejected lists the indexes rejected as out of order.
+		wantRejected []int
+	}{
+		{
+			name:         "in order",
+			positions:    []position{{"492", 11, sequence(3)}, {"492", 12, sequence(4)}, {"493", 0, nil}},
+			wantAccepted: []int{0, 1, 2},
+		},
+		{
+			name:         "copies of stored positions",
+			positions:    []position{{"492", 0, sequence(1)}, {"492", 10, sequence(2)}, {"492", 11, sequence(3)}},
+			wantAccepted: []int{2},
+			wantStored:   []string{"7", "8", ""},
+		},
+		{
+			name:         "copy within the batch",
+			positions:    []position{{"492", 11, sequence(3)}, {"492", 11, sequence(3)}, {"493", 5, nil}, {"493", 5, nil}},
+			wantAccepted: []int{0, 2},
+			wantCopies:   map[int]int{1: 0, 3: 2},
+		},
+		{
+			name:         "out of order",
+			positions:    []position{{"492", 5, sequence(9)}, {"492", 12, sequence(4)}, {"492", 11, sequence(3)}},
+			wantAccepted: []int{1},
+			wantRejected: []int{0, 2},
+		},
+		{
+			name:         "same time as a stored position, another sequence",
+			positions:    []position{{"492", 10, sequence(3)}, {"492", 10, nil}},
+			wantRejected: []int{0, 1},
+		},
+		{
+			name:         "same time as an accepted position, another sequence",
+			positions:    []position{{"492", 11, sequence(3)}, {"492", 11, sequence(4)}},
+			wantAccepted: []int{0},
+			wantRejected: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		positions := make([]NewBusPosition, len(tt.positions))
+		creationTimes := make([]time.Time, len(tt.positions))
+		for i, p := range tt.positions {
+			positions[i] = NewBusPosition{BusId: p.busId, Sequence: p.sequence}
+			creationTimes[i] = at(p.seconds)
+		}
+		latestCopy := make(map[string]time.Time)
+		for busId, creationTime := range latest {
+			latestCopy[busId] = creationTime
+		}
+		results := make([]BusPositionResult, len(positions))
+		accepted, copies := orderBusPositions(positions, creationTimes, latestCopy, stored, results)
+
+		if !reflect.DeepEqual(accepted, tt.wantAccepted) {
+			t.Errorf("%s: accepted %v, want %v", tt.name, accepted, tt.wantAccepted)
+		}
+		wantCopies := tt.wantCopies
+		if wantCopies == nil {
+			wantCopies = map[int]int{}
+		}
+		if !reflect.DeepEqual(copies, wantCopies) {
+			t.Errorf("%s: copies %v, want %v", tt.name, copies, wantCopies)
+		}
+		rejected := []int{}
+		for i, r := range results {
+			if errors.Is(r.Err, ErrPositionOutOfOrder) {
+				rejected = append(rejected, i)
+			}
+			wantStored := ""
+			if tt.wantStored != nil {
+				wantStored = tt.wantStored[i]
+			}
+			if r.Position.Id != wantStored {
+				t.Errorf("%s: position %d returned stored position %q, want %q", tt.name, i, r.Position.Id, wantStored)
+			}
+		}
+		wantRejected := tt.wantRejected
+		if wantRejected == nil {
+			wantRejected = []int{}
+		}
+		if !reflect.DeepEqual(rejected, wantRejected) {
+			t.Errorf("%s: rejected %v, want %v", tt.name, rejected, wantRejected)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// ErrUnknownBusStop is returned when a route references a bus stop that doesn't exist.
+var ErrUnknownBusStop = errors.New("unknown bus stop")
+
+// ErrUnknownRoute is returned when a bus is assigned to, or a trip created on, a route that doesn't exist.
+var ErrUnknownRoute = errors.New("unknown route")
+
+// Route is a line, served by the buses BusIds. Each direction has its own
+// sequence of stops and shape.
+type Route struct {
+	Id         string           `json:"id"`
+	ShortName  string           `json:"short_name"`
+	LongName   string           `json:"long_name"`
+	BusIds     []string         `json:"bus_ids"`
+	Directions []RouteDirection `json:"directions,omitempty"`
+}
+
+// RouteDirection is the sequence of stops of a route in a direction, and the polyline followed between them.
+type RouteDirection struct {
+	DirectionId int               `json:"direction_id"`
+	Stops       []RouteStop       `json:"stops"`
+	Shape       []RouteShapePoint `json:"shape"`
+}
+
+type RouteStop struct {
+	StopSequence int    `json:"stop_sequence"`
+	BusStopId    string `json:"bus_stop_id"`
+}
+
+type RouteShapePoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// createRouteTables creates the route tables and assigns the buses to their
+// route. The bus_schedule view gives the time table every bus follows: its
+// own bus_time_table when it has one, otherwise the time table of its route.
+func (dc DatabaseConnection) createRouteTables() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS route
+				(
+					id varchar (36) NOT NULL,
+					short_name varchar (36) NOT NULL,
+					long_name varchar (255) NOT NULL DEFAULT '',
+					PRIMARY KEY(id)
+				);
+				CREATE TABLE IF NOT EXISTS route_stop
+				(
+					route_id varchar (36) NOT NULL REFERENCES route(id) ON DELETE CASCADE,
+					direction_id SMALLINT NOT NULL,
+					stop_sequence INTEGER NOT NULL,
+					bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					PRIMARY KEY(route_id, direction_id, stop_sequence)
+				);
+				CREATE TABLE IF NOT EXISTS route_shape
+				(
+					route_id varchar (36) NOT NULL REFERENCES route(id) ON DELETE CASCADE,
+					direction_id SMALLINT NOT NULL,
+					point_sequence INTEGER NOT NULL,
+					latitude DOUBLE PRECISION NOT NULL,
+					longitude DOUBLE PRECISION NOT NULL,
+					PRIMARY KEY(route_id, direction_id, point_sequence)
+				);
+				CREATE TABLE IF NOT EXISTS route_time_table
+				(
+					route_id varchar (36) NOT NULL REFERENCES route(id) ON DELETE CASCADE,
+					bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					time_seconds INTEGER NOT NULL,
+					PRIMARY KEY(route_id, bus_stop_id)
+				);
+				ALTER TABLE bus ADD COLUMN IF NOT EXISTS route_id varchar (36) REFERENCES route(id) ON DELETE SET NULL;
+				CREATE OR REPLACE VIEW bus_schedule AS
+					SELECT bus_id, bus_stop_id, time_seconds FROM bus_time_table
+					UNION ALL
+					SELECT b.id, rtt.bus_stop_id, rtt.time_seconds
+					FROM bus b JOIN route_time_table rtt ON rtt.route_id = b.route_id
+					WHERE NOT EXISTS (SELECT 1 FROM bus_time_table btt WHERE btt.bus_id = b.id);`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// createRouteEntries creates, when there is no route yet, one route per bus
+// time table, with the ID of the bus, its stops in the time table order and
+// a shape joining the stops, and assigns the bus to it.
+func (dc DatabaseConnection) createRouteEntries() (err error) {
+	sqlStmt := `WITH created AS (
+					INSERT INTO route (id, short_name)
+					SELECT DISTINCT bus_id, bus_id FROM bus_time_table
+					WHERE NOT EXISTS (SELECT 1 FROM route)
+					RETURNING id
+				), stops AS (
+					INSERT INTO route_stop (route_id, direction_id, stop_sequence, bus_stop_id)
+					SELECT btt.bus_id, 0, ROW_NUMBER() OVER (PARTITION BY btt.bus_id ORDER BY btt.time_seconds, btt.bus_stop_id), btt.bus_stop_id
+					FROM bus_time_table btt JOIN created ON created.id = btt.bus_id
+					RETURNING route_id, stop_sequence, bus_stop_id
+				), shape AS (
+					INSERT INTO route_shape (route_id, direction_id, point_sequence, latitude, longitude)
+					SELECT stops.route_id, 0, stops.stop_sequence, bs.latitude, bs.longitude
+					FROM stops JOIN bus_stop bs ON bs.id = stops.bus_stop_id
+				)
+				UPDATE bus SET route_id = bus.id FROM created WHERE created.id = bus.id;`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// GetRoutes returns the routes, without their directions.
+func (dc DatabaseConnection) GetRoutes() (error, []Route) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT r.id, r.short_name, r.long_name, ARRAY_REMOVE(ARRAY_AGG(b.id ORDER BY b.id), NULL)
+				FROM route r LEFT JOIN bus b ON b.route_id = r.id
+				GROUP BY r.id
+				ORDER BY r.id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	routes := []Route{}
+
+	rows, err := sqlStmt.Query()
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Route
+		err := rows.Scan(
+			&r.Id,
+			&r.ShortName,
+			&r.LongName,
+			pq.Array(&r.BusIds),
+		)
+		if err != nil {
+			return err, nil
+		}
+		routes = append(routes, r)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, routes
+}
+
+// RouteExists reports whether the route exists.
+func (dc DatabaseConnection) RouteExists(routeId string) (err error, exists bool) {
+	err = dc.Db.QueryRow("SELECT EXISTS (SELECT 1 FROM route WHERE id = $1)", routeId).Scan(&exists)
+	return
+}
+
+// GetRoute returns the route with its stops and shape, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) GetRoute(routeId string) (error, Route) {
+	var r Route
+	err := dc.withTransaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT r.id, r.short_name, r.long_name, ARRAY_REMOVE(ARRAY_AGG(b.id ORDER BY b.id), NULL)
+				FROM route r LEFT JOIN bus b ON b.route_id = r.id
+				WHERE r.id = $1
+				GROUP BY r.id`, routeId).Scan(&r.Id, &r.ShortName, &r.LongName, pq.Array(&r.BusIds))
+		if err != nil {
+			return err
+		}
+
+		directions := make(map[int]*RouteDirection)
+		direction := func(directionId int) *RouteDirection {
+			if directions[directionId] == nil {
+				directions[directionId] = &RouteDirection{DirectionId: directionId, Stops: []RouteStop{}, Shape: []RouteShapePoint{}}
+			}
+			return directions[directionId]
+		}
+		rows, err := tx.Query(`SELECT direction_id, stop_sequence, bus_stop_id FROM route_stop WHERE route_id = $1 ORDER BY direction_id, stop_sequence`, routeId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var directionId int
+			var rs RouteStop
+			if err := rows.Scan(&directionId, &rs.StopSequence, &rs.BusStopId); err != nil {
+				return err
+			}
+			d := direction(directionId)
+			d.Stops = append(d.Stops, rs)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.Query(`SELECT direction_id, latitude, longitude FROM route_shape WHERE route_id = $1 ORDER BY direction_id, point_sequence`, routeId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var directionId int
+			var p RouteShapePoint
+			if err := rows.Scan(&directionId, &p.Latitude, &p.Longitude); err != nil {
+				return err
+			}
+			d := direction(directionId)
+			d.Shape = append(d.Shape, p)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for directionId := 0; directionId <= 1; directionId++ {
+			if d, ok := directions[directionId]; ok {
+				r.Directions = append(r.Directions, *d)
+			}
+		}
+		return nil
+	})
+	return err, r
+}
+
+// SaveRoute creates the route, or replaces its names, stops and shape. The
+// stop sequences follow the order of the stops in each direction.
+func (dc DatabaseConnection) SaveRoute(r Route) (err error, created bool) {
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`INSERT INTO route (id, short_name, long_name) VALUES ($1, $2, $3)
+				ON CONFLICT (id) DO UPDATE SET short_name = EXCLUDED.short_name, long_name = EXCLUDED.long_name
+				RETURNING (xmax = 0)`, r.Id, r.ShortName, r.LongName).Scan(&created)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM route_stop WHERE route_id = $1", r.Id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM route_shape WHERE route_id = $1", r.Id); err != nil {
+			return err
+		}
+		stopStmt, err := tx.Prepare("INSERT INTO route_stop (route_id, direction_id, stop_sequence, bus_stop_id) VALUES ($1, $2, $3, $4)")
+		if err != nil {
+			return err
+		}
+		defer stopStmt.Close()
+		shapeStmt, err := tx.Prepare("INSERT INTO route_shape (route_id, direction_id, point_sequence, latitude, longitude) VALUES ($1, $2, $3, $4, $5)")
+		if err != nil {
+			return err
+		}
+		defer shapeStmt.Close()
+		for _, d := range r.Directions {
+			for i, rs := range d.Stops {
+				if _, err := stopStmt.Exec(r.Id, d.DirectionId, i+1, rs.BusStopId); err != nil {
+					var pqErr *pq.Error
+					if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+						return ErrUnknownBusStop
+					}
+					return err
+				}
+			}
+			for i, p := range d.Shape {
+				if _, err := shapeStmt.Exec(r.Id, d.DirectionId, i+1, p.Latitude, p.Longitude); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// AssignBusRoute assigns the bus to the route, or unassigns it when routeId
+// is empty. It returns sql.ErrNoRows if the bus doesn't exist.
+func (dc DatabaseConnection) AssignBusRoute(busId string, routeId string) error {
+	result, err := dc.Db.Exec("UPDATE bus SET route_id = NULLIF($2, '') WHERE id = $1", busId, routeId)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrUnknownRoute
+	}
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetBusRoutes returns the route of every bus assigned to one.
+func (dc DatabaseConnection) GetBusRoutes() (error, map[string]string) {
+	rows, err := dc.Db.Query("SELECT id, route_id FROM bus WHERE route_id IS NOT NULL")
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	routes := make(map[string]string)
+	for rows.Next() {
+		var busId, routeId string
+		if err := rows.Scan(&busId, &routeId); err != nil {
+			return err, nil
+		}
+		routes[busId] = routeId
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, routes
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// NearbyBusStop is a bus stop DistanceMeters away from a location.
+type NearbyBusStop struct {
+	BusStop
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// createSpatialIndexes creates the btree indexes on the bus stop and latest
+// bus position coordinates and, when PostGIS is available, enables it and
+// creates GiST indexes on their points. PostGIS is optional: the error
+// enabling it is printed and the btree indexes are used. Without PostGIS the
+// bus stops are searched in memory, but the box query on the buses is a
+// latitude range scan of the btree index: its longitude only filters the
+// rows of the range, which is enough for the fleet of a city.
+func (dc DatabaseConnection) createSpatialIndexes() (err error) {
+	sqlStmt := `CREATE INDEX IF NOT EXISTS bus_stop_location_idx ON bus_stop (latitude, longitude);
+				CREATE INDEX IF NOT EXISTS bus_latest_position_location_idx ON bus_latest_position (latitude, longitude);`
+	if err = dc.executeTransaction(sqlStmt); err != nil {
+		return
+	}
+	var available bool
+	err = dc.Db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis')").Scan(&available)
+	if err != nil || !available {
+		return
+	}
+	sqlStmt = `CREATE EXTENSION IF NOT EXISTS postgis;
+				CREATE INDEX IF NOT EXISTS bus_stop_geography_idx ON bus_stop USING GIST ((ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography));
+				CREATE INDEX IF NOT EXISTS bus_latest_position_geometry_idx ON bus_latest_position USING GIST ((ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)));`
+	if err := dc.executeTransaction(sqlStmt); err != nil {
+		fmt.Println("PostGIS not enabled, using the btree indexes ", err)
+	}
+	return nil
+}
+
+// HasPostGIS reports whether the PostGIS extension is enabled.
+func (dc DatabaseConnection) HasPostGIS() (err error, enabled bool) {
+	err = dc.Db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'postgis')").Scan(&enabled)
+	return
+}
+
+// GetNearbyBusStops returns at most limit bus stops within radius meters of
+// the location, nearest first. It requires PostGIS.
+func (dc DatabaseConnection) GetNearbyBusStops(latitude float64, longitude float64, radius float64, limit int) (error, []NearbyBusStop) {
+	rows, err := dc.Db.Query(`SELECT id, name, latitude, longitude,
+					ST_Distance(ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography, ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography)
+				FROM bus_stop
+				WHERE ST_DWithin(ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography, ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography, $3)
+				ORDER BY 5, id
+				LIMIT $4`, latitude, longitude, radius, limit)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	busStops := []NearbyBusStop{}
+	for rows.Next() {
+		var bs NearbyBusStop
+		if err := rows.Scan(&bs.Id, &bs.Name, &bs.Latitude, &bs.Longitude, &bs.DistanceMeters); err != nil {
+			return err, nil
+		}
+		busStops = append(busStops, bs)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busStops
+}
+
+// GetBusStatesInBox returns the latest position of the buses currently
+// inside the box, borders included: the buses in service whose position is
+// at most maxStaleness old. A box whose minLongitude is greater than its
+// maxLongitude wraps around the antimeridian. It uses the PostGIS index when
+// postGIS is true and the btree index otherwise.
+func (dc DatabaseConnection) GetBusStatesInBox(minLatitude float64, minLongitude float64, maxLatitude float64, maxLongitude float64, maxStaleness time.Duration, postGIS bool) (error, []BusState) {
+	wraps := minLongitude > maxLongitude
+	where := "p.latitude BETWEEN $1 AND $3 AND p.longitude BETWEEN $2 AND $4"
+	switch {
+	case postGIS && wraps:
+		// An envelope doesn't wrap: the box is split at the antimeridian.
+		where = `(ST_SetSRID(ST_MakePoint(p.longitude, p.latitude), 4326) && ST_MakeEnvelope($2, $1, 180, $3, 4326)
+				OR ST_SetSRID(ST_MakePoint(p.longitude, p.latitude), 4326) && ST_MakeEnvelope(-180, $1, $4, $3, 4326))`
+	case postGIS:
+		where = "ST_SetSRID(ST_MakePoint(p.longitude, p.latitude), 4326) && ST_MakeEnvelope($2, $1, $4, $3, 4326)"
+	case wraps:
+		where = "p.latitude BETWEEN $1 AND $3 AND (p.longitude >= $2 OR p.longitude <= $4)"
+	}
+	rows, err := dc.Db.Query(`SELECT p.bus_id, p.position_id, p.creationtime, p.latitude, p.longitude, p.next_bus_stop_id, p.is_bus_stop, COALESCE(p.trip_id::text, ''),
+					GREATEST(0, EXTRACT(EPOCH FROM (LOCALTIMESTAMP - p.creationtime)))::float8
+				FROM bus_latest_position p JOIN bus b ON b.id = p.bus_id
+				WHERE `+where+` AND b.in_service AND p.creationtime >= LOCALTIMESTAMP - $5 * interval '1 second'
+				ORDER BY p.bus_id`, minLatitude, minLongitude, maxLatitude, maxLongitude, maxStaleness.Seconds())
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	busStates := []BusState{}
+	for rows.Next() {
+		var bs BusState
+		err := rows.Scan(
+			&bs.BusId,
+			&bs.PositionId,
+			&bs.Timestamp,
+			&bs.Latitude,
+			&bs.Longitude,
+			&bs.NextBusStopId,
+			&bs.IsBusStop,
+			&bs.TripId,
+			&bs.StalenessSeconds,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busStates = append(busStates, bs)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busStates
+}
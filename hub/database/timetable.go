@@ -0,0 +1,382 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"hub/start/timetable"
+)
+
+// TimeTableUpload is a time table uploaded for a bus or for a route,
+// effective from a date. An upload effective today or earlier is applied at
+// once; a later one is pending until its date. BusIds lists the buses of the
+// route, which follow the time table of the route once applied.
+type TimeTableUpload struct {
+	Id            string            `json:"id,omitempty"`
+	BusId         string            `json:"bus_id,omitempty"`
+	RouteId       string            `json:"route_id,omitempty"`
+	BusIds        []string          `json:"bus_ids,omitempty"`
+	EffectiveFrom string            `json:"effective_from"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Applied       bool              `json:"applied"`
+	Stops         []timetable.Entry `json:"stops"`
+}
+
+// timeTableOwner is what a time table is uploaded for: a bus or a route.
+type timeTableOwner struct {
+	// column is the column of the owner ID in bus_time_table_upload and in table.
+	column string
+	// table holds the time tables of the owners.
+	table string
+}
+
+var (
+	busTimeTableOwner   = timeTableOwner{column: "bus_id", table: "bus_time_table"}
+	routeTimeTableOwner = timeTableOwner{column: "route_id", table: "route_time_table"}
+)
+
+// createTimeTableUploadTables creates the tables of the pending time table
+// uploads, each for either a bus or a route. A new upload for the same bus or
+// route and date replaces the previous one.
+func (dc DatabaseConnection) createTimeTableUploadTables() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS bus_time_table_upload
+				(
+					id bigserial NOT NULL,
+					bus_id varchar (36) NOT NULL REFERENCES bus(id) ON DELETE CASCADE,
+					effective_from date NOT NULL,
+					created_at timestamp NOT NULL DEFAULT LOCALTIMESTAMP,
+					PRIMARY KEY(id),
+					UNIQUE(bus_id, effective_from)
+				);
+				CREATE TABLE IF NOT EXISTS bus_time_table_upload_stop
+				(
+					upload_id bigint NOT NULL REFERENCES bus_time_table_upload(id) ON DELETE CASCADE,
+					bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					time_seconds INTEGER NOT NULL,
+					PRIMARY KEY(upload_id, bus_stop_id)
+				);
+				ALTER TABLE bus_time_table_upload ADD COLUMN IF NOT EXISTS route_id varchar (36) REFERENCES route(id) ON DELETE CASCADE;
+				ALTER TABLE bus_time_table_upload ALTER COLUMN bus_id DROP NOT NULL;
+				ALTER TABLE bus_time_table_upload DROP CONSTRAINT IF EXISTS bus_time_table_upload_owner;
+				ALTER TABLE bus_time_table_upload ADD CONSTRAINT bus_time_table_upload_owner CHECK ((bus_id IS NULL) <> (route_id IS NULL));
+				CREATE UNIQUE INDEX IF NOT EXISTS bus_time_table_upload_route_id_effective_from_key ON bus_time_table_upload (route_id, effective_from);`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// GetBusTimeTable returns the time table the bus follows, ordered by time.
+func (dc DatabaseConnection) GetBusTimeTable(busId string) (error, []timetable.Entry) {
+	rows, err := dc.Db.Query("SELECT bus_stop_id, time_seconds FROM bus_schedule WHERE bus_id = $1 ORDER BY time_seconds, bus_stop_id", busId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	entries := []timetable.Entry{}
+	for rows.Next() {
+		var entry timetable.Entry
+		if err := rows.Scan(&entry.BusStopId, &entry.TimeSeconds); err != nil {
+			return err, nil
+		}
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, entries
+}
+
+// GetRouteTimeTable returns the time table of the route, ordered by time.
+func (dc DatabaseConnection) GetRouteTimeTable(routeId string) (error, []timetable.Entry) {
+	rows, err := dc.Db.Query("SELECT bus_stop_id, time_seconds FROM route_time_table WHERE route_id = $1 ORDER BY time_seconds, bus_stop_id", routeId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	entries := []timetable.Entry{}
+	for rows.Next() {
+		var entry timetable.Entry
+		if err := rows.Scan(&entry.BusStopId, &entry.TimeSeconds); err != nil {
+			return err, nil
+		}
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, entries
+}
+
+// GetUnknownBusStops returns the IDs that aren't bus stops.
+func (dc DatabaseConnection) GetUnknownBusStops(busStopIds []string) (error, []string) {
+	rows, err := dc.Db.Query(`SELECT id FROM UNNEST($1::varchar[]) WITH ORDINALITY AS ids(id, n)
+				WHERE NOT EXISTS (SELECT 1 FROM bus_stop WHERE bus_stop.id = ids.id)
+				ORDER BY n`, pq.Array(busStopIds))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	unknown := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err, nil
+		}
+		unknown = append(unknown, id)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, unknown
+}
+
+// SaveBusTimeTable replaces the time table of the bus when effectiveFrom is
+// today or earlier, in the time zone of the database, and stores it as a
+// pending upload otherwise. It returns ErrUnknownBusStop if a stop doesn't exist.
+func (dc DatabaseConnection) SaveBusTimeTable(busId string, entries []timetable.Entry, effectiveFrom time.Time) (error, TimeTableUpload) {
+	return dc.saveTimeTable(busTimeTableOwner, busId, entries, effectiveFrom)
+}
+
+// SaveRouteTimeTable replaces the time table of the route, like
+// SaveBusTimeTable. Applying it removes the own time tables of the buses of
+// the route, so that they all follow the time table of the route.
+func (dc DatabaseConnection) SaveRouteTimeTable(routeId string, entries []timetable.Entry, effectiveFrom time.Time) (error, TimeTableUpload) {
+	return dc.saveTimeTable(routeTimeTableOwner, routeId, entries, effectiveFrom)
+}
+
+func (dc DatabaseConnection) saveTimeTable(owner timeTableOwner, ownerId string, entries []timetable.Entry, effectiveFrom time.Time) (err error, upload TimeTableUpload) {
+	upload = TimeTableUpload{EffectiveFrom: effectiveFrom.Format("2006-01-02"), Stops: entries}
+	owner.setId(&upload, ownerId)
+	err = dc.withTransaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT $1::date <= CURRENT_DATE, LOCALTIMESTAMP", upload.EffectiveFrom).Scan(&upload.Applied, &upload.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if owner == routeTimeTableOwner {
+			err := tx.QueryRow("SELECT COALESCE(ARRAY_AGG(id ORDER BY id), '{}') FROM bus WHERE route_id = $1", ownerId).Scan(pq.Array(&upload.BusIds))
+			if err != nil {
+				return err
+			}
+		}
+		if upload.Applied {
+			return replaceTimeTable(tx, owner, ownerId, entries)
+		}
+		err = tx.QueryRow(fmt.Sprintf(`INSERT INTO bus_time_table_upload (%[1]s, effective_from, created_at) VALUES ($1, $2, $3)
+				ON CONFLICT (%[1]s, effective_from) DO UPDATE SET created_at = EXCLUDED.created_at
+				RETURNING id`, owner.column), ownerId, upload.EffectiveFrom, upload.CreatedAt).Scan(&upload.Id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM bus_time_table_upload_stop WHERE upload_id = $1", upload.Id); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare("INSERT INTO bus_time_table_upload_stop (upload_id, bus_stop_id, time_seconds) VALUES ($1, $2, $3)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, entry := range entries {
+			if _, err := stmt.Exec(upload.Id, entry.BusStopId, entry.TimeSeconds); err != nil {
+				return unknownBusStop(err)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (owner timeTableOwner) setId(upload *TimeTableUpload, ownerId string) {
+	if owner == routeTimeTableOwner {
+		upload.RouteId = ownerId
+	} else {
+		upload.BusId = ownerId
+	}
+}
+
+// replaceTimeTable replaces the time table of the bus or route with the
+// entries. The buses of a route lose their own time table.
+func replaceTimeTable(tx *sql.Tx, owner timeTableOwner, ownerId string, entries []timetable.Entry) error {
+	if _, err := tx.Exec("DELETE FROM "+owner.table+" WHERE "+owner.column+" = $1", ownerId); err != nil {
+		return err
+	}
+	if owner == routeTimeTableOwner {
+		if _, err := tx.Exec("DELETE FROM bus_time_table WHERE bus_id IN (SELECT id FROM bus WHERE route_id = $1)", ownerId); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare("INSERT INTO " + owner.table + " (" + owner.column + ", bus_stop_id, time_seconds) VALUES ($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		if _, err := stmt.Exec(ownerId, entry.BusStopId, entry.TimeSeconds); err != nil {
+			return unknownBusStop(err)
+		}
+	}
+	return nil
+}
+
+func unknownBusStop(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrUnknownBusStop
+	}
+	return err
+}
+
+// GetBusTimeTableUploads returns the pending uploads of the bus, ordered by effective date.
+func (dc DatabaseConnection) GetBusTimeTableUploads(busId string) (error, []TimeTableUpload) {
+	return dc.getTimeTableUploads(busTimeTableOwner, busId)
+}
+
+// GetRouteTimeTableUploads returns the pending uploads of the route, ordered by effective date.
+func (dc DatabaseConnection) GetRouteTimeTableUploads(routeId string) (error, []TimeTableUpload) {
+	return dc.getTimeTableUploads(routeTimeTableOwner, routeId)
+}
+
+func (dc DatabaseConnection) getTimeTableUploads(owner timeTableOwner, ownerId string) (error, []TimeTableUpload) {
+	uploads := []TimeTableUpload{}
+	err := dc.withTransaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, to_char(effective_from, 'YYYY-MM-DD'), created_at
+				FROM bus_time_table_upload WHERE `+owner.column+` = $1 ORDER BY effective_from`, ownerId)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var upload TimeTableUpload
+			if err := rows.Scan(&upload.Id, &upload.EffectiveFrom, &upload.CreatedAt); err != nil {
+				return err
+			}
+			owner.setId(&upload, ownerId)
+			uploads = append(uploads, upload)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i := range uploads {
+			if err := loadUploadStops(tx, &uploads[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err, uploads
+}
+
+func loadUploadStops(tx *sql.Tx, upload *TimeTableUpload) error {
+	rows, err := tx.Query("SELECT bus_stop_id, time_seconds FROM bus_time_table_upload_stop WHERE upload_id = $1 ORDER BY time_seconds", upload.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	upload.Stops = []timetable.Entry{}
+	for rows.Next() {
+		var entry timetable.Entry
+		if err := rows.Scan(&entry.BusStopId, &entry.TimeSeconds); err != nil {
+			return err
+		}
+		upload.Stops = append(upload.Stops, entry)
+	}
+	return rows.Err()
+}
+
+// DeleteBusTimeTableUpload cancels a pending upload of the bus, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) DeleteBusTimeTableUpload(busId string, uploadId string) error {
+	return dc.deleteTimeTableUpload(busTimeTableOwner, busId, uploadId)
+}
+
+// DeleteRouteTimeTableUpload cancels a pending upload of the route, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) DeleteRouteTimeTableUpload(routeId string, uploadId string) error {
+	return dc.deleteTimeTableUpload(routeTimeTableOwner, routeId, uploadId)
+}
+
+func (dc DatabaseConnection) deleteTimeTableUpload(owner timeTableOwner, ownerId string, uploadId string) error {
+	result, err := dc.Db.Exec("DELETE FROM bus_time_table_upload WHERE id = $1 AND "+owner.column+" = $2", uploadId, ownerId)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ApplyTimeTableUploads replaces the time tables of the buses and routes
+// with the pending uploads that became effective, in the order of their
+// dates, and deletes them. It returns the uploads applied.
+func (dc DatabaseConnection) ApplyTimeTableUploads() (error, []TimeTableUpload) {
+	applied := []TimeTableUpload{}
+	err := dc.withTransaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, COALESCE(bus_id, ''), COALESCE(route_id, ''), to_char(effective_from, 'YYYY-MM-DD'), created_at
+				FROM bus_time_table_upload WHERE effective_from <= CURRENT_DATE
+				ORDER BY effective_from, id
+				FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			upload := TimeTableUpload{Applied: true}
+			if err := rows.Scan(&upload.Id, &upload.BusId, &upload.RouteId, &upload.EffectiveFrom, &upload.CreatedAt); err != nil {
+				return err
+			}
+			applied = append(applied, upload)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i := range applied {
+			if err := loadUploadStops(tx, &applied[i]); err != nil {
+				return err
+			}
+			owner, ownerId := busTimeTableOwner, applied[i].BusId
+			if applied[i].RouteId != "" {
+				owner, ownerId = routeTimeTableOwner, applied[i].RouteId
+			}
+			if err := replaceTimeTable(tx, owner, ownerId, applied[i].Stops); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM bus_time_table_upload WHERE id = $1", applied[i].Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+	return nil, applied
+}
+
+// GetBusStopTimeTables returns the time tables of the buses in service
+// stopping at the bus stop, keyed by bus and ordered by time.
+func (dc DatabaseConnection) GetBusStopTimeTables(busStopId string) (error, map[string][]BusTimeTable) {
+	rows, err := dc.Db.Query(`SELECT btt.bus_id, btt.bus_stop_id, btt.time_seconds
+				FROM bus_schedule btt JOIN bus b ON b.id = btt.bus_id
+				WHERE b.in_service AND btt.bus_id IN (SELECT bus_id FROM bus_schedule WHERE bus_stop_id = $1)
+				ORDER BY btt.bus_id, btt.time_seconds`, busStopId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	timeTables := make(map[string][]BusTimeTable)
+	for rows.Next() {
+		var btt BusTimeTable
+		if err := rows.Scan(&btt.BusId, &btt.BusStopId, &btt.TimeSeconds); err != nil {
+			return err, nil
+		}
+		timeTables[btt.BusId] = append(timeTables[btt.BusId], btt)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, timeTables
+}
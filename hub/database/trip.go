@@ -0,0 +1,354 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrNoTimeTable is returned when creating a trip for a bus without time table.
+var ErrNoTimeTable = errors.New("bus has no time table")
+
+// ErrTripExists is returned when the bus already has a trip starting at the same time.
+var ErrTripExists = errors.New("trip already exists")
+
+// Trip is a run of a bus along its route, starting at ScheduledStart. Its
+// stops are ordered by StopSequence.
+type Trip struct {
+	Id             string     `json:"id"`
+	BusId          string     `json:"bus_id"`
+	RouteId        string     `json:"route_id"`
+	DirectionId    int        `json:"direction_id"`
+	ScheduledStart time.Time  `json:"scheduled_start"`
+	ScheduledEnd   time.Time  `json:"scheduled_end"`
+	Stops          []TripStop `json:"stops,omitempty"`
+}
+
+// TripStop is the scheduled time of a trip at a bus stop.
+type TripStop struct {
+	StopSequence  int       `json:"stop_sequence"`
+	BusStopId     string    `json:"bus_stop_id"`
+	ScheduledTime time.Time `json:"scheduled_time"`
+}
+
+// createTripTables creates the trip tables, links the bus positions to the
+// trips and assigns every new position to the active trip of its bus. The
+// trips of a deleted route are deleted; the route of the trips created
+// before the constraint isn't checked.
+func (dc DatabaseConnection) createTripTables() (err error) {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS trip
+				(
+					id bigserial NOT NULL,
+					bus_id varchar (36) NOT NULL REFERENCES bus(id),
+					route_id varchar (36) NOT NULL,
+					direction_id SMALLINT NOT NULL DEFAULT 0,
+					scheduled_start timestamp NOT NULL,
+					scheduled_end timestamp NOT NULL,
+					PRIMARY KEY(id),
+					UNIQUE(bus_id, scheduled_start)
+				);
+				CREATE TABLE IF NOT EXISTS trip_stop
+				(
+					trip_id bigint NOT NULL REFERENCES trip(id) ON DELETE CASCADE,
+					stop_sequence INTEGER NOT NULL,
+					bus_stop_id varchar (36) NOT NULL REFERENCES bus_stop(id),
+					scheduled_time timestamp NOT NULL,
+					PRIMARY KEY(trip_id, stop_sequence)
+				);
+				ALTER TABLE bus_position ADD COLUMN IF NOT EXISTS trip_id bigint REFERENCES trip(id) ON DELETE SET NULL;
+				CREATE INDEX IF NOT EXISTS bus_position_trip_id_idx ON bus_position (trip_id, creationtime, id);
+				DO $$
+				BEGIN
+					IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'trip_route_id_fkey') THEN
+						ALTER TABLE trip ADD CONSTRAINT trip_route_id_fkey FOREIGN KEY (route_id) REFERENCES route(id) ON DELETE CASCADE NOT VALID;
+					END IF;
+				END;
+				$$;`
+	if err = dc.executeTransaction(sqlStmt); err != nil {
+		return
+	}
+	// A position belongs to the trip of its bus started last, from 10 minutes
+	// before its scheduled start to 30 minutes after its scheduled end.
+	sqlStmt = `CREATE OR REPLACE FUNCTION assign_bus_position_trip() RETURNS TRIGGER AS
+				$$
+				BEGIN
+					IF NEW.trip_id IS NULL THEN
+						SELECT id INTO NEW.trip_id
+						FROM trip
+						WHERE bus_id = NEW.bus_id
+							AND scheduled_start <= NEW.creationtime + interval '10 minutes'
+							AND scheduled_end + interval '30 minutes' >= NEW.creationtime
+						ORDER BY scheduled_start DESC
+						LIMIT 1;
+					END IF;
+					RETURN NEW;
+				END;
+				$$
+				LANGUAGE plpgsql;
+				DROP TRIGGER IF EXISTS assign_bus_position_trip ON bus_position;
+				CREATE TRIGGER assign_bus_position_trip
+					BEFORE INSERT
+					ON bus_position
+					FOR EACH ROW
+				EXECUTE PROCEDURE assign_bus_position_trip();`
+	err = dc.executeTransaction(sqlStmt)
+	return
+}
+
+// CreateTrips creates one trip of the bus per departure. The stops of each
+// trip are taken from the time table the bus follows, their scheduled time
+// being the departure plus time_seconds.
+func (dc DatabaseConnection) CreateTrips(busId string, routeId string, directionId int, departures []time.Time) (error, []Trip) {
+	var trips []Trip
+	err := dc.withTransaction(func(tx *sql.Tx) error {
+		tripStmt, err := tx.Prepare(`INSERT INTO trip (bus_id, route_id, direction_id, scheduled_start, scheduled_end)
+				SELECT $1, $2, $3, $4::timestamptz::timestamp, $4::timestamptz::timestamp + MAX(time_seconds) * interval '1 second'
+				FROM bus_schedule
+				WHERE bus_id = $1
+				HAVING COUNT(*) > 0
+				RETURNING id`)
+		if err != nil {
+			return err
+		}
+		defer tripStmt.Close()
+		stopStmt, err := tx.Prepare(`INSERT INTO trip_stop (trip_id, stop_sequence, bus_stop_id, scheduled_time)
+				SELECT t.id, ROW_NUMBER() OVER (ORDER BY btt.time_seconds, btt.bus_stop_id), btt.bus_stop_id, t.scheduled_start + btt.time_seconds * interval '1 second'
+				FROM trip t JOIN bus_schedule btt ON btt.bus_id = t.bus_id
+				WHERE t.id = $1`)
+		if err != nil {
+			return err
+		}
+		defer stopStmt.Close()
+
+		for _, departure := range departures {
+			var tripId string
+			err := tripStmt.QueryRow(busId, routeId, directionId, departure).Scan(&tripId)
+			if err == sql.ErrNoRows {
+				return ErrNoTimeTable
+			}
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return ErrTripExists
+			}
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				return ErrUnknownRoute
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := stopStmt.Exec(tripId); err != nil {
+				return err
+			}
+			err, trip := getTrip(tx, tripId)
+			if err != nil {
+				return err
+			}
+			trips = append(trips, trip)
+		}
+		return nil
+	})
+	return err, trips
+}
+
+// GetTrip returns the trip with its stops, sql.ErrNoRows if it doesn't exist.
+func (dc DatabaseConnection) GetTrip(tripId string) (error, Trip) {
+	var trip Trip
+	err := dc.withTransaction(func(tx *sql.Tx) (err error) {
+		err, trip = getTrip(tx, tripId)
+		return
+	})
+	return err, trip
+}
+
+func getTrip(tx *sql.Tx, tripId string) (err error, trip Trip) {
+	err = tx.QueryRow(`SELECT id, bus_id, route_id, direction_id, scheduled_start, scheduled_end FROM trip WHERE id = $1`, tripId).Scan(
+		&trip.Id,
+		&trip.BusId,
+		&trip.RouteId,
+		&trip.DirectionId,
+		&trip.ScheduledStart,
+		&trip.ScheduledEnd,
+	)
+	if err != nil {
+		return
+	}
+	rows, err := tx.Query(`SELECT stop_sequence, bus_stop_id, scheduled_time FROM trip_stop WHERE trip_id = $1 ORDER BY stop_sequence`, tripId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts TripStop
+		if err = rows.Scan(&ts.StopSequence, &ts.BusStopId, &ts.ScheduledTime); err != nil {
+			return
+		}
+		trip.Stops = append(trip.Stops, ts)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetBusTrips returns the trips of the bus starting on the date, in the time zone of the database.
+func (dc DatabaseConnection) GetBusTrips(busId string, date time.Time) (error, []Trip) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT id, bus_id, route_id, direction_id, scheduled_start, scheduled_end
+				FROM trip
+				WHERE bus_id = $1 AND scheduled_start >= $2::date AND scheduled_start < $2::date + 1
+				ORDER BY scheduled_start`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	trips := []Trip{}
+
+	rows, err := sqlStmt.Query(busId, date.Format("2006-01-02"))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var trip Trip
+		err := rows.Scan(
+			&trip.Id,
+			&trip.BusId,
+			&trip.RouteId,
+			&trip.DirectionId,
+			&trip.ScheduledStart,
+			&trip.ScheduledEnd,
+		)
+		if err != nil {
+			return err, nil
+		}
+		trips = append(trips, trip)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, trips
+}
+
+// GetBusTripTimeTableEntries returns the time table of the bus on the date,
+// with one entry per stop of every trip starting on the date. TimeSeconds is
+// the offset of the stop from the start of its trip.
+func (dc DatabaseConnection) GetBusTripTimeTableEntries(busId string, date time.Time) (error, []BusTimeTable) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT t.bus_id, ts.bus_stop_id, EXTRACT(EPOCH FROM ts.scheduled_time - t.scheduled_start)::integer, ts.scheduled_time, t.id
+				FROM trip t JOIN trip_stop ts ON ts.trip_id = t.id
+				WHERE t.bus_id = $1 AND t.scheduled_start >= $2::date AND t.scheduled_start < $2::date + 1
+				ORDER BY t.scheduled_start, ts.stop_sequence`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	busTimeTableEntries := []BusTimeTable{}
+
+	rows, err := sqlStmt.Query(busId, date.Format("2006-01-02"))
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var btt BusTimeTable
+		err := rows.Scan(
+			&btt.BusId,
+			&btt.BusStopId,
+			&btt.TimeSeconds,
+			&btt.Timestamp,
+			&btt.TripId,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busTimeTableEntries = append(busTimeTableEntries, btt)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busTimeTableEntries
+}
+
+// GetTripPositions returns the positions of the trip, ordered by creation time.
+func (dc DatabaseConnection) GetTripPositions(tripId string) (error, []BusPosition) {
+	sqlStmt, err := dc.Db.Prepare(`SELECT id, creationtime, bus_id, latitude, longitude, next_bus_stop_id, is_bus_stop, COALESCE(trip_id::text, ''),
+					received_time, speed, heading, accuracy, sequence
+				FROM bus_position
+				WHERE trip_id = $1
+				ORDER BY creationtime, id`)
+	if err != nil {
+		return err, nil
+	}
+	defer sqlStmt.Close()
+
+	busPositions := []BusPosition{}
+
+	rows, err := sqlStmt.Query(tripId)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bp BusPosition
+		err := rows.Scan(
+			&bp.Id,
+			&bp.CreationTime,
+			&bp.BusId,
+			&bp.Latitude,
+			&bp.Longitude,
+			&bp.NextBusStopId,
+			&bp.IsBusStop,
+			&bp.TripId,
+			&bp.ReceivedTime,
+			&bp.Speed,
+			&bp.Heading,
+			&bp.Accuracy,
+			&bp.Sequence,
+		)
+		if err != nil {
+			return err, nil
+		}
+		busPositions = append(busPositions, bp)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, busPositions
+}
+
+// BusStopTrip is a trip scheduled to stop at a bus stop.
+type BusStopTrip struct {
+	TripId        string
+	BusId         string
+	RouteId       string
+	ScheduledTime time.Time
+}
+
+// GetBusStopTrips returns the trips of the buses in service scheduled at the
+// bus stop from now to within the horizon, ordered by scheduled time.
+func (dc DatabaseConnection) GetBusStopTrips(busStopId string, horizon time.Duration) (error, []BusStopTrip) {
+	rows, err := dc.Db.Query(`SELECT t.id, t.bus_id, t.route_id, ts.scheduled_time
+				FROM trip_stop ts JOIN trip t ON t.id = ts.trip_id JOIN bus b ON b.id = t.bus_id
+				WHERE ts.bus_stop_id = $1 AND b.in_service
+					AND ts.scheduled_time >= LOCALTIMESTAMP AND ts.scheduled_time <= LOCALTIMESTAMP + $2 * interval '1 second'
+				ORDER BY ts.scheduled_time, t.id`, busStopId, horizon.Seconds())
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+	trips := []BusStopTrip{}
+	for rows.Next() {
+		var trip BusStopTrip
+		if err := rows.Scan(&trip.TripId, &trip.BusId, &trip.RouteId, &trip.ScheduledTime); err != nil {
+			return err, nil
+		}
+		trips = append(trips, trip)
+	}
+	if rows.Err() != nil {
+		return rows.Err(), nil
+	}
+	return nil, trips
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"hub/start/database"
+	"hub/start/eta"
+)
+
+const (
+	defaultDepartureLimit = 10
+	maxDepartureLimit     = 100
+	// departureHorizon is how far ahead the scheduled trips of the buses are listed.
+	departureHorizon = 2 * time.Hour
+	// maxDepartureStaleness is the age of the latest position of a bus beyond which it isn't predicted.
+	maxDepartureStaleness = 10 * time.Minute
+	// tripAnchorValidity is how long after its scheduled end a trip started at
+	// the first stop of the time table still gives the scheduled times of a bus.
+	tripAnchorValidity = 30 * time.Minute
+	// arrivalCacheTtl is how long the arrivals of a bus are reused to predict its departures.
+	arrivalCacheTtl = time.Minute
+)
+
+// departure is an upcoming arrival of a bus at a bus stop. A realtime
+// departure is predicted from the latest position of the bus; its scheduled
+// time and delay are null when the bus isn't on a trip. Otherwise it is a
+// scheduled trip, predicted on time, whose delay is unknown.
+type departure struct {
+	BusId         string     `json:"bus_id"`
+	RouteId       string     `json:"route_id,omitempty"`
+	TripId        string     `json:"trip_id,omitempty"`
+	ScheduledTime *time.Time `json:"scheduled_time"`
+	PredictedTime time.Time  `json:"predicted_time"`
+	DelaySeconds  *int       `json:"delay_seconds"`
+	Confidence    float64    `json:"confidence"`
+	Realtime      bool       `json:"realtime"`
+}
+
+// departureBoard lists the upcoming arrivals at a bus stop, ordered by predicted time.
+type departureBoard struct {
+	BusStopId  string      `json:"bus_stop_id"`
+	Name       string      `json:"name"`
+	Departures []departure `json:"departures"`
+}
+
+// arrivalCache keeps the arrivals of the buses at their bus stops, in which
+// the segment travel times are observed. They only change when a bus reaches
+// a stop, so each bus is reloaded at most every arrivalCacheTtl.
+type arrivalCache struct {
+	dc       *database.DatabaseConnection
+	mu       sync.Mutex
+	arrivals map[string]cachedArrivals
+}
+
+type cachedArrivals struct {
+	arrivals []eta.Arrival
+	loadedAt time.Time
+}
+
+func newArrivalCache(dc *database.DatabaseConnection) *arrivalCache {
+	return &arrivalCache{dc: dc, arrivals: make(map[string]cachedArrivals)}
+}
+
+// Arrivals returns the arrivals of the buses, loading the expired ones in a single query.
+func (ac *arrivalCache) Arrivals(busIds []string) (map[string][]eta.Arrival, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	now := time.Now()
+	arrivals := make(map[string][]eta.Arrival, len(busIds))
+	expired := []string{}
+	for _, busId := range busIds {
+		if cached, ok := ac.arrivals[busId]; ok && now.Sub(cached.loadedAt) < arrivalCacheTtl {
+			arrivals[busId] = cached.arrivals
+		} else {
+			expired = append(expired, busId)
+		}
+	}
+	if len(expired) == 0 {
+		return arrivals, nil
+	}
+	err, loaded := ac.dc.GetBusesStopArrivals(expired, etaPositions)
+	if err != nil {
+		return nil, err
+	}
+	for busId, cached := range ac.arrivals {
+		if now.Sub(cached.loadedAt) >= arrivalCacheTtl {
+			delete(ac.arrivals, busId)
+		}
+	}
+	for _, busId := range expired {
+		arrivals[busId] = etaArrivals(loaded[busId])
+		ac.arrivals[busId] = cachedArrivals{arrivals: arrivals[busId], loadedAt: now}
+	}
+	return arrivals, nil
+}
+
+// liveDepartures predicts the arrivals at the bus stop of the buses of the
+// time tables from their latest position, querying all the buses at once.
+// activeTrips are the trips of the latest positions, predicted or not.
+func (h *Handler) liveDepartures(busStopId string, timeTables map[string][]database.BusTimeTable) (departures []departure, activeTrips map[string]bool, err error) {
+	busIds := make([]string, 0, len(timeTables))
+	for busId := range timeTables {
+		busIds = append(busIds, busId)
+	}
+	err, busStates := h.DC.GetBusStatesOf(busIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	activeTrips = make(map[string]bool)
+	recent := []string{}
+	for _, busState := range busStates {
+		if busState.TripId != "" {
+			activeTrips[busState.TripId] = true
+		}
+		if time.Duration(busState.StalenessSeconds*float64(time.Second)) <= maxDepartureStaleness {
+			recent = append(recent, busState.BusId)
+		}
+	}
+	departures = []departure{}
+	if len(recent) == 0 {
+		return departures, activeTrips, nil
+	}
+	busStops, err := h.Spatial.BusStops()
+	if err != nil {
+		return nil, nil, err
+	}
+	arrivals, err := h.Arrivals.Arrivals(recent)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, busId := range recent {
+		d, ok, err := liveDeparture(busStopId, busStates[busId], timeTables[busId], busStops, arrivals[busId])
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			d.RouteId = h.Routes.Route(busId)
+			departures = append(departures, d)
+		}
+	}
+	if err := h.scheduleDepartures(busStopId, departures, busStates, timeTables); err != nil {
+		return nil, nil, err
+	}
+	return departures, activeTrips, nil
+}
+
+// liveDeparture predicts the arrival of the bus at the bus stop from its
+// latest position, time table and arrivals. ok is false when the bus has
+// already passed the bus stop.
+func liveDeparture(busStopId string, busState database.BusState, timeTable []database.BusTimeTable, busStops map[string]database.BusStop, arrivals []eta.Arrival) (d departure, ok bool, err error) {
+	d = departure{BusId: busState.BusId, TripId: busState.TripId, Realtime: true}
+	if busState.IsBusStop && busState.NextBusStopId == busStopId {
+		now := busState.Timestamp.Add(time.Duration(busState.StalenessSeconds * float64(time.Second)))
+		d.PredictedTime, d.Confidence = now.Round(time.Second), 1
+		return d, true, nil
+	}
+	stops, err := etaStops(timeTable, busStops)
+	if err != nil {
+		return d, false, err
+	}
+	position, err := etaPosition(busState)
+	if err != nil {
+		return d, false, err
+	}
+	for _, prediction := range eta.Predict(stops, position, arrivals) {
+		if prediction.BusStopId == busStopId {
+			d.PredictedTime, d.Confidence = prediction.Arrival, prediction.Confidence
+			return d, true, nil
+		}
+	}
+	return d, false, nil
+}
+
+// scheduleDepartures sets the scheduled time and delay of the live
+// departures: the time of the trip of the bus or, without trip, the time
+// table offset added to the trip start observed at the first stop. They stay
+// null when the bus is on neither.
+func (h *Handler) scheduleDepartures(busStopId string, departures []departure, busStates map[string]database.BusState, timeTables map[string][]database.BusTimeTable) error {
+	tripIds, busIds := []string{}, []string{}
+	for _, d := range departures {
+		if d.TripId != "" {
+			tripIds = append(tripIds, d.TripId)
+		} else {
+			busIds = append(busIds, d.BusId)
+		}
+	}
+	scheduledTimes, tripStarts := map[string]time.Time{}, map[string]time.Time{}
+	var err error
+	if len(tripIds) > 0 {
+		if err, scheduledTimes = h.DC.GetTripsScheduledTimes(tripIds, busStopId); err != nil {
+			return err
+		}
+	}
+	if len(busIds) > 0 {
+		if err, tripStarts = h.DC.GetLatestTripStarts(busIds); err != nil {
+			return err
+		}
+	}
+	for i := range departures {
+		d := &departures[i]
+		scheduled := scheduledTimes[d.TripId]
+		if tripStart, ok := tripStarts[d.BusId]; ok && d.TripId == "" {
+			busState := busStates[d.BusId]
+			now := busState.Timestamp.Add(time.Duration(busState.StalenessSeconds * float64(time.Second)))
+			scheduled = anchoredTime(busStopId, timeTables[d.BusId], tripStart, now)
+		}
+		if !scheduled.IsZero() {
+			delay := int(d.PredictedTime.Sub(scheduled).Round(time.Second) / time.Second)
+			d.ScheduledTime, d.DelaySeconds = &scheduled, &delay
+		}
+	}
+	return nil
+}
+
+// anchoredTime returns the time table offset of the bus stop added to the
+// trip start. It is zero when the bus stop isn't in the time table or when
+// the trip ended more than tripAnchorValidity before now.
+func anchoredTime(busStopId string, timeTable []database.BusTimeTable, tripStart time.Time, now time.Time) time.Time {
+	if len(timeTable) == 0 || tripStart.Add(timeTable[len(timeTable)-1].TimeSeconds*time.Second).Add(tripAnchorValidity).Before(now) {
+		return time.Time{}
+	}
+	for _, btt := range timeTable {
+		if btt.BusStopId == busStopId {
+			return tripStart.Add(btt.TimeSeconds * time.Second)
+		}
+	}
+	return time.Time{}
+}
+
+// scheduledDepartures returns the departures of the scheduled trips, leaving
+// out the trips the buses are running. A bus predicted without a trip is
+// taken to run its first scheduled trip, which is left out too so that the
+// bus isn't listed twice.
+func scheduledDepartures(trips []database.BusStopTrip, activeTrips map[string]bool, live []departure) []departure {
+	untracked := make(map[string]bool)
+	for _, d := range live {
+		if d.TripId == "" {
+			untracked[d.BusId] = true
+		}
+	}
+	departures := []departure{}
+	for _, trip := range trips {
+		if activeTrips[trip.TripId] {
+			continue
+		}
+		if untracked[trip.BusId] {
+			delete(untracked, trip.BusId)
+			continue
+		}
+		scheduled := trip.ScheduledTime
+		departures = append(departures, departure{
+			BusId:         trip.BusId,
+			RouteId:       trip.RouteId,
+			TripId:        trip.TripId,
+			ScheduledTime: &scheduled,
+			PredictedTime: scheduled,
+		})
+	}
+	return departures
+}
+
+func sortDepartures(departures []departure) {
+	sort.SliceStable(departures, func(i, j int) bool {
+		if !departures[i].PredictedTime.Equal(departures[j].PredictedTime) {
+			return departures[i].PredictedTime.Before(departures[j].PredictedTime)
+		}
+		return departures[i].BusId < departures[j].BusId
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"hub/start/database"
+)
+
+var departureStart = time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+// departureTimeTable stops at A, B then C, two minutes apart and 0.01° of latitude apart.
+var departureTimeTable = []database.BusTimeTable{
+	{BusStopId: "A", TimeSeconds: 0},
+	{BusStopId: "B", TimeSeconds: 120},
+	{BusStopId: "C", TimeSeconds: 240},
+}
+
+var departureBusStops = map[string]database.BusStop{
+	"A": {Id: "A", Latitude: "0", Longitude: "0"},
+	"B": {Id: "B", Latitude: "0.01", Longitude: "0"},
+	"C": {Id: "C", Latitude: "0.02", Longitude: "0"},
+}
+
+func TestLiveDeparture(t *testing.T) {
+	tests := []struct {
+		name      string
+		busState  database.BusState
+		want      time.Time
+		wantOk    bool
+		wantError bool
+	}{
+		{
+			name:     "at the bus stop",
+			busState: database.BusState{BusId: "1", Timestamp: departureStart, Latitude: "0.01", Longitude: "0", NextBusStopId: "B", IsBusStop: true, StalenessSeconds: 30},
+			want:     departureStart.Add(30 * time.Second),
+			wantOk:   true,
+		},
+		{
+			name:     "before the bus stop",
+			busState: database.BusState{BusId: "1", Timestamp: departureStart, Latitude: "0", Longitude: "0", NextBusStopId: "A", IsBusStop: true},
+			want:     departureStart.Add(2 * time.Minute),
+			wantOk:   true,
+		},
+		{
+			name:     "bus stop passed",
+			busState: database.BusState{BusId: "1", Timestamp: departureStart, Latitude: "0.02", Longitude: "0", NextBusStopId: "C", IsBusStop: true},
+		},
+		{
+			name:      "wrong location",
+			busState:  database.BusState{BusId: "1", Timestamp: departureStart, Latitude: "north", Longitude: "0", NextBusStopId: "A"},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		d, ok, err := liveDeparture("B", tt.busState, departureTimeTable, departureBusStops, nil)
+		if (err != nil) != tt.wantError {
+			t.Errorf("%s: liveDeparture() error = %v, want error %v", tt.name, err, tt.wantError)
+			continue
+		}
+		if ok != tt.wantOk {
+			t.Errorf("%s: liveDeparture() ok = %v, want %v", tt.name, ok, tt.wantOk)
+			continue
+		}
+		if ok && (!d.PredictedTime.Equal(tt.want) || d.BusId != "1" || !d.Realtime) {
+			t.Errorf("%s: liveDeparture() = %+v, want predicted at %v", tt.name, d, tt.want)
+		}
+	}
+}
+
+func TestAnchoredTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		busStopId string
+		timeTable []database.BusTimeTable
+		now       time.Time
+		want      time.Time
+	}{
+		{name: "during the trip", busStopId: "B", timeTable: departureTimeTable, now: departureStart.Add(time.Minute), want: departureStart.Add(2 * time.Minute)},
+		{name: "shortly after the trip end", busStopId: "C", timeTable: departureTimeTable, now: departureStart.Add(30 * time.Minute), want: departureStart.Add(4 * time.Minute)},
+		{name: "trip ended long ago", busStopId: "B", timeTable: departureTimeTable, now: departureStart.Add(35 * time.Minute)},
+		{name: "bus stop not in the time table", busStopId: "Z", timeTable: departureTimeTable, now: departureStart},
+		{name: "no time table", busStopId: "B", now: departureStart},
+	}
+	for _, tt := range tests {
+		if got := anchoredTime(tt.busStopId, tt.timeTable, departureStart, tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: anchoredTime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScheduledDepartures(t *testing.T) {
+	trips := []database.BusStopTrip{
+		{TripId: "10", BusId: "1", RouteId: "R", ScheduledTime: departureStart},
+		{TripId: "20", BusId: "2", RouteId: "R", ScheduledTime: departureStart.Add(5 * time.Minute)},
+		{TripId: "11", BusId: "1", RouteId: "R", ScheduledTime: departureStart.Add(time.Hour)},
+		{TripId: "21", BusId: "2", RouteId: "R", ScheduledTime: departureStart.Add(time.Hour + 5*time.Minute)},
+	}
+	tests := []struct {
+		name        string
+		activeTrips map[string]bool
+		live        []departure
+		want        []string
+	}{
+		{name: "no live bus", want: []string{"10", "20", "11", "21"}},
+		{name: "active trips left out", activeTrips: map[string]bool{"10": true, "21": true}, want: []string{"20", "11"}},
+		{
+			name:        "bus on its trip listed once",
+			activeTrips: map[string]bool{"10": true},
+			live:        []departure{{BusId: "1", TripId: "10", Realtime: true}},
+			want:        []string{"20", "11", "21"},
+		},
+		{
+			name: "bus without trip listed once",
+			live: []departure{{BusId: "2", Realtime: true}},
+			want: []string{"10", "11", "21"},
+		},
+		{
+			name: "buses without trip",
+			live: []departure{{BusId: "1", Realtime: true}, {BusId: "2", Realtime: true}},
+			want: []string{"11", "21"},
+		},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, d := range scheduledDepartures(trips, tt.activeTrips, tt.live) {
+			if d.Realtime || d.ScheduledTime == nil || !d.PredictedTime.Equal(*d.ScheduledTime) {
+				t.Errorf("%s: scheduled departure %+v", tt.name, d)
+			}
+			got = append(got, d.TripId)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: scheduledDepartures() trips = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+)
+
+const (
+	// deviceKeyHeader is the request header holding the API key of a bus device.
+	deviceKeyHeader = "X-Api-Key"
+	// defaultKeyGrace is how long the previous keys of a bus stay valid after a rotation.
+	defaultKeyGrace = time.Hour
+	// minDeviceKeyGrace is the shortest grace period of a rotation by a
+	// device, so that a leaked key can't revoke the other keys of its bus at
+	// once. An admin may revoke them with a grace period of 0.
+	minDeviceKeyGrace = 10 * time.Minute
+	// maxKeyGrace is the longest grace period of a rotation.
+	maxKeyGrace = 7 * 24 * time.Hour
+)
+
+// rotatedDeviceKey is a new API key of a bus, with the keys of the bus still valid.
+type rotatedDeviceKey struct {
+	BusId  string               `json:"bus_id"`
+	ApiKey string               `json:"api_key"`
+	Keys   []database.DeviceKey `json:"keys"`
+}
+
+// newDeviceKey returns a random API key and its hash.
+func newDeviceKey() (key string, hash string, err error) {
+	data := make([]byte, 32)
+	if _, err = rand.Read(data); err != nil {
+		return
+	}
+	key = hex.EncodeToString(data)
+	return key, hashDeviceKey(key), nil
+}
+
+// hashDeviceKey returns the SHA-256 of the key, as stored.
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDeviceKeys reads the keys provisioned with BUS_DEVICE_KEYS, given as
+// comma-separated bus_id=key pairs, and returns the bus of every key hash.
+func parseDeviceKeys(value string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		busId, key, ok := strings.Cut(pair, "=")
+		if !ok || busId == "" || key == "" {
+			return nil, fmt.Errorf("invalid device key %q: must be bus_id=key", pair)
+		}
+		keys[hashDeviceKey(key)] = busId
+	}
+	return keys, nil
+}
+
+// authenticateDevice returns the bus of the API key of the request. It
+// answers 401 and reports false when the key is missing or invalid.
+func (h *Handler) authenticateDevice(c *gin.Context) (busId string, ok bool) {
+	key := c.GetHeader(deviceKeyHeader)
+	if key == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "api key required"})
+		return "", false
+	}
+	err, busId := h.DC.GetDeviceKeyBus(hashDeviceKey(key))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while checking api key", "detail": err})
+		return "", false
+	}
+	return busId, true
+}
+
+// parseKeyGrace reads the query parameter grace_seconds, between minGrace
+// and maxKeyGrace, defaultKeyGrace if it is missing.
+func parseKeyGrace(c *gin.Context, minGrace time.Duration) (time.Duration, error) {
+	value := c.Query("grace_seconds")
+	if value == "" {
+		return defaultKeyGrace, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || time.Duration(seconds)*time.Second < minGrace || time.Duration(seconds)*time.Second > maxKeyGrace {
+		return 0, fmt.Errorf("grace_seconds must be between %d and %d", int(minGrace.Seconds()), int(maxKeyGrace.Seconds()))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// curl -X POST "http://localhost:9090/hub/bus/492/api_key?grace_seconds=3600" --header "X-Api-Key: <key>"
+func (h *Handler) RotateDeviceKey(c *gin.Context) {
+	busId := c.Param("bus_id")
+	deviceBusId, ok := h.authenticateDevice(c)
+	if !ok {
+		return
+	}
+	if deviceBusId != busId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key is not a key of the bus"})
+		return
+	}
+	grace, err := parseKeyGrace(c, minDeviceKeyGrace)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.rotateDeviceKey(c, busId, grace)
+}
+
+// curl -X POST "http://localhost:9090/hub/bus/492/api_keys?grace_seconds=0" --header "Authorization: Bearer <token>"
+func (h *Handler) IssueDeviceKey(c *gin.Context) {
+	grace, err := parseKeyGrace(c, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.rotateDeviceKey(c, c.Param("bus_id"), grace)
+}
+
+// rotateDeviceKey creates a new key of the bus, its other keys expiring after the grace period.
+func (h *Handler) rotateDeviceKey(c *gin.Context, busId string, grace time.Duration) {
+	key, hash, err := newDeviceKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating api key", "detail": err})
+		return
+	}
+	err, _ = h.DC.RotateDeviceKey(busId, hash, grace)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while rotating api key", "detail": err})
+		return
+	}
+	err, keys := h.DC.GetDeviceKeys(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving api keys", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, rotatedDeviceKey{BusId: busId, ApiKey: key, Keys: keys})
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492/api_keys --header "Authorization: Bearer <token>"
+func (h *Handler) GetDeviceKeys(c *gin.Context) {
+	busId := c.Param("bus_id")
+	err, exists := h.DC.BusExists(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	err, keys := h.DC.GetDeviceKeys(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving api keys", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, keys)
+}
+
+// curl -X DELETE http://localhost:9090/hub/bus/492/api_keys/1 --header "Authorization: Bearer <token>"
+func (h *Handler) RevokeDeviceKey(c *gin.Context) {
+	err := h.DC.RevokeDeviceKey(c.Param("bus_id"), c.Param("key_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while revoking api key", "detail": err})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseDeviceKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: map[string]string{}},
+		{name: "pairs", value: " 492=key-a, 493=key-b ,", want: map[string]string{hashDeviceKey("key-a"): "492", hashDeviceKey("key-b"): "493"}},
+		{name: "key with an equal sign", value: "492=a=b", want: map[string]string{hashDeviceKey("a=b"): "492"}},
+		{name: "no key", value: "492", wantErr: true},
+		{name: "empty key", value: "492=", wantErr: true},
+		{name: "empty bus", value: "=key", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDeviceKeys(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseDeviceKeys() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseDeviceKeys() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseKeyGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		minGrace time.Duration
+		want     time.Duration
+		wantErr  bool
+	}{
+		{name: "default", minGrace: minDeviceKeyGrace, want: defaultKeyGrace},
+		{name: "device rotation", query: "grace_seconds=600", minGrace: minDeviceKeyGrace, want: 10 * time.Minute},
+		{name: "device revoking the other keys", query: "grace_seconds=0", minGrace: minDeviceKeyGrace, wantErr: true},
+		{name: "device shortening the grace", query: "grace_seconds=599", minGrace: minDeviceKeyGrace, wantErr: true},
+		{name: "admin revoking the other keys", query: "grace_seconds=0", want: 0},
+		{name: "longest grace", query: "grace_seconds=604800", want: maxKeyGrace},
+		{name: "grace too long", query: "grace_seconds=604801", wantErr: true},
+		{name: "negative grace", query: "grace_seconds=-1", wantErr: true},
+		{name: "not a number", query: "grace_seconds=hour", wantErr: true},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/hub/bus/492/api_key?"+tt.query, nil)
+		got, err := parseKeyGrace(c, tt.minGrace)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseKeyGrace() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: parseKeyGrace() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"hub/start/database"
+	"hub/start/eta"
+)
+
+// etaPositions is the number of latest positions of a bus in which the segment travel times are observed.
+const etaPositions = 5000
+
+// busEta holds the predicted arrivals of a bus, computed from its latest position.
+type busEta struct {
+	BusId            string           `json:"bus_id"`
+	PositionId       string           `json:"position_id"`
+	Timestamp        time.Time        `json:"timestamp"`
+	StalenessSeconds float64          `json:"staleness_seconds"`
+	Predictions      []eta.Prediction `json:"predictions"`
+}
+
+// etaStops joins the time table entries of a bus with the location of their bus stops.
+func etaStops(busTimeTableEntries []database.BusTimeTable, busStops map[string]database.BusStop) ([]eta.Stop, error) {
+	stops := make([]eta.Stop, 0, len(busTimeTableEntries))
+	for _, btt := range busTimeTableEntries {
+		bs, ok := busStops[btt.BusStopId]
+		if !ok {
+			return nil, fmt.Errorf("unknown bus stop %s", btt.BusStopId)
+		}
+		latitude, longitude, err := parseLocation(bs.Latitude, bs.Longitude)
+		if err != nil {
+			return nil, fmt.Errorf("bus stop %s: %w", bs.Id, err)
+		}
+		stops = append(stops, eta.Stop{
+			Id:        bs.Id,
+			Latitude:  latitude,
+			Longitude: longitude,
+			Offset:    btt.TimeSeconds * time.Second,
+		})
+	}
+	return stops, nil
+}
+
+func etaPosition(bs database.BusState) (eta.Position, error) {
+	latitude, longitude, err := parseLocation(bs.Latitude, bs.Longitude)
+	if err != nil {
+		return eta.Position{}, err
+	}
+	return eta.Position{
+		Time:       bs.Timestamp,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		NextStopId: bs.NextBusStopId,
+		AtStop:     bs.IsBusStop,
+		Staleness:  time.Duration(bs.StalenessSeconds * float64(time.Second)),
+	}, nil
+}
+
+func etaArrivals(arrivals []database.BusStopArrival) []eta.Arrival {
+	etaArrivals := make([]eta.Arrival, 0, len(arrivals))
+	for _, a := range arrivals {
+		etaArrivals = append(etaArrivals, eta.Arrival{StopId: a.BusStopId, Time: a.Time})
+	}
+	return etaArrivals
+}
+
+func parseLocation(latitude string, longitude string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude %q", latitude)
+	}
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude %q", longitude)
+	}
+	return lat, lon, nil
+}
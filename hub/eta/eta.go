@@ -0,0 +1,231 @@
+// Package eta predicts the arrival of a bus at its remaining stops.
+//
+// The arrival at the next stop is projected from the latest position, on the
+// share of the current segment left to travel. The following stops are
+// reached adding the travel time of each segment: the median of the recently
+// observed travel times between the two stops, or the time table difference
+// when the segment hasn't been observed.
+//
+// Every prediction carries a confidence between 0 and 1: the product of the
+// confidence of the segments travelled to reach the stop, reduced as the
+// latest position gets older.
+package eta
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"hub/start/geo"
+)
+
+const (
+	// SourceObserved marks a travel time taken from the observed arrivals.
+	SourceObserved = "observed"
+	// SourceScheduled marks a travel time taken from the time table.
+	SourceScheduled = "scheduled"
+	// SourceDistance marks a travel time estimated from the distance, before the first stop.
+	SourceDistance = "distance"
+
+	// sampleSize is the number of most recent observations kept per segment.
+	sampleSize = 5
+	// outlierFactor discards observations longer than this multiple of the scheduled time.
+	outlierFactor = 3
+	// defaultSpeed is the speed in meters per second used to reach the first stop.
+	defaultSpeed = 5.5
+	// stalenessHalfLife halves the confidence of the predictions of an old position.
+	stalenessHalfLife = 5 * time.Minute
+
+	scheduledConfidence = 0.6
+	distanceConfidence  = 0.5
+)
+
+// Stop is a stop of the time table, reached Offset after the start of the trip.
+type Stop struct {
+	Id        string
+	Latitude  float64
+	Longitude float64
+	Offset    time.Duration
+}
+
+// Arrival is the time a bus reached a stop.
+type Arrival struct {
+	StopId string
+	Time   time.Time
+}
+
+// Position is the latest position of a bus, received Staleness ago.
+type Position struct {
+	Time       time.Time
+	Latitude   float64
+	Longitude  float64
+	NextStopId string
+	AtStop     bool
+	Staleness  time.Duration
+}
+
+// Prediction is the predicted arrival of a bus at a stop. ArrivalSeconds is
+// the time left before the arrival, counted from now.
+type Prediction struct {
+	BusStopId      string    `json:"bus_stop_id"`
+	Arrival        time.Time `json:"arrival"`
+	ArrivalSeconds float64   `json:"arrival_seconds"`
+	Confidence     float64   `json:"confidence"`
+	Source         string    `json:"source"`
+}
+
+// segment is the travel time between a stop and the next one.
+type segment struct {
+	duration   time.Duration
+	confidence float64
+	source     string
+}
+
+// Predict returns the predicted arrival at the next stop of the position and
+// at the following stops of the time table. A bus at a stop isn't predicted
+// at that stop. No prediction is made if the next stop isn't in the time table.
+func Predict(stops []Stop, position Position, arrivals []Arrival) []Prediction {
+	stops = append([]Stop(nil), stops...)
+	sort.SliceStable(stops, func(i, j int) bool {
+		return stops[i].Offset < stops[j].Offset
+	})
+	next := -1
+	for i, stop := range stops {
+		if stop.Id == position.NextStopId {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return []Prediction{}
+	}
+
+	segments := observedSegments(stops, arrivals)
+	now := position.Time.Add(position.Staleness)
+	arrival := position.Time
+	confidence := math.Pow(0.5, float64(position.Staleness)/float64(stalenessHalfLife))
+	predictions := []Prediction{}
+
+	first := next
+	if position.AtStop {
+		first = next + 1
+	} else {
+		var s segment
+		distance := geo.Distance(position.Latitude, position.Longitude, stops[next].Latitude, stops[next].Longitude)
+		if next == 0 {
+			s = segment{
+				duration:   time.Duration(distance / defaultSpeed * float64(time.Second)),
+				confidence: distanceConfidence,
+				source:     SourceDistance,
+			}
+		} else {
+			s = segmentTime(stops, next, segments)
+			length := geo.Distance(stops[next-1].Latitude, stops[next-1].Longitude, stops[next].Latitude, stops[next].Longitude)
+			share := 0.0
+			if length > 0 {
+				share = math.Min(1, distance/length)
+			}
+			s.duration = time.Duration(share * float64(s.duration))
+		}
+		arrival, confidence = arrival.Add(s.duration), confidence*s.confidence
+		// The bus hasn't reported the arrival yet: it is late, not arrived.
+		if arrival.Before(now) {
+			arrival = now
+		}
+		predictions = append(predictions, newPrediction(stops[next].Id, arrival, now, confidence, s.source))
+		first = next + 1
+	}
+
+	for i := first; i < len(stops); i++ {
+		s := segmentTime(stops, i, segments)
+		arrival, confidence = arrival.Add(s.duration), confidence*s.confidence
+		if arrival.Before(now) {
+			arrival = now
+		}
+		predictions = append(predictions, newPrediction(stops[i].Id, arrival, now, confidence, s.source))
+	}
+	return predictions
+}
+
+func newPrediction(stopId string, arrival time.Time, now time.Time, confidence float64, source string) Prediction {
+	return Prediction{
+		BusStopId:      stopId,
+		Arrival:        arrival.Round(time.Second),
+		ArrivalSeconds: math.Round(arrival.Sub(now).Seconds()),
+		Confidence:     math.Round(confidence*100) / 100,
+		Source:         source,
+	}
+}
+
+// segmentTime returns the travel time from the stop i-1 to the stop i.
+func segmentTime(stops []Stop, i int, observed map[int][]time.Duration) segment {
+	samples := observed[i]
+	if len(samples) == 0 {
+		return segment{
+			duration:   stops[i].Offset - stops[i-1].Offset,
+			confidence: scheduledConfidence,
+			source:     SourceScheduled,
+		}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a] < sorted[b]
+	})
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	// The confidence grows with the number of observations and shrinks with their dispersion.
+	var mean, variance float64
+	for _, sample := range samples {
+		mean += sample.Seconds()
+	}
+	mean /= float64(len(samples))
+	for _, sample := range samples {
+		variance += (sample.Seconds() - mean) * (sample.Seconds() - mean)
+	}
+	variance /= float64(len(samples))
+	variation := 0.0
+	if mean > 0 {
+		variation = math.Sqrt(variance) / mean
+	}
+	n := float64(len(samples))
+	return segment{
+		duration:   median,
+		confidence: 0.95 * n / (n + 1) / (1 + variation),
+		source:     SourceObserved,
+	}
+}
+
+// observedSegments returns the most recent travel times observed into each
+// stop of the time table, keyed by the stop index. Arrivals must be ordered
+// by time; only arrivals at consecutive stops of the time table are used.
+func observedSegments(stops []Stop, arrivals []Arrival) map[int][]time.Duration {
+	index := make(map[string]int, len(stops))
+	for i, stop := range stops {
+		if _, ok := index[stop.Id]; !ok {
+			index[stop.Id] = i
+		}
+	}
+	segments := make(map[int][]time.Duration)
+	for i := 1; i < len(arrivals); i++ {
+		from, ok := index[arrivals[i-1].StopId]
+		if !ok {
+			continue
+		}
+		to, ok := index[arrivals[i].StopId]
+		if !ok || to != from+1 {
+			continue
+		}
+		duration := arrivals[i].Time.Sub(arrivals[i-1].Time)
+		scheduled := stops[to].Offset - stops[from].Offset
+		if duration <= 0 || (scheduled > 0 && duration > outlierFactor*scheduled) {
+			continue
+		}
+		segments[to] = append(segments[to], duration)
+		if len(segments[to]) > sampleSize {
+			segments[to] = segments[to][1:]
+		}
+	}
+	return segments
+}
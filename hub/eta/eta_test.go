@@ -0,0 +1,166 @@
+package eta
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stops are 0.01° of latitude apart, about 1112 m, two minutes apart in the time table.
+var stops = []Stop{
+	{Id: "A", Latitude: 0, Longitude: 0, Offset: 0},
+	{Id: "B", Latitude: 0.01, Longitude: 0, Offset: 2 * time.Minute},
+	{Id: "C", Latitude: 0.02, Longitude: 0, Offset: 4 * time.Minute},
+	{Id: "D", Latitude: 0.03, Longitude: 0, Offset: 6 * time.Minute},
+}
+
+var start = time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+
+// trips returns the arrivals at A then B of successive trips, B being reached after each duration.
+func trips(durations ...time.Duration) []Arrival {
+	var arrivals []Arrival
+	t := start.Add(-24 * time.Hour)
+	for _, d := range durations {
+		arrivals = append(arrivals, Arrival{StopId: "A", Time: t}, Arrival{StopId: "B", Time: t.Add(d)})
+		t = t.Add(time.Hour)
+	}
+	return arrivals
+}
+
+func TestPredict(t *testing.T) {
+	tests := []struct {
+		name     string
+		stops    []Stop
+		position Position
+		arrivals []Arrival
+		want     []Prediction
+	}{
+		{
+			name:     "next stop not in the time table",
+			stops:    stops,
+			position: Position{Time: start, NextStopId: "Z", AtStop: true},
+			want:     []Prediction{},
+		},
+		{
+			name:     "at a stop, scheduled",
+			stops:    stops,
+			position: Position{Time: start, NextStopId: "B", AtStop: true},
+			want: []Prediction{
+				{BusStopId: "C", ArrivalSeconds: 120, Confidence: 0.6, Source: SourceScheduled},
+				{BusStopId: "D", ArrivalSeconds: 240, Confidence: 0.36, Source: SourceScheduled},
+			},
+		},
+		{
+			name:     "stops sorted by offset",
+			stops:    []Stop{stops[3], stops[1], stops[2], stops[0]},
+			position: Position{Time: start, NextStopId: "B", AtStop: true},
+			want: []Prediction{
+				{BusStopId: "C", ArrivalSeconds: 120, Confidence: 0.6, Source: SourceScheduled},
+				{BusStopId: "D", ArrivalSeconds: 240, Confidence: 0.36, Source: SourceScheduled},
+			},
+		},
+		{
+			name:     "halfway to the next stop",
+			stops:    stops,
+			position: Position{Time: start, Latitude: 0.005, NextStopId: "B"},
+			want: []Prediction{
+				{BusStopId: "B", ArrivalSeconds: 60, Confidence: 0.6, Source: SourceScheduled},
+				{BusStopId: "C", ArrivalSeconds: 180, Confidence: 0.36, Source: SourceScheduled},
+				{BusStopId: "D", ArrivalSeconds: 300, Confidence: 0.22, Source: SourceScheduled},
+			},
+		},
+		{
+			name:     "before the first stop",
+			stops:    stops[:2],
+			position: Position{Time: start, Latitude: -0.01, NextStopId: "A"},
+			want: []Prediction{
+				{BusStopId: "A", ArrivalSeconds: 202, Confidence: 0.5, Source: SourceDistance},
+				{BusStopId: "B", ArrivalSeconds: 322, Confidence: 0.3, Source: SourceScheduled},
+			},
+		},
+		{
+			name:     "odd number of observations",
+			stops:    stops[:2],
+			position: Position{Time: start, NextStopId: "A", AtStop: true},
+			arrivals: trips(100*time.Second, 140*time.Second, 120*time.Second),
+			want:     []Prediction{{BusStopId: "B", ArrivalSeconds: 120, Confidence: 0.63, Source: SourceObserved}},
+		},
+		{
+			name:     "even number of observations",
+			stops:    stops[:2],
+			position: Position{Time: start, NextStopId: "A", AtStop: true},
+			arrivals: trips(100*time.Second, 160*time.Second),
+			want:     []Prediction{{BusStopId: "B", ArrivalSeconds: 130, Confidence: 0.51, Source: SourceObserved}},
+		},
+		{
+			name:     "identical observations",
+			stops:    stops[:2],
+			position: Position{Time: start, NextStopId: "A", AtStop: true},
+			arrivals: trips(90*time.Second, 90*time.Second, 90*time.Second, 90*time.Second),
+			want:     []Prediction{{BusStopId: "B", ArrivalSeconds: 90, Confidence: 0.76, Source: SourceObserved}},
+		},
+		{
+			name:     "only the most recent observations",
+			stops:    stops[:2],
+			position: Position{Time: start, NextStopId: "A", AtStop: true},
+			arrivals: trips(10*time.Second, 10*time.Second, 90*time.Second, 90*time.Second, 90*time.Second, 90*time.Second, 90*time.Second),
+			want:     []Prediction{{BusStopId: "B", ArrivalSeconds: 90, Confidence: 0.79, Source: SourceObserved}},
+		},
+		{
+			name:     "outliers and negative durations discarded",
+			stops:    stops[:2],
+			position: Position{Time: start, NextStopId: "A", AtStop: true},
+			arrivals: trips(-30*time.Second, 0, 361*time.Second, 90*time.Second),
+			want:     []Prediction{{BusStopId: "B", ArrivalSeconds: 90, Confidence: 0.48, Source: SourceObserved}},
+		},
+		{
+			name:     "skipped stops not observed",
+			stops:    stops[:3],
+			position: Position{Time: start, NextStopId: "B", AtStop: true},
+			arrivals: []Arrival{{StopId: "A", Time: start.Add(-time.Hour)}, {StopId: "C", Time: start.Add(-time.Hour + time.Minute)}},
+			want:     []Prediction{{BusStopId: "C", ArrivalSeconds: 120, Confidence: 0.6, Source: SourceScheduled}},
+		},
+		{
+			name:     "stale position",
+			stops:    stops,
+			position: Position{Time: start, NextStopId: "B", AtStop: true, Staleness: 5 * time.Minute},
+			want: []Prediction{
+				{BusStopId: "C", ArrivalSeconds: 0, Confidence: 0.3, Source: SourceScheduled},
+				{BusStopId: "D", ArrivalSeconds: 120, Confidence: 0.18, Source: SourceScheduled},
+			},
+		},
+		{
+			// The following stops are reached from now, not from the overdue arrival.
+			name:     "late bus predicted now",
+			stops:    stops,
+			position: Position{Time: start, NextStopId: "B", AtStop: true, Staleness: 3 * time.Minute},
+			want: []Prediction{
+				{BusStopId: "C", ArrivalSeconds: 0, Confidence: 0.4, Source: SourceScheduled},
+				{BusStopId: "D", ArrivalSeconds: 120, Confidence: 0.24, Source: SourceScheduled},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Predict(tt.stops, tt.position, tt.arrivals)
+			now := tt.position.Time.Add(tt.position.Staleness)
+			for i := range got {
+				if want := now.Add(time.Duration(got[i].ArrivalSeconds) * time.Second); !got[i].Arrival.Equal(want) {
+					t.Errorf("prediction %d: Arrival = %v, want now + ArrivalSeconds %v", i, got[i].Arrival, want)
+				}
+				got[i].Arrival = time.Time{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Predict() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictDoesNotModifyStops(t *testing.T) {
+	unsorted := []Stop{stops[2], stops[0], stops[1]}
+	Predict(unsorted, Position{Time: start, NextStopId: "A", AtStop: true}, nil)
+	if unsorted[0].Id != "C" || unsorted[1].Id != "A" || unsorted[2].Id != "B" {
+		t.Errorf("Predict() reordered the stops: %+v", unsorted)
+	}
+}
@@ -0,0 +1,32 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{name: "same location", lat1: 52.52, lon1: 13.405, lat2: 52.52, lon2: 13.405, want: 0},
+		{name: "one degree of latitude", lat1: 0, lon1: 0, lat2: 1, lon2: 0, want: 111195.08},
+		{name: "one degree of longitude at the equator", lat1: 0, lon1: 0, lat2: 0, lon2: 1, want: 111195.08},
+		{name: "one degree of longitude at 60°", lat1: 60, lon1: 0, lat2: 60, lon2: 1, want: 55597.26},
+		{name: "across the antimeridian", lat1: 0, lon1: 179.5, lat2: 0, lon2: -179.5, want: 111195.08},
+		{name: "pole to pole", lat1: 90, lon1: 0, lat2: -90, lon2: 0, want: math.Pi * EarthRadius},
+		{name: "antipodes", lat1: 0, lon1: 0, lat2: 0, lon2: 180, want: math.Pi * EarthRadius},
+		{name: "Berlin to Paris", lat1: 52.52, lon1: 13.405, lat2: 48.8566, lon2: 2.3522, want: 877464},
+	}
+	for _, tt := range tests {
+		got := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		if math.Abs(got-tt.want) > 1 {
+			t.Errorf("%s: Distance() = %.2f, want %.2f", tt.name, got, tt.want)
+		}
+		if back := Distance(tt.lat2, tt.lon2, tt.lat1, tt.lon1); math.Abs(back-got) > 1e-6 {
+			t.Errorf("%s: Distance() isn't symmetric: %.2f and %.2f", tt.name, got, back)
+		}
+	}
+}
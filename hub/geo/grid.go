@@ -0,0 +1,90 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// metersPerDegree is the length in meters of a degree of latitude.
+const metersPerDegree = EarthRadius * math.Pi / 180
+
+// Point is a location indexed by a Grid.
+type Point struct {
+	Id        string
+	Latitude  float64
+	Longitude float64
+}
+
+// Neighbor is a point found near a location, Distance meters away.
+type Neighbor struct {
+	Point
+	Distance float64
+}
+
+type cell struct {
+	row, column int
+}
+
+// Grid is an in-memory spatial index, splitting the locations into cells of
+// CellSize degrees of latitude and longitude. It is read-only once built.
+type Grid struct {
+	cellSize float64
+	cells    map[cell][]Point
+}
+
+// NewGrid indexes the points in cells of cellSize degrees.
+func NewGrid(points []Point, cellSize float64) *Grid {
+	g := &Grid{cellSize: cellSize, cells: make(map[cell][]Point)}
+	for _, p := range points {
+		c := g.cellOf(p.Latitude, p.Longitude)
+		g.cells[c] = append(g.cells[c], p)
+	}
+	return g
+}
+
+func (g *Grid) cellOf(latitude float64, longitude float64) cell {
+	return cell{row: int(math.Floor(latitude / g.cellSize)), column: int(math.Floor(longitude / g.cellSize))}
+}
+
+// Nearby returns the points within radius meters of the location, nearest
+// first. The search wraps around the antimeridian and spans every longitude
+// near the poles.
+func (g *Grid) Nearby(latitude float64, longitude float64, radius float64) []Neighbor {
+	deltaLatitude := radius / metersPerDegree
+	deltaLongitude := 180.0
+	if cos := math.Cos(latitude * math.Pi / 180); cos*metersPerDegree*180 > radius {
+		deltaLongitude = radius / (metersPerDegree * cos)
+	}
+	from := g.cellOf(math.Max(-90, latitude-deltaLatitude), math.Max(-180, longitude-deltaLongitude))
+	to := g.cellOf(math.Min(90, latitude+deltaLatitude), math.Min(180, longitude+deltaLongitude))
+	// The columns searched, split in two where they cross the antimeridian.
+	columns := [][2]int{{from.column, to.column}}
+	if deltaLongitude < 180 {
+		if west := longitude - deltaLongitude; west < -180 {
+			columns = append(columns, [2]int{max(g.cellOf(0, west+360).column, to.column+1), g.cellOf(0, 180).column})
+		}
+		if east := longitude + deltaLongitude; east > 180 {
+			columns = append(columns, [2]int{g.cellOf(0, -180).column, min(g.cellOf(0, east-360).column, from.column-1)})
+		}
+	}
+
+	neighbors := []Neighbor{}
+	for row := from.row; row <= to.row; row++ {
+		for _, span := range columns {
+			for column := span[0]; column <= span[1]; column++ {
+				for _, p := range g.cells[cell{row: row, column: column}] {
+					if distance := Distance(latitude, longitude, p.Latitude, p.Longitude); distance <= radius {
+						neighbors = append(neighbors, Neighbor{Point: p, Distance: distance})
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Distance != neighbors[j].Distance {
+			return neighbors[i].Distance < neighbors[j].Distance
+		}
+		return neighbors[i].Id < neighbors[j].Id
+	})
+	return neighbors
+}
@@ -0,0 +1,56 @@
+package geo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGridNearby(t *testing.T) {
+	grid := NewGrid([]Point{
+		{Id: "tiburtina", Latitude: 41.9096, Longitude: 12.52975},
+		{Id: "cipro", Latitude: 41.9076, Longitude: 12.4473},
+		{Id: "termini", Latitude: 41.9010, Longitude: 12.5016},
+		{Id: "below the cell border", Latitude: 0.0099, Longitude: 0},
+		{Id: "above the cell border", Latitude: 0.0101, Longitude: 0},
+		{Id: "same place a", Latitude: 10, Longitude: 10},
+		{Id: "same place b", Latitude: 10, Longitude: 10},
+		{Id: "east of the antimeridian", Latitude: 0, Longitude: -179.999},
+		{Id: "west of the antimeridian", Latitude: 0, Longitude: 179.999},
+		{Id: "north pole", Latitude: 90, Longitude: 0},
+		{Id: "near the north pole", Latitude: 89.999, Longitude: 100},
+		{Id: "south pole", Latitude: -90, Longitude: 0},
+	}, 0.01)
+
+	tests := []struct {
+		name                string
+		latitude, longitude float64
+		radius              float64
+		want                []string
+	}{
+		{name: "nearest first", latitude: 41.9096, longitude: 12.52975, radius: 3000, want: []string{"tiburtina", "termini"}},
+		{name: "nothing in range", latitude: 45, longitude: 9, radius: 1000, want: []string{}},
+		{name: "across a cell border", latitude: 0.01, longitude: 0, radius: 50, want: []string{"above the cell border", "below the cell border"}},
+		{name: "ties ordered by id", latitude: 10, longitude: 10, radius: 1, want: []string{"same place a", "same place b"}},
+		{name: "across the antimeridian from the west", latitude: 0, longitude: 179.9995, radius: 500, want: []string{"west of the antimeridian", "east of the antimeridian"}},
+		{name: "across the antimeridian from the east", latitude: 0, longitude: -179.9995, radius: 500, want: []string{"east of the antimeridian", "west of the antimeridian"}},
+		{name: "around the north pole", latitude: 89.9995, longitude: -80, radius: 500, want: []string{"north pole", "near the north pole"}},
+		{name: "at the south pole", latitude: -90, longitude: 45, radius: 10, want: []string{"south pole"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		previous := 0.0
+		for _, neighbor := range grid.Nearby(tt.latitude, tt.longitude, tt.radius) {
+			if neighbor.Distance > tt.radius || neighbor.Distance < previous {
+				t.Errorf("%s: %s is %.2f m away, after %.2f m", tt.name, neighbor.Id, neighbor.Distance, previous)
+			}
+			if d := Distance(tt.latitude, tt.longitude, neighbor.Latitude, neighbor.Longitude); d != neighbor.Distance {
+				t.Errorf("%s: %s distance %.2f, want %.2f", tt.name, neighbor.Id, neighbor.Distance, d)
+			}
+			previous = neighbor.Distance
+			got = append(got, neighbor.Id)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Nearby() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+	"hub/start/geojson"
+)
+
+// busPositionPageCollection is a page of positions as GeoJSON, with the cursor of the next page.
+type busPositionPageCollection struct {
+	geojson.FeatureCollection
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// wantsGeoJSON reports whether the client asks for GeoJSON, with the format
+// parameter geojson or an Accept header including application/geo+json.
+func wantsGeoJSON(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "geojson"
+	}
+	return strings.Contains(c.GetHeader("Accept"), geojson.MediaType)
+}
+
+// writeGeoJSON writes the GeoJSON document, or the error that prevented its encoding.
+func writeGeoJSON(c *gin.Context, document any, err error) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while encoding the GeoJSON", "detail": err.Error()})
+		return
+	}
+	c.Header("Content-Type", geojson.MediaType)
+	c.IndentedJSON(http.StatusOK, document)
+}
+
+func busStopCollection(busStops []database.BusStop) (geojson.FeatureCollection, error) {
+	features := make([]geojson.Feature, 0, len(busStops))
+	for _, bs := range busStops {
+		latitude, longitude, err := parseLocation(bs.Latitude, bs.Longitude)
+		if err != nil {
+			return geojson.FeatureCollection{}, fmt.Errorf("bus stop %s: %w", bs.Id, err)
+		}
+		features = append(features, geojson.NewFeature(bs.Id, geojson.Point(latitude, longitude), map[string]any{
+			"name": bs.Name,
+		}))
+	}
+	return geojson.NewFeatureCollection(features), nil
+}
+
+func busCollection(buses []database.Bus) (geojson.FeatureCollection, error) {
+	features := make([]geojson.Feature, 0, len(buses))
+	for _, b := range buses {
+		latitude, longitude, err := parseLocation(b.Latitude, b.Longitude)
+		if err != nil {
+			return geojson.FeatureCollection{}, fmt.Errorf("bus %s: %w", b.Id, err)
+		}
+		properties := map[string]any{
+			"label":      b.Label,
+			"in_service": b.InService,
+		}
+		if b.RouteId != "" {
+			properties["route_id"] = b.RouteId
+		}
+		if b.DecommissionedAt != nil {
+			properties["decommissioned_at"] = b.DecommissionedAt
+		}
+		features = append(features, geojson.NewFeature(b.Id, geojson.Point(latitude, longitude), properties))
+	}
+	return geojson.NewFeatureCollection(features), nil
+}
+
+// routeCollection returns the shape of every direction of the route as a
+// line. Directions with fewer than two shape points are left out.
+func routeCollection(route database.Route) geojson.FeatureCollection {
+	features := make([]geojson.Feature, 0, len(route.Directions))
+	for _, d := range route.Directions {
+		if len(d.Shape) < 2 {
+			continue
+		}
+		positions := make([]geojson.Position, len(d.Shape))
+		for i, p := range d.Shape {
+			positions[i] = geojson.Position{p.Longitude, p.Latitude}
+		}
+		busStopIds := make([]string, len(d.Stops))
+		for i, rs := range d.Stops {
+			busStopIds[i] = rs.BusStopId
+		}
+		features = append(features, geojson.NewFeature(fmt.Sprintf("%s/%d", route.Id, d.DirectionId), geojson.LineString(positions), map[string]any{
+			"route_id":     route.Id,
+			"short_name":   route.ShortName,
+			"long_name":    route.LongName,
+			"direction_id": d.DirectionId,
+			"bus_stop_ids": busStopIds,
+			"bus_ids":      route.BusIds,
+		}))
+	}
+	return geojson.NewFeatureCollection(features)
+}
+
+func busPositionCollection(busPositions []database.BusPosition) (geojson.FeatureCollection, error) {
+	features := make([]geojson.Feature, 0, len(busPositions))
+	for _, bp := range busPositions {
+		latitude, longitude, err := parseLocation(bp.Latitude, bp.Longitude)
+		if err != nil {
+			return geojson.FeatureCollection{}, fmt.Errorf("bus position %s: %w", bp.Id, err)
+		}
+		properties := map[string]any{
+			"bus_id":           bp.BusId,
+			"creationtime":     bp.CreationTime,
+			"next_bus_stop_id": bp.NextBusStopId,
+			"is_bus_stop":      bp.IsBusStop,
+		}
+		if bp.TripId != "" {
+			properties["trip_id"] = bp.TripId
+		}
+		features = append(features, geojson.NewFeature(bp.Id, geojson.Point(latitude, longitude), properties))
+	}
+	return geojson.NewFeatureCollection(features), nil
+}
+
+func busStateCollection(busStates []database.BusState) (geojson.FeatureCollection, error) {
+	features := make([]geojson.Feature, 0, len(busStates))
+	for _, bs := range busStates {
+		latitude, longitude, err := parseLocation(bs.Latitude, bs.Longitude)
+		if err != nil {
+			return geojson.FeatureCollection{}, fmt.Errorf("bus %s: %w", bs.BusId, err)
+		}
+		properties := map[string]any{
+			"position_id":       bs.PositionId,
+			"timestamp":         bs.Timestamp,
+			"next_bus_stop_id":  bs.NextBusStopId,
+			"is_bus_stop":       bs.IsBusStop,
+			"staleness_seconds": bs.StalenessSeconds,
+		}
+		if bs.TripId != "" {
+			properties["trip_id"] = bs.TripId
+		}
+		features = append(features, geojson.NewFeature(bs.BusId, geojson.Point(latitude, longitude), properties))
+	}
+	return geojson.NewFeatureCollection(features), nil
+}
@@ -0,0 +1,48 @@
+// Package geojson encodes locations and lines as GeoJSON (RFC 7946), with
+// their coordinates in longitude, latitude order.
+package geojson
+
+// MediaType is the media type of the GeoJSON documents.
+const MediaType = "application/geo+json"
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string         `json:"type"`
+	Id         string         `json:"id,omitempty"`
+	Geometry   Geometry       `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// Geometry is a Point, whose coordinates are a position, or a LineString,
+// whose coordinates are an array of positions.
+type Geometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// Position is a longitude and a latitude.
+type Position [2]float64
+
+func NewFeatureCollection(features []Feature) FeatureCollection {
+	if features == nil {
+		features = []Feature{}
+	}
+	return FeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+func NewFeature(id string, geometry Geometry, properties map[string]any) Feature {
+	return Feature{Type: "Feature", Id: id, Geometry: geometry, Properties: properties}
+}
+
+func Point(latitude float64, longitude float64) Geometry {
+	return Geometry{Type: "Point", Coordinates: Position{longitude, latitude}}
+}
+
+// LineString returns the line joining the positions, which must be at least two.
+func LineString(positions []Position) Geometry {
+	return Geometry{Type: "LineString", Coordinates: positions}
+}
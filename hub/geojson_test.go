@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+	"hub/start/geojson"
+)
+
+func TestWantsGeoJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   bool
+	}{
+		{name: "no preference"},
+		{name: "JSON accepted", accept: "application/json", want: false},
+		{name: "GeoJSON accepted", accept: "application/geo+json", want: true},
+		{name: "GeoJSON among other types", accept: "application/json;q=0.5, application/geo+json", want: true},
+		{name: "format geojson", query: "format=geojson", want: true},
+		{name: "format json over a GeoJSON Accept", query: "format=json", accept: "application/geo+json", want: false},
+		{name: "format geojson over a JSON Accept", query: "format=geojson", accept: "application/json", want: true},
+		{name: "unknown format", query: "format=xml", accept: "application/geo+json", want: false},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/hub/bus_stop?"+tt.query, nil)
+		if tt.accept != "" {
+			c.Request.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsGeoJSON(c); got != tt.want {
+			t.Errorf("%s: wantsGeoJSON() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBusStopCollection(t *testing.T) {
+	tests := []struct {
+		name     string
+		busStops []database.BusStop
+		want     string
+		wantErr  bool
+	}{
+		{name: "no bus stop", want: `{"type":"FeatureCollection","features":[]}`},
+		{
+			name:     "longitude first",
+			busStops: []database.BusStop{{Id: "1", Name: "Tiburtina", Latitude: "41.9096", Longitude: "12.52975"}},
+			want:     `{"type":"FeatureCollection","features":[{"type":"Feature","id":"1","geometry":{"type":"Point","coordinates":[12.52975,41.9096]},"properties":{"name":"Tiburtina"}}]}`,
+		},
+		{name: "invalid location", busStops: []database.BusStop{{Id: "1", Latitude: "north", Longitude: "12.52975"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		collection, err := busStopCollection(tt.busStops)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: busStopCollection() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got, err := json.Marshal(collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: busStopCollection() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRouteCollection(t *testing.T) {
+	route := database.Route{
+		Id:     "R1",
+		BusIds: []string{"492"},
+		Directions: []database.RouteDirection{
+			{DirectionId: 0, Stops: []database.RouteStop{{StopSequence: 1, BusStopId: "A"}, {StopSequence: 2, BusStopId: "B"}}, Shape: []database.RouteShapePoint{{Latitude: 41.9, Longitude: 12.5}, {Latitude: 41.91, Longitude: 12.52}}},
+			{DirectionId: 1, Stops: []database.RouteStop{{StopSequence: 1, BusStopId: "B"}}, Shape: []database.RouteShapePoint{{Latitude: 41.91, Longitude: 12.52}}},
+		},
+	}
+	collection := routeCollection(route)
+	if len(collection.Features) != 1 {
+		t.Fatalf("routeCollection() has %d features, want the direction with a shape only", len(collection.Features))
+	}
+	feature := collection.Features[0]
+	want := []geojson.Position{{12.5, 41.9}, {12.52, 41.91}}
+	if feature.Id != "R1/0" || feature.Geometry.Type != "LineString" {
+		t.Errorf("routeCollection() feature %s of type %s, want R1/0 of type LineString", feature.Id, feature.Geometry.Type)
+	}
+	if got, ok := feature.Geometry.Coordinates.([]geojson.Position); !ok || len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("routeCollection() coordinates %v, want %v", feature.Geometry.Coordinates, want)
+	}
+}
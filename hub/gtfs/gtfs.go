@@ -0,0 +1,520 @@
+// Package gtfs reads and validates GTFS static feeds.
+package gtfs
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxIdLength, MaxNameLength and MaxLongNameLength are the sizes of the varchar columns the feed is loaded into.
+const (
+	MaxIdLength       = 36
+	MaxNameLength     = 36
+	MaxLongNameLength = 255
+)
+
+type Stop struct {
+	Id        string
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+type Route struct {
+	Id        string
+	ShortName string
+	LongName  string
+	Type      int
+}
+
+type Trip struct {
+	Id          string
+	RouteId     string
+	ServiceId   string
+	ShapeId     string
+	DirectionId int
+}
+
+// StopTime is a stop of a trip. ArrivalTime is the time since midnight of
+// the service day, and HasTime is false for stops without arrival and departure times.
+type StopTime struct {
+	TripId       string
+	StopId       string
+	StopSequence int
+	ArrivalTime  time.Duration
+	HasTime      bool
+}
+
+type ShapePoint struct {
+	ShapeId   string
+	Latitude  float64
+	Longitude float64
+	Sequence  int
+}
+
+type Calendar struct {
+	ServiceId string
+	Weekdays  [7]bool
+	StartDate time.Time
+	EndDate   time.Time
+}
+
+// Rejection describes a row of the feed that failed validation.
+type Rejection struct {
+	File   string `json:"file"`
+	Line   int    `json:"line,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Feed is a validated GTFS feed. Rows failing validation are left out and listed in Rejected.
+type Feed struct {
+	Stops       []Stop
+	Routes      []Route
+	Trips       []Trip
+	StopTimes   []StopTime
+	ShapePoints []ShapePoint
+	Calendars   []Calendar
+	Rejected    []Rejection
+}
+
+// RejectedIn returns the number of rejected rows of the given file.
+func (f *Feed) RejectedIn(file string) (count int) {
+	for _, r := range f.Rejected {
+		if r.File == file {
+			count++
+		}
+	}
+	return
+}
+
+// ReadZip reads and validates the GTFS feed stored in the given zip file.
+// stops.txt, routes.txt, trips.txt and stop_times.txt are required;
+// shapes.txt and calendar.txt are validated when present.
+func ReadZip(path string) (*Feed, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		name := f.Name
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		files[name] = f
+	}
+
+	feed := &Feed{}
+	readers := []struct {
+		name     string
+		required bool
+		read     func(*table) error
+	}{
+		{"stops.txt", true, feed.readStops},
+		{"routes.txt", true, feed.readRoutes},
+		{"calendar.txt", false, feed.readCalendars},
+		{"shapes.txt", false, feed.readShapePoints},
+		{"trips.txt", true, feed.readTrips},
+		{"stop_times.txt", true, feed.readStopTimes},
+	}
+	for _, r := range readers {
+		f, ok := files[r.name]
+		if !ok {
+			if r.required {
+				return nil, fmt.Errorf("missing required file %s", r.name)
+			}
+			continue
+		}
+		if err := readFile(f, r.name, r.read); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.name, err)
+		}
+	}
+	return feed, nil
+}
+
+func readFile(f *zip.File, name string, read func(*table) error) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	t, err := newTable(name, rc)
+	if err != nil {
+		return err
+	}
+	return read(t)
+}
+
+// table iterates over the rows of a GTFS CSV file, giving access to the fields by column name.
+type table struct {
+	name    string
+	reader  *csv.Reader
+	columns map[string]int
+	record  []string
+	line    int
+}
+
+func newTable(name string, r io.Reader) (*table, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+		columns[column] = i
+	}
+	return &table{name: name, reader: reader, columns: columns, line: 1}, nil
+}
+
+func (t *table) require(columns ...string) error {
+	for _, column := range columns {
+		if _, ok := t.columns[column]; !ok {
+			return fmt.Errorf("missing required column %s", column)
+		}
+	}
+	return nil
+}
+
+func (t *table) next() (bool, error) {
+	record, err := t.reader.Read()
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t.record = record
+	t.line++
+	return true, nil
+}
+
+func (t *table) get(column string) string {
+	i, ok := t.columns[column]
+	if !ok || i >= len(t.record) {
+		return ""
+	}
+	return strings.TrimSpace(t.record[i])
+}
+
+func (t *table) reject(feed *Feed, format string, args ...any) {
+	feed.Rejected = append(feed.Rejected, Rejection{
+		File:   t.name,
+		Line:   t.line,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func validId(id string) error {
+	if id == "" {
+		return errors.New("empty")
+	}
+	if utf8.RuneCountInString(id) > MaxIdLength {
+		return fmt.Errorf("longer than %d characters", MaxIdLength)
+	}
+	return nil
+}
+
+func parseCoordinate(value string, limit float64) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a number: %q", value)
+	}
+	if f < -limit || f > limit {
+		return 0, fmt.Errorf("%v out of range [-%v, %v]", f, limit, limit)
+	}
+	return f, nil
+}
+
+// parseTime parses a GTFS time, which can exceed 24:00:00 for trips ending after midnight.
+func parseTime(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	var fields [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (i > 0 && n > 59) {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		fields[i] = n
+	}
+	return time.Duration(fields[0])*time.Hour + time.Duration(fields[1])*time.Minute + time.Duration(fields[2])*time.Second, nil
+}
+
+func (f *Feed) readStops(t *table) error {
+	if err := t.require("stop_id"); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		id := t.get("stop_id")
+		if err := validId(id); err != nil {
+			t.reject(f, "stop_id %q: %v", id, err)
+			continue
+		}
+		// Only stops and platforms can be served by a bus: stations, entrances and nodes are skipped.
+		if locationType := t.get("location_type"); locationType != "" && locationType != "0" {
+			continue
+		}
+		if seen[id] {
+			t.reject(f, "duplicate stop_id %q", id)
+			continue
+		}
+		name := t.get("stop_name")
+		if name == "" {
+			t.reject(f, "stop %s: empty stop_name", id)
+			continue
+		}
+		if utf8.RuneCountInString(name) > MaxNameLength {
+			t.reject(f, "stop %s: stop_name longer than %d characters", id, MaxNameLength)
+			continue
+		}
+		latitude, err := parseCoordinate(t.get("stop_lat"), 90)
+		if err != nil {
+			t.reject(f, "stop %s: stop_lat %v", id, err)
+			continue
+		}
+		longitude, err := parseCoordinate(t.get("stop_lon"), 180)
+		if err != nil {
+			t.reject(f, "stop %s: stop_lon %v", id, err)
+			continue
+		}
+		seen[id] = true
+		f.Stops = append(f.Stops, Stop{Id: id, Name: name, Latitude: latitude, Longitude: longitude})
+	}
+}
+
+func (f *Feed) readRoutes(t *table) error {
+	if err := t.require("route_id", "route_type"); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		id := t.get("route_id")
+		if err := validId(id); err != nil {
+			t.reject(f, "route_id %q: %v", id, err)
+			continue
+		}
+		if seen[id] {
+			t.reject(f, "duplicate route_id %q", id)
+			continue
+		}
+		shortName, longName := t.get("route_short_name"), t.get("route_long_name")
+		if shortName == "" && longName == "" {
+			t.reject(f, "route %s: route_short_name and route_long_name are both empty", id)
+			continue
+		}
+		if utf8.RuneCountInString(shortName) > MaxNameLength {
+			t.reject(f, "route %s: route_short_name longer than %d characters", id, MaxNameLength)
+			continue
+		}
+		if utf8.RuneCountInString(longName) > MaxLongNameLength {
+			t.reject(f, "route %s: route_long_name longer than %d characters", id, MaxLongNameLength)
+			continue
+		}
+		routeType, err := strconv.Atoi(t.get("route_type"))
+		if err != nil {
+			t.reject(f, "route %s: invalid route_type %q", id, t.get("route_type"))
+			continue
+		}
+		seen[id] = true
+		f.Routes = append(f.Routes, Route{Id: id, ShortName: shortName, LongName: longName, Type: routeType})
+	}
+}
+
+func (f *Feed) readCalendars(t *table) error {
+	weekdays := []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+	if err := t.require(append([]string{"service_id", "start_date", "end_date"}, weekdays...)...); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+rows:
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		c := Calendar{ServiceId: t.get("service_id")}
+		if c.ServiceId == "" {
+			t.reject(f, "empty service_id")
+			continue
+		}
+		if seen[c.ServiceId] {
+			t.reject(f, "duplicate service_id %q", c.ServiceId)
+			continue
+		}
+		for i, day := range weekdays {
+			switch t.get(day) {
+			case "0":
+			case "1":
+				c.Weekdays[i] = true
+			default:
+				t.reject(f, "service %s: invalid %s %q", c.ServiceId, day, t.get(day))
+				continue rows
+			}
+		}
+		if c.StartDate, err = time.Parse("20060102", t.get("start_date")); err != nil {
+			t.reject(f, "service %s: invalid start_date %q", c.ServiceId, t.get("start_date"))
+			continue
+		}
+		if c.EndDate, err = time.Parse("20060102", t.get("end_date")); err != nil {
+			t.reject(f, "service %s: invalid end_date %q", c.ServiceId, t.get("end_date"))
+			continue
+		}
+		if c.EndDate.Before(c.StartDate) {
+			t.reject(f, "service %s: end_date before start_date", c.ServiceId)
+			continue
+		}
+		seen[c.ServiceId] = true
+		f.Calendars = append(f.Calendars, c)
+	}
+}
+
+func (f *Feed) readShapePoints(t *table) error {
+	if err := t.require("shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"); err != nil {
+		return err
+	}
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		p := ShapePoint{ShapeId: t.get("shape_id")}
+		if err := validId(p.ShapeId); err != nil {
+			t.reject(f, "shape_id %q: %v", p.ShapeId, err)
+			continue
+		}
+		if p.Latitude, err = parseCoordinate(t.get("shape_pt_lat"), 90); err != nil {
+			t.reject(f, "shape %s: shape_pt_lat %v", p.ShapeId, err)
+			continue
+		}
+		if p.Longitude, err = parseCoordinate(t.get("shape_pt_lon"), 180); err != nil {
+			t.reject(f, "shape %s: shape_pt_lon %v", p.ShapeId, err)
+			continue
+		}
+		if p.Sequence, err = strconv.Atoi(t.get("shape_pt_sequence")); err != nil || p.Sequence < 0 {
+			t.reject(f, "shape %s: invalid shape_pt_sequence %q", p.ShapeId, t.get("shape_pt_sequence"))
+			continue
+		}
+		f.ShapePoints = append(f.ShapePoints, p)
+	}
+}
+
+func (f *Feed) readTrips(t *table) error {
+	if err := t.require("route_id", "service_id", "trip_id"); err != nil {
+		return err
+	}
+	routes := make(map[string]bool, len(f.Routes))
+	for _, r := range f.Routes {
+		routes[r.Id] = true
+	}
+	services := make(map[string]bool, len(f.Calendars))
+	for _, c := range f.Calendars {
+		services[c.ServiceId] = true
+	}
+	seen := make(map[string]bool)
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		trip := Trip{
+			Id:        t.get("trip_id"),
+			RouteId:   t.get("route_id"),
+			ServiceId: t.get("service_id"),
+			ShapeId:   t.get("shape_id"),
+		}
+		if trip.Id == "" {
+			t.reject(f, "empty trip_id")
+			continue
+		}
+		if seen[trip.Id] {
+			t.reject(f, "duplicate trip_id %q", trip.Id)
+			continue
+		}
+		if !routes[trip.RouteId] {
+			t.reject(f, "trip %s: unknown route_id %q", trip.Id, trip.RouteId)
+			continue
+		}
+		// Without calendar.txt the services are defined by calendar_dates.txt, which isn't validated.
+		if len(f.Calendars) > 0 && !services[trip.ServiceId] {
+			t.reject(f, "trip %s: unknown service_id %q", trip.Id, trip.ServiceId)
+			continue
+		}
+		if direction := t.get("direction_id"); direction != "" {
+			if trip.DirectionId, err = strconv.Atoi(direction); err != nil || (trip.DirectionId != 0 && trip.DirectionId != 1) {
+				t.reject(f, "trip %s: invalid direction_id %q", trip.Id, direction)
+				continue
+			}
+		}
+		seen[trip.Id] = true
+		f.Trips = append(f.Trips, trip)
+	}
+}
+
+func (f *Feed) readStopTimes(t *table) error {
+	if err := t.require("trip_id", "stop_id", "stop_sequence"); err != nil {
+		return err
+	}
+	trips := make(map[string]bool, len(f.Trips))
+	for _, trip := range f.Trips {
+		trips[trip.Id] = true
+	}
+	stops := make(map[string]bool, len(f.Stops))
+	for _, stop := range f.Stops {
+		stops[stop.Id] = true
+	}
+	for {
+		ok, err := t.next()
+		if err != nil || !ok {
+			return err
+		}
+		st := StopTime{TripId: t.get("trip_id"), StopId: t.get("stop_id")}
+		if !trips[st.TripId] {
+			t.reject(f, "unknown trip_id %q", st.TripId)
+			continue
+		}
+		if !stops[st.StopId] {
+			t.reject(f, "trip %s: unknown stop_id %q", st.TripId, st.StopId)
+			continue
+		}
+		if st.StopSequence, err = strconv.Atoi(t.get("stop_sequence")); err != nil || st.StopSequence < 0 {
+			t.reject(f, "trip %s: invalid stop_sequence %q", st.TripId, t.get("stop_sequence"))
+			continue
+		}
+		value := t.get("arrival_time")
+		if value == "" {
+			value = t.get("departure_time")
+		}
+		if value != "" {
+			if st.ArrivalTime, err = parseTime(value); err != nil {
+				t.reject(f, "trip %s: %v", st.TripId, err)
+				continue
+			}
+			st.HasTime = true
+		}
+		f.StopTimes = append(f.StopTimes, st)
+	}
+}
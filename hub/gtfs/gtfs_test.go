@@ -0,0 +1,325 @@
+package gtfs
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "00:00:00", want: 0},
+		{value: "08:05:30", want: 8*time.Hour + 5*time.Minute + 30*time.Second},
+		{value: "8:05:30", want: 8*time.Hour + 5*time.Minute + 30*time.Second},
+		{value: "25:10:00", want: 25*time.Hour + 10*time.Minute},
+		{value: "08:60:00", wantErr: true},
+		{value: "08:00:60", wantErr: true},
+		{value: "-1:00:00", wantErr: true},
+		{value: "08:00", wantErr: true},
+		{value: "08:00:00:00", wantErr: true},
+		{value: "aa:00:00", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTime(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidId(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "S1"},
+		{id: strings.Repeat("a", MaxIdLength)},
+		{id: strings.Repeat("é", MaxIdLength)},
+		{id: strings.Repeat("a", MaxIdLength+1), wantErr: true},
+		{id: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validId(tt.id); (err != nil) != tt.wantErr {
+			t.Errorf("validId(%q) error = %v, want error %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCoordinate(t *testing.T) {
+	tests := []struct {
+		value   string
+		limit   float64
+		want    float64
+		wantErr bool
+	}{
+		{value: "52.5", limit: 90, want: 52.5},
+		{value: "-90", limit: 90, want: -90},
+		{value: "180", limit: 180, want: 180},
+		{value: "90.0001", limit: 90, wantErr: true},
+		{value: "-180.5", limit: 180, wantErr: true},
+		{value: "north", limit: 90, wantErr: true},
+		{value: "", limit: 90, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCoordinate(tt.value, tt.limit)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCoordinate(%q, %v) error = %v, want error %v", tt.value, tt.limit, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseCoordinate(%q, %v) = %v, want %v", tt.value, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func stopTime(arrival string) StopTime {
+	if arrival == "" {
+		return StopTime{}
+	}
+	d, err := parseTime(arrival)
+	if err != nil {
+		panic(err)
+	}
+	return StopTime{ArrivalTime: d, HasTime: true}
+}
+
+func TestInterpolateTimes(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals []string
+		want     []time.Duration
+		ok       bool
+	}{
+		{
+			name:     "all timed",
+			arrivals: []string{"08:00:00", "08:05:00", "08:12:00"},
+			want:     []time.Duration{0, 5 * time.Minute, 12 * time.Minute},
+			ok:       true,
+		},
+		{
+			name:     "untimed stops are interpolated",
+			arrivals: []string{"08:00:00", "", "", "08:09:00"},
+			want:     []time.Duration{0, 3 * time.Minute, 6 * time.Minute, 9 * time.Minute},
+			ok:       true,
+		},
+		{
+			name:     "after midnight",
+			arrivals: []string{"23:50:00", "24:10:00"},
+			want:     []time.Duration{0, 20 * time.Minute},
+			ok:       true,
+		},
+		{
+			name:     "equal times",
+			arrivals: []string{"08:00:00", "08:00:00"},
+			want:     []time.Duration{0, 0},
+			ok:       true,
+		},
+		{name: "decreasing", arrivals: []string{"08:00:00", "08:10:00", "08:05:00"}},
+		{name: "decreasing across untimed stops", arrivals: []string{"08:10:00", "", "08:00:00"}},
+		{name: "first stop untimed", arrivals: []string{"", "08:05:00"}},
+		{name: "last stop untimed", arrivals: []string{"08:00:00", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := make([]StopTime, len(tt.arrivals))
+			for i, arrival := range tt.arrivals {
+				sts[i] = stopTime(arrival)
+			}
+			got, ok := interpolateTimes(sts)
+			if ok != tt.ok {
+				t.Fatalf("interpolateTimes() ok = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("interpolateTimes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeTables(t *testing.T) {
+	feed := &Feed{
+		Trips: []Trip{
+			{Id: "T2", RouteId: "R1"},
+			{Id: "T1", RouteId: "R1"},
+			{Id: "T3", RouteId: "R2"},
+			{Id: "T4", RouteId: "R2"},
+			{Id: "T5", RouteId: "R3"},
+			{Id: "T6", RouteId: "R1", DirectionId: 1},
+		},
+		StopTimes: []StopTime{
+			// T1 and T2 serve as many stops: the smaller trip id wins.
+			{TripId: "T2", StopId: "A", StopSequence: 1, ArrivalTime: 8 * time.Hour, HasTime: true},
+			{TripId: "T2", StopId: "B", StopSequence: 2, ArrivalTime: 8*time.Hour + 4*time.Minute, HasTime: true},
+			{TripId: "T1", StopId: "B", StopSequence: 2, ArrivalTime: 9*time.Hour + 5*time.Minute, HasTime: true},
+			{TripId: "T1", StopId: "A", StopSequence: 1, ArrivalTime: 9 * time.Hour, HasTime: true},
+			// T4 serves more stops than T3 and visits A twice.
+			{TripId: "T3", StopId: "A", StopSequence: 1, ArrivalTime: 10 * time.Hour, HasTime: true},
+			{TripId: "T3", StopId: "C", StopSequence: 2, ArrivalTime: 10*time.Hour + time.Minute, HasTime: true},
+			{TripId: "T4", StopId: "A", StopSequence: 1, ArrivalTime: 10 * time.Hour, HasTime: true},
+			{TripId: "T4", StopId: "C", StopSequence: 2},
+			{TripId: "T4", StopId: "D", StopSequence: 3, ArrivalTime: 10*time.Hour + 6*time.Minute, HasTime: true},
+			{TripId: "T4", StopId: "A", StopSequence: 4, ArrivalTime: 10*time.Hour + 9*time.Minute, HasTime: true},
+			// T5 goes back in time and is rejected.
+			{TripId: "T5", StopId: "A", StopSequence: 1, ArrivalTime: 11 * time.Hour, HasTime: true},
+			{TripId: "T5", StopId: "B", StopSequence: 2, ArrivalTime: 10 * time.Hour, HasTime: true},
+			// T6 runs R1 in the other direction.
+			{TripId: "T6", StopId: "B", StopSequence: 1, ArrivalTime: 9 * time.Hour, HasTime: true},
+			{TripId: "T6", StopId: "A", StopSequence: 2, ArrivalTime: 9*time.Hour + 6*time.Minute, HasTime: true},
+		},
+	}
+
+	want := []TimeTable{
+		{RouteId: "R1", TripId: "T1", Stops: []TimeTableStop{{"A", 0}, {"B", 5 * time.Minute}}},
+		{RouteId: "R1", DirectionId: 1, TripId: "T6", Stops: []TimeTableStop{{"B", 0}, {"A", 6 * time.Minute}}},
+		{RouteId: "R2", TripId: "T4", Stops: []TimeTableStop{{"A", 0}, {"C", 3 * time.Minute}, {"D", 6 * time.Minute}}},
+	}
+	if got := feed.TimeTables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TimeTables() = %+v, want %+v", got, want)
+	}
+	if got := feed.RejectedIn("stop_times.txt"); got != 1 {
+		t.Errorf("RejectedIn(stop_times.txt) = %d, want 1", got)
+	}
+	// T2 and T3 aren't imported.
+	if got := feed.RejectedIn("trips.txt"); got != 2 {
+		t.Errorf("RejectedIn(trips.txt) = %d, want 2", got)
+	}
+}
+
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "feed.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadZip(t *testing.T) {
+	files := map[string]string{
+		"feed/stops.txt": "\ufeffstop_id,stop_name,stop_lat,stop_lon,location_type\n" +
+			"A,Alpha,52.5,13.4,\n" +
+			"B,Beta,52.6,13.5,0\n" +
+			"ST,Station,52.6,13.5,1\n" +
+			"A,Duplicate,52.5,13.4,\n" +
+			"C,,52.5,13.4,\n" +
+			"D,Delta,91,13.4,\n",
+		"routes.txt": "route_id,route_short_name,route_long_name,route_type\n" +
+			"R1,1,Alpha - Beta,3\n" +
+			"R2,,,3\n" +
+			"R3,3,,bus\n",
+		"calendar.txt": "service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\n" +
+			"WD,1,1,1,1,1,0,0,20260101,20261231\n" +
+			"BAD,1,1,1,1,1,0,2,20260101,20261231\n" +
+			"BACK,1,1,1,1,1,0,0,20261231,20260101\n",
+		"trips.txt": "route_id,service_id,trip_id,direction_id\n" +
+			"R1,WD,T1,0\n" +
+			"R2,WD,T2,0\n" +
+			"R1,XX,T3,0\n" +
+			"R1,WD,T4,2\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+			"T1,08:00:00,08:00:00,A,1\n" +
+			"T1,,25:00:00,B,2\n" +
+			"T1,08:00:00,08:00:00,Z,3\n" +
+			"T2,08:00:00,08:00:00,A,1\n" +
+			"T1,8h,,A,4\n",
+	}
+	feed, err := ReadZip(writeZip(t, files))
+	if err != nil {
+		t.Fatalf("ReadZip() error = %v", err)
+	}
+
+	wantStops := []Stop{{Id: "A", Name: "Alpha", Latitude: 52.5, Longitude: 13.4}, {Id: "B", Name: "Beta", Latitude: 52.6, Longitude: 13.5}}
+	if !reflect.DeepEqual(feed.Stops, wantStops) {
+		t.Errorf("Stops = %+v, want %+v", feed.Stops, wantStops)
+	}
+	if len(feed.Routes) != 1 || feed.Routes[0].Id != "R1" {
+		t.Errorf("Routes = %+v, want only R1", feed.Routes)
+	}
+	if len(feed.Calendars) != 1 || feed.Calendars[0].ServiceId != "WD" || feed.Calendars[0].Weekdays[5] {
+		t.Errorf("Calendars = %+v, want only WD on weekdays", feed.Calendars)
+	}
+	if len(feed.Trips) != 1 || feed.Trips[0].Id != "T1" {
+		t.Errorf("Trips = %+v, want only T1", feed.Trips)
+	}
+	wantStopTimes := []StopTime{
+		{TripId: "T1", StopId: "A", StopSequence: 1, ArrivalTime: 8 * time.Hour, HasTime: true},
+		{TripId: "T1", StopId: "B", StopSequence: 2, ArrivalTime: 25 * time.Hour, HasTime: true},
+	}
+	if !reflect.DeepEqual(feed.StopTimes, wantStopTimes) {
+		t.Errorf("StopTimes = %+v, want %+v", feed.StopTimes, wantStopTimes)
+	}
+
+	wantRejected := map[string]int{"stops.txt": 3, "routes.txt": 2, "calendar.txt": 2, "trips.txt": 3, "stop_times.txt": 3}
+	for file, want := range wantRejected {
+		if got := feed.RejectedIn(file); got != want {
+			t.Errorf("RejectedIn(%s) = %d, want %d", file, got, want)
+		}
+	}
+	for _, r := range feed.Rejected {
+		if r.Line < 2 {
+			t.Errorf("rejection %+v has no data line", r)
+		}
+	}
+}
+
+func TestReadZipMissingFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "required file",
+			files: map[string]string{"stops.txt": "stop_id\n"},
+			want:  "missing required file routes.txt",
+		},
+		{
+			name: "required column",
+			files: map[string]string{
+				"stops.txt":      "stop_id\n",
+				"routes.txt":     "route_id,route_short_name\n",
+				"trips.txt":      "route_id,service_id,trip_id\n",
+				"stop_times.txt": "trip_id,stop_id,stop_sequence\n",
+			},
+			want: "routes.txt: missing required column route_type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadZip(writeZip(t, tt.files))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("ReadZip() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
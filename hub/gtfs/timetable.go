@@ -0,0 +1,125 @@
+package gtfs
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TimeTable is the sequence of stops of a route in a direction, with the
+// time offset of each stop from the first one, taken from the trip TripId.
+type TimeTable struct {
+	RouteId     string
+	DirectionId int
+	TripId      string
+	Stops       []TimeTableStop
+}
+
+type TimeTableStop struct {
+	StopId string
+	Offset time.Duration
+}
+
+// routeDirection identifies a direction of a route.
+type routeDirection struct {
+	routeId     string
+	directionId int
+}
+
+// TimeTables returns one time table per route and direction, built from the
+// trip of the direction serving the most stops, ordered by route then
+// direction. Stops without times are interpolated between the surrounding
+// timed stops; a stop visited twice keeps its first visit. Trips whose times
+// can't be used are rejected, and so are the other trips: the Hub keeps no
+// GTFS trip, its trips are scheduled per bus.
+func (f *Feed) TimeTables() []TimeTable {
+	stopTimes := make(map[string][]StopTime)
+	for _, st := range f.StopTimes {
+		stopTimes[st.TripId] = append(stopTimes[st.TripId], st)
+	}
+
+	best := make(map[routeDirection]TimeTable)
+	var candidates []TimeTable
+	var routeIds []string
+	routeSeen := make(map[string]bool)
+	for _, trip := range f.Trips {
+		sts := stopTimes[trip.Id]
+		if len(sts) < 2 {
+			continue
+		}
+		sort.Slice(sts, func(i, j int) bool {
+			return sts[i].StopSequence < sts[j].StopSequence
+		})
+		offsets, ok := interpolateTimes(sts)
+		if !ok {
+			f.Rejected = append(f.Rejected, Rejection{
+				File:   "stop_times.txt",
+				Reason: "trip " + trip.Id + ": times missing at the first or last stop, or decreasing",
+			})
+			continue
+		}
+		tt := TimeTable{RouteId: trip.RouteId, DirectionId: trip.DirectionId, TripId: trip.Id}
+		visited := make(map[string]bool)
+		for i, st := range sts {
+			if visited[st.StopId] {
+				continue
+			}
+			visited[st.StopId] = true
+			tt.Stops = append(tt.Stops, TimeTableStop{StopId: st.StopId, Offset: offsets[i]})
+		}
+		candidates = append(candidates, tt)
+
+		if !routeSeen[trip.RouteId] {
+			routeSeen[trip.RouteId] = true
+			routeIds = append(routeIds, trip.RouteId)
+		}
+		key := routeDirection{trip.RouteId, trip.DirectionId}
+		current, ok := best[key]
+		if !ok || len(tt.Stops) > len(current.Stops) || (len(tt.Stops) == len(current.Stops) && tt.TripId < current.TripId) {
+			best[key] = tt
+		}
+	}
+
+	for _, tt := range candidates {
+		kept := best[routeDirection{tt.RouteId, tt.DirectionId}]
+		if kept.TripId != tt.TripId {
+			f.Rejected = append(f.Rejected, Rejection{
+				File:   "trips.txt",
+				Reason: fmt.Sprintf("trip %s: not imported, route %s direction %d follows trip %s", tt.TripId, tt.RouteId, tt.DirectionId, kept.TripId),
+			})
+		}
+	}
+
+	timeTables := make([]TimeTable, 0, len(best))
+	for _, routeId := range routeIds {
+		for _, directionId := range []int{0, 1} {
+			if tt, ok := best[routeDirection{routeId, directionId}]; ok {
+				timeTables = append(timeTables, tt)
+			}
+		}
+	}
+	return timeTables
+}
+
+// interpolateTimes returns the offset of every stop time from the first one.
+func interpolateTimes(sts []StopTime) ([]time.Duration, bool) {
+	if !sts[0].HasTime || !sts[len(sts)-1].HasTime {
+		return nil, false
+	}
+	offsets := make([]time.Duration, len(sts))
+	previous := 0
+	for i := 1; i < len(sts); i++ {
+		if !sts[i].HasTime {
+			continue
+		}
+		from, to := sts[previous].ArrivalTime, sts[i].ArrivalTime
+		if to < from {
+			return nil, false
+		}
+		for j := previous + 1; j <= i; j++ {
+			offsets[j] = from - sts[0].ArrivalTime + (to-from)*time.Duration(j-previous)/time.Duration(i-previous)
+		}
+		previous = i
+	}
+	return offsets, true
+}
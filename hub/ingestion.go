@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/auth"
+	"hub/start/database"
+)
+
+const (
+	// maxIdLength is the size of the varchar columns of the bus and bus stop IDs.
+	maxIdLength = 36
+	// maxBatchSize is the number of positions accepted in a batch.
+	maxBatchSize = 1000
+	// maxBatchBytes is the size of the largest batch body read.
+	maxBatchBytes = 4 << 20
+	// maxClockSkew is how far ahead of the time it is received a position may
+	// be timestamped by its device. A position further in the future would
+	// hold back every later position of its bus until the clock catches up.
+	maxClockSkew = time.Minute
+)
+
+// batchItemResult is the outcome of a position of a batch: Status is the
+// status the position would get alone, and Id the ID of the stored position,
+// created or sent before.
+type batchItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Id     string `json:"id,omitempty"`
+	TripId string `json:"trip_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// batchResult lists the outcome of every position of a batch, in the order
+// of the batch. The positions sent again count as accepted.
+type batchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+}
+
+// busPositionV2 is a position sent to the v2 ingestion API, with numeric
+// coordinates and the time the device took it. Speed is in meters per
+// second, heading in degrees clockwise from north and accuracy in meters;
+// sequence increases with every position sent by the device.
+type busPositionV2 struct {
+	BusId         string     `json:"bus_id"`
+	Timestamp     *time.Time `json:"timestamp"`
+	Latitude      *float64   `json:"latitude"`
+	Longitude     *float64   `json:"longitude"`
+	Speed         *float64   `json:"speed"`
+	Heading       *float64   `json:"heading"`
+	Accuracy      *float64   `json:"accuracy"`
+	Sequence      *int64     `json:"sequence"`
+	NextBusStopId string     `json:"next_bus_stop_id"`
+	IsBusStop     bool       `json:"is_bus_stop"`
+}
+
+// toDatabase checks the position, received at the time received, and
+// returns it as stored. The timestamp and the coordinates are required; the
+// other measures are optional.
+func (p busPositionV2) toDatabase(received time.Time) (database.NewBusPosition, error) {
+	if p.Timestamp == nil || p.Timestamp.IsZero() {
+		return database.NewBusPosition{}, fmt.Errorf("timestamp is required")
+	}
+	if p.Timestamp.After(received.Add(maxClockSkew)) {
+		return database.NewBusPosition{}, fmt.Errorf("timestamp must not be more than %d seconds ahead of the time received", int(maxClockSkew.Seconds()))
+	}
+	if p.Latitude == nil || p.Longitude == nil {
+		return database.NewBusPosition{}, fmt.Errorf("latitude and longitude are required")
+	}
+	np := database.NewBusPosition{
+		BusId:         p.BusId,
+		Timestamp:     p.Timestamp,
+		Latitude:      *p.Latitude,
+		Longitude:     *p.Longitude,
+		Speed:         p.Speed,
+		Heading:       p.Heading,
+		Accuracy:      p.Accuracy,
+		Sequence:      p.Sequence,
+		NextBusStopId: p.NextBusStopId,
+		IsBusStop:     p.IsBusStop,
+	}
+	return np, validateBusPosition(np)
+}
+
+// toDatabase translates a v1 position onto the v2 model: the coordinates are
+// parsed and the position is timestamped when received.
+func (p busPosition) toDatabase() (database.NewBusPosition, error) {
+	latitude, longitude, err := parseLocation(p.Latitude, p.Longitude)
+	if err != nil {
+		return database.NewBusPosition{}, err
+	}
+	np := database.NewBusPosition{
+		BusId:         p.BusId,
+		Latitude:      latitude,
+		Longitude:     longitude,
+		NextBusStopId: p.NextBusStopId,
+		IsBusStop:     p.IsBusStop,
+	}
+	return np, validateBusPosition(np)
+}
+
+func validateBusPosition(np database.NewBusPosition) error {
+	switch {
+	case np.BusId == "" || utf8.RuneCountInString(np.BusId) > maxIdLength:
+		return fmt.Errorf("bus_id must have 1 to %d characters", maxIdLength)
+	case np.NextBusStopId == "" || utf8.RuneCountInString(np.NextBusStopId) > maxIdLength:
+		return fmt.Errorf("next_bus_stop_id must have 1 to %d characters", maxIdLength)
+	case math.IsNaN(np.Latitude) || math.Abs(np.Latitude) > 90:
+		return fmt.Errorf("latitude must be between -90 and 90")
+	case math.IsNaN(np.Longitude) || math.Abs(np.Longitude) > 180:
+		return fmt.Errorf("longitude must be between -180 and 180")
+	case np.Speed != nil && !(*np.Speed >= 0 && !math.IsInf(*np.Speed, 0)):
+		return fmt.Errorf("speed must not be negative")
+	case np.Heading != nil && !(*np.Heading >= 0 && *np.Heading < 360):
+		return fmt.Errorf("heading must be at least 0 and less than 360")
+	case np.Accuracy != nil && !(*np.Accuracy >= 0 && !math.IsInf(*np.Accuracy, 0)):
+		return fmt.Errorf("accuracy must not be negative")
+	case np.Sequence != nil && *np.Sequence < 0:
+		return fmt.Errorf("sequence must not be negative")
+	}
+	return nil
+}
+
+// readBatch splits the body in the raw positions of the batch: a JSON array,
+// or one JSON object per line (NDJSON). A line that isn't valid JSON is
+// returned as is and rejected with its position.
+func readBatch(c *gin.Context) ([]json.RawMessage, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes))
+	if err != nil {
+		return nil, fmt.Errorf("body must have at most %d bytes", maxBatchBytes)
+	}
+	body = bytes.TrimSpace(body)
+	var items []json.RawMessage
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("body is not a JSON array")
+		}
+	} else {
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	}
+	if len(items) == 0 || len(items) > maxBatchSize {
+		return nil, fmt.Errorf("batch must have 1 to %d positions", maxBatchSize)
+	}
+	return items, nil
+}
+
+// authenticateBatch returns the bus whose positions the batch may hold: the
+// bus of the API key of a device, or none for a gateway sending the
+// positions of many buses with the bearer token of a dispatcher. Such a token
+// isn't bound to a bus: it may post the positions of any bus, without its
+// device key. It answers 401 or 403 and reports false otherwise.
+func (h *Handler) authenticateBatch(c *gin.Context) (deviceBusId string, ok bool) {
+	if c.GetHeader(deviceKeyHeader) == "" && c.GetHeader("Authorization") != "" {
+		return "", h.authorize(c, auth.RoleDispatcher)
+	}
+	return h.authenticateDevice(c)
+}
+
+// parseBatchItems returns the position of every batch item, at the index of
+// the item. Invalid items are rejected in result with 400, and so are with 403
+// the positions of another bus than deviceBusId when a device sends the batch.
+func parseBatchItems(items []json.RawMessage, deviceBusId string, received time.Time, result *batchResult) []database.NewBusPosition {
+	positions := make([]database.NewBusPosition, len(items))
+	for i, item := range items {
+		var p busPositionV2
+		if err := json.Unmarshal(item, &p); err != nil {
+			result.Results[i] = batchItemResult{Index: i, Status: http.StatusBadRequest, Error: "wrong bus position parameters"}
+			continue
+		}
+		np, err := p.toDatabase(received)
+		if err != nil {
+			result.Results[i] = batchItemResult{Index: i, Status: http.StatusBadRequest, Error: "wrong bus position parameters", Detail: err.Error()}
+			continue
+		}
+		if deviceBusId != "" && np.BusId != deviceBusId {
+			result.Results[i] = batchItemResult{Index: i, Status: http.StatusForbidden, Error: "api key is not a key of the bus"}
+			continue
+		}
+		positions[i] = np
+	}
+	return positions
+}
+
+// curl -X POST http://localhost:9090/hub/v2/bus/position/batch --header "X-Api-Key: <key>" --header "Content-Type: application/json" --data '[{"bus_id": "492", "timestamp": "2025-01-02T08:00:00+01:00", "latitude": 41.9096, "longitude": 12.52975, "sequence": 1, "next_bus_stop_id": "1", "is_bus_stop": true}, {"bus_id": "492", "timestamp": "2025-01-02T08:00:05+01:00", "latitude": 41.9094, "longitude": 12.5291, "sequence": 2, "next_bus_stop_id": "2", "is_bus_stop": false}]'
+func (h *Handler) InsertBusPositions(c *gin.Context) {
+	deviceBusId, ok := h.authenticateBatch(c)
+	if !ok {
+		return
+	}
+	items, err := readBatch(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position batch", "detail": err.Error()})
+		return
+	}
+
+	result := batchResult{Results: make([]batchItemResult, len(items))}
+	reject := func(i int, status int, message string, detail string) {
+		result.Results[i] = batchItemResult{Index: i, Status: status, Error: message, Detail: detail}
+	}
+	positions := parseBatchItems(items, deviceBusId, time.Now(), &result)
+	var busIds, busStopIds []string
+	for i, np := range positions {
+		if result.Results[i].Status == 0 {
+			busIds = append(busIds, np.BusId)
+			busStopIds = append(busStopIds, np.NextBusStopId)
+		}
+	}
+
+	if len(busIds) > 0 {
+		err, inService := h.DC.GetBusesInService(busIds)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving buses", "detail": err})
+			return
+		}
+		err, unknown := h.DC.GetUnknownBusStops(busStopIds)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus stops", "detail": err})
+			return
+		}
+		unknownBusStops := make(map[string]bool, len(unknown))
+		for _, busStopId := range unknown {
+			unknownBusStops[busStopId] = true
+		}
+		for i, np := range positions {
+			if result.Results[i].Status != 0 {
+				continue
+			}
+			active, exists := inService[np.BusId]
+			switch {
+			case !exists:
+				reject(i, http.StatusConflict, "bus does not exist", "")
+			case !active:
+				reject(i, http.StatusConflict, "bus is out of service", "")
+			case unknownBusStops[np.NextBusStopId]:
+				reject(i, http.StatusConflict, "next bus stop does not exist", "")
+			}
+		}
+	}
+
+	var accepted []database.NewBusPosition
+	var indexes []int
+	for i, np := range positions {
+		if result.Results[i].Status == 0 {
+			accepted = append(accepted, np)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(accepted) > 0 {
+		err, outcomes := h.DC.CreateBusPositions(accepted)
+		if errors.Is(err, database.ErrUnknownBusStop) {
+			c.JSON(http.StatusConflict, gin.H{"error": "a bus or next bus stop of the batch does not exist anymore"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating bus positions", "detail": err})
+			return
+		}
+		for j, r := range outcomes {
+			i := indexes[j]
+			switch {
+			case r.Err != nil:
+				reject(i, http.StatusConflict, r.Err.Error(), "")
+			case r.Created:
+				result.Results[i] = batchItemResult{Index: i, Status: http.StatusCreated, Id: r.Position.Id, TripId: r.Position.TripId}
+			default:
+				result.Results[i] = batchItemResult{Index: i, Status: http.StatusOK, Id: r.Position.Id, TripId: r.Position.TripId}
+			}
+		}
+	}
+	for _, r := range result.Results {
+		if r.Status == http.StatusCreated || r.Status == http.StatusOK {
+			result.Accepted++
+		} else {
+			result.Rejected++
+		}
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
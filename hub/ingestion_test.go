@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/auth"
+)
+
+func TestReadBatch(t *testing.T) {
+	position := `{"bus_id": "492", "latitude": 41.9, "longitude": 12.5}`
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "JSON array", body: "[" + position + ", " + position + "]", want: []string{position, position}},
+		{name: "NDJSON", body: position + "\n\n" + position + "\r\n", want: []string{position, position}},
+		{name: "NDJSON with a line that isn't JSON", body: position + "\nnot json\n", want: []string{position, "not json"}},
+		{name: "spaces around the array", body: "\n  [" + position + "]  \n", want: []string{position}},
+		{name: "largest batch", body: "[" + strings.TrimSuffix(strings.Repeat(position+",", maxBatchSize), ",") + "]", want: make([]string, maxBatchSize)},
+		{name: "largest NDJSON batch", body: strings.Repeat(position+"\n", maxBatchSize), want: make([]string, maxBatchSize)},
+		{name: "empty body", body: "", wantErr: true},
+		{name: "empty array", body: "[]", wantErr: true},
+		{name: "blank lines", body: "\n \n", wantErr: true},
+		{name: "too many positions", body: "[" + strings.TrimSuffix(strings.Repeat(position+",", maxBatchSize+1), ",") + "]", wantErr: true},
+		{name: "too many NDJSON lines", body: strings.Repeat(position+"\n", maxBatchSize+1), wantErr: true},
+		{name: "array not closed", body: "[" + position, wantErr: true},
+		{name: "body too large", body: "[" + strings.Repeat(" ", maxBatchBytes) + "]", wantErr: true},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/hub/v2/bus/position/batch", strings.NewReader(tt.body))
+			got, err := readBatch(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBatch() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("readBatch() returned %d positions, want %d", len(got), len(tt.want))
+			}
+			for i, item := range got {
+				if tt.want[i] != "" && string(item) != tt.want[i] {
+					t.Errorf("position %d = %s, want %s", i, item, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBusPositionV2ToDatabase(t *testing.T) {
+	valid := `"bus_id": "492", "timestamp": "2026-03-01T08:00:00Z", "latitude": 41.9, "longitude": 12.5, "next_bus_stop_id": "1"`
+	received := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		json     string
+		wantTime time.Time
+		wantErr  string
+	}{
+		{name: "required fields", json: valid},
+		{name: "all fields", json: valid + `, "speed": 0, "heading": 359.9, "accuracy": 5, "sequence": 0, "is_bus_stop": true`},
+		{name: "no timestamp", json: `"bus_id": "492", "latitude": 41.9, "longitude": 12.5, "next_bus_stop_id": "1"`, wantErr: "timestamp is required"},
+		{name: "no longitude", json: `"bus_id": "492", "timestamp": "2026-03-01T08:00:00Z", "latitude": 41.9, "next_bus_stop_id": "1"`, wantErr: "latitude and longitude are required"},
+		{name: "no bus", json: strings.Replace(valid, `"492"`, `""`, 1), wantErr: "bus_id must have 1 to 36 characters"},
+		{name: "bus id too long", json: strings.Replace(valid, `"492"`, `"`+strings.Repeat("é", 37)+`"`, 1), wantErr: "bus_id must have 1 to 36 characters"},
+		{name: "latitude out of range", json: strings.Replace(valid, "41.9", "90.5", 1), wantErr: "latitude must be between -90 and 90"},
+		{name: "negative speed", json: valid + `, "speed": -1`, wantErr: "speed must not be negative"},
+		{name: "full turn heading", json: valid + `, "heading": 360`, wantErr: "heading must be at least 0 and less than 360"},
+		{name: "negative accuracy", json: valid + `, "accuracy": -0.5`, wantErr: "accuracy must not be negative"},
+		{name: "negative sequence", json: valid + `, "sequence": -1`, wantErr: "sequence must not be negative"},
+		{name: "ahead within the clock skew", json: strings.Replace(valid, "08:00:00Z", "08:01:00Z", 1), wantTime: received.Add(time.Minute)},
+		{name: "ahead of the clock skew", json: strings.Replace(valid, "08:00:00Z", "08:01:01Z", 1), wantErr: "timestamp must not be more than 60 seconds ahead of the time received"},
+		{name: "far in the future", json: strings.Replace(valid, "2026-03-01", "2027-03-01", 1), wantErr: "timestamp must not be more than 60 seconds ahead of the time received"},
+		{name: "in the past", json: strings.Replace(valid, "2026-03-01", "2025-03-01", 1), wantTime: received.AddDate(-1, 0, 0)},
+	}
+	for _, tt := range tests {
+		var p busPositionV2
+		if err := json.Unmarshal([]byte("{"+tt.json+"}"), &p); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		np, err := p.toDatabase(received)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: toDatabase() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: toDatabase() error = %v", tt.name, err)
+			continue
+		}
+		wantTime := received
+		if !tt.wantTime.IsZero() {
+			wantTime = tt.wantTime
+		}
+		if np.BusId != "492" || np.Latitude != 41.9 || !np.Timestamp.Equal(wantTime) {
+			t.Errorf("%s: toDatabase() = %+v", tt.name, np)
+		}
+	}
+}
+
+func TestParseBatchItems(t *testing.T) {
+	position := func(busId string) json.RawMessage {
+		return json.RawMessage(`{"bus_id": "` + busId + `", "timestamp": "2026-03-01T08:00:00Z", "latitude": 41.9, "longitude": 12.5, "next_bus_stop_id": "1"}`)
+	}
+	received := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		deviceBusId string
+		items       []json.RawMessage
+		wantStatus  []int
+	}{
+		{name: "device sending its bus", deviceBusId: "492", items: []json.RawMessage{position("492"), position("492")}, wantStatus: []int{0, 0}},
+		{name: "device sending another bus", deviceBusId: "492", items: []json.RawMessage{position("492"), position("493")}, wantStatus: []int{0, 403}},
+		{name: "dispatcher sending any bus", items: []json.RawMessage{position("492"), position("493")}, wantStatus: []int{0, 0}},
+		{name: "invalid positions", items: []json.RawMessage{json.RawMessage("not json"), position(""), position("493")}, wantStatus: []int{400, 400, 0}},
+	}
+	for _, tt := range tests {
+		result := batchResult{Results: make([]batchItemResult, len(tt.items))}
+		positions := parseBatchItems(tt.items, tt.deviceBusId, received, &result)
+		for i, r := range result.Results {
+			if r.Status != tt.wantStatus[i] {
+				t.Errorf("%s: position %d status %d, want %d", tt.name, i, r.Status, tt.wantStatus[i])
+			}
+			if r.Status == 0 && positions[i].BusId == "" {
+				t.Errorf("%s: position %d accepted without its bus", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestBusPositionToDatabase(t *testing.T) {
+	tests := []struct {
+		latitude, longitude string
+		wantErr             bool
+	}{
+		{latitude: "41.9096", longitude: "12.52975"},
+		{latitude: "north", longitude: "12.52975", wantErr: true},
+		{latitude: "41.9096", longitude: "181", wantErr: true},
+		{latitude: fmt.Sprint(math.NaN()), longitude: "12.52975", wantErr: true},
+	}
+	for _, tt := range tests {
+		p := busPosition{BusId: "492", Latitude: tt.latitude, Longitude: tt.longitude, NextBusStopId: "1"}
+		np, err := p.toDatabase()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("toDatabase(%s, %s) error = %v, want error %v", tt.latitude, tt.longitude, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && np.Timestamp != nil {
+			t.Errorf("toDatabase(%s, %s) timestamp = %v, want the time received", tt.latitude, tt.longitude, np.Timestamp)
+		}
+	}
+}
+
+func TestAuthenticateBatch(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator(strings.Repeat("s", auth.MinSecretLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(role auth.Role) string {
+		token, err := authenticator.Issue("gateway", role, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	h := &Handler{Auth: authenticator}
+	tests := []struct {
+		name          string
+		authorization string
+		wantOk        bool
+		wantStatus    int
+	}{
+		{name: "dispatcher", authorization: token(auth.RoleDispatcher), wantOk: true},
+		{name: "admin", authorization: token(auth.RoleAdmin), wantOk: true},
+		{name: "viewer", authorization: token(auth.RoleViewer), wantStatus: 403},
+		{name: "invalid token", authorization: "Bearer abc", wantStatus: 401},
+		{name: "no credentials", wantStatus: 401},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("POST", "/hub/v2/bus/position/batch", nil)
+		if tt.authorization != "" {
+			c.Request.Header.Set("Authorization", tt.authorization)
+		}
+		busId, ok := h.authenticateBatch(c)
+		if ok != tt.wantOk || busId != "" {
+			t.Errorf("%s: authenticateBatch() = %q, %v, want any bus, %v", tt.name, busId, ok, tt.wantOk)
+		}
+		if !ok && recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, recorder.Code, tt.wantStatus)
+		}
+	}
+}
@@ -2,16 +2,27 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"hub/start/adherence"
+	"hub/start/auth"
 	"hub/start/database"
+	"hub/start/eta"
+	"hub/start/realtime"
+	"hub/start/stream"
+	"hub/start/timetable"
 )
 
 type bus struct {
@@ -20,6 +31,12 @@ type bus struct {
 	Longitude string `json:"longitude"`
 }
 
+// registeredBus is a bus just registered, with the API key of its device.
+type registeredBus struct {
+	bus
+	ApiKey string `json:"api_key"`
+}
+
 type busPosition struct {
 	BusId         string `json:"bus_id"`
 	Latitude      string `json:"latitude"`
@@ -28,8 +45,37 @@ type busPosition struct {
 	IsBusStop     bool   `json:"is_bus_stop"`
 }
 
+// trips creates one trip per departure, along the bus time table. The route defaults to the route of the bus.
+type trips struct {
+	RouteId     string      `json:"route_id"`
+	DirectionId int         `json:"direction_id"`
+	Departures  []time.Time `json:"departures"`
+}
+
+// busRoute assigns a bus to a route; an empty route unassigns the bus.
+type busRoute struct {
+	BusId   string `json:"bus_id"`
+	RouteId string `json:"route_id"`
+}
+
+// busDelay is the current delay of a bus, at its latest bus stop, with the delays of the current trip.
+type busDelay struct {
+	BusId        string                  `json:"bus_id"`
+	BusStopId    string                  `json:"bus_stop_id"`
+	TripStart    time.Time               `json:"trip_start"`
+	ArrivalTime  time.Time               `json:"arrival_time"`
+	DelaySeconds int                     `json:"delay_seconds"`
+	Stops        []database.BusStopDelay `json:"stops"`
+}
+
 type Handler struct {
-	DC *database.DatabaseConnection
+	DC         *database.DatabaseConnection
+	Broker     *stream.Broker
+	StopBroker *stream.Broker
+	Routes     *routeResolver
+	Spatial    *spatialIndex
+	Arrivals   *arrivalCache
+	Auth       *auth.Authenticator
 }
 
 // curl -X GET http://localhost:9090/hub/health
@@ -44,9 +90,203 @@ func (h *Handler) GetBusStopEntries(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop entries", "detail": err})
 		return
 	}
+	if wantsGeoJSON(c) {
+		collection, err := busStopCollection(busStopEntries)
+		writeGeoJSON(c, collection, err)
+		return
+	}
 	c.IndentedJSON(http.StatusOK, busStopEntries)
 }
 
+// curl -X GET http://localhost:9090/hub/bus_stop/1
+func (h *Handler) GetBusStop(c *gin.Context) {
+	err, busStop := h.DC.GetBusStop(c.Param("bus_stop_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busStop)
+}
+
+// curl -X POST http://localhost:9090/hub/bus_stop --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"id": "41", "name": "Piazza Bologna", "latitude": 41.91329, "longitude": 12.52052}'
+func (h *Handler) CreateBusStop(c *gin.Context) {
+	var newBusStop busStop
+	if err := c.BindJSON(&newBusStop); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus stop parameters"})
+		return
+	}
+	bs := newBusStop.toDatabase()
+	if err := validateBusStop(bs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus stop parameters", "detail": err.Error()})
+		return
+	}
+	err := h.DC.CreateBusStop(bs)
+	if errors.Is(err, database.ErrBusStopExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus stop already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating bus stop", "detail": err})
+		return
+	}
+	h.writeBusStop(c, http.StatusCreated, bs.Id)
+}
+
+// curl -X PUT http://localhost:9090/hub/bus_stop/41 --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"name": "Piazza Bologna", "latitude": 41.91329, "longitude": 12.52052}'
+func (h *Handler) UpdateBusStop(c *gin.Context) {
+	var updatedBusStop busStop
+	if err := c.BindJSON(&updatedBusStop); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus stop parameters"})
+		return
+	}
+	updatedBusStop.Id = c.Param("bus_stop_id")
+	h.updateBusStop(c, updatedBusStop.toDatabase())
+}
+
+// curl -X PATCH http://localhost:9090/hub/bus_stop/41 --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"name": "P.za Bologna"}'
+func (h *Handler) PatchBusStop(c *gin.Context) {
+	var patch busStopPatch
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus stop parameters"})
+		return
+	}
+	err, bs := h.DC.GetBusStop(c.Param("bus_stop_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop", "detail": err})
+		return
+	}
+	h.updateBusStop(c, patch.apply(bs))
+}
+
+func (h *Handler) updateBusStop(c *gin.Context, bs database.BusStop) {
+	if err := validateBusStop(bs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus stop parameters", "detail": err.Error()})
+		return
+	}
+	err := h.DC.UpdateBusStop(bs)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while updating bus stop", "detail": err})
+		return
+	}
+	h.writeBusStop(c, http.StatusOK, bs.Id)
+}
+
+// writeBusStop writes the bus stop as stored, with its normalized coordinates.
+func (h *Handler) writeBusStop(c *gin.Context, status int, busStopId string) {
+	err, busStop := h.DC.GetBusStop(busStopId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop", "detail": err})
+		return
+	}
+	c.IndentedJSON(status, busStop)
+}
+
+// curl -X DELETE http://localhost:9090/hub/bus_stop/41 --header "Authorization: Bearer <token>"
+func (h *Handler) DeleteBusStop(c *gin.Context) {
+	busStopId := c.Param("bus_stop_id")
+	err, references := h.DC.GetBusStopReferences(busStopId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop references", "detail": err})
+		return
+	}
+	if len(references) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus stop is referenced", "references": references})
+		return
+	}
+	err = h.DC.DeleteBusStop(busStopId)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if errors.Is(err, database.ErrBusStopReferenced) {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus stop is referenced"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while deleting bus stop", "detail": err})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// curl -X GET http://localhost:9090/hub/bus_stop/1/departures?limit=5
+func (h *Handler) GetBusStopDepartures(c *gin.Context) {
+	busStopId := c.Param("bus_stop_id")
+	limit := defaultDepartureLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxDepartureLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wrong limit", "detail": fmt.Sprintf("limit must be between 1 and %d", maxDepartureLimit)})
+			return
+		}
+	}
+	err, busStop := h.DC.GetBusStop(busStopId)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop", "detail": err})
+		return
+	}
+	err, timeTables := h.DC.GetBusStopTimeTables(busStopId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
+		return
+	}
+	departures, activeTrips, err := h.liveDepartures(busStopId, timeTables)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while predicting the departures", "detail": err.Error()})
+		return
+	}
+	err, busStopTrips := h.DC.GetBusStopTrips(busStopId, departureHorizon)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the trips", "detail": err})
+		return
+	}
+	departures = append(departures, scheduledDepartures(busStopTrips, activeTrips, departures)...)
+	sortDepartures(departures)
+	if len(departures) > limit {
+		departures = departures[:limit]
+	}
+	c.IndentedJSON(http.StatusOK, departureBoard{BusStopId: busStop.Id, Name: busStop.Name, Departures: departures})
+}
+
+// curl -X GET "http://localhost:9090/hub/bus_stop/nearby?lat=41.9096&lon=12.52975&radius=500&limit=5"
+func (h *Handler) GetNearbyBusStops(c *gin.Context) {
+	query, err := parseNearbyQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong nearby parameters", "detail": err.Error()})
+		return
+	}
+	busStops, err := h.Spatial.NearbyBusStops(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the nearby bus stops", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busStops)
+}
+
+// curl -N http://localhost:9090/hub/bus_stop/stream
+func (h *Handler) StreamBusStops(c *gin.Context) {
+	client := h.StopBroker.Subscribe(stream.Filter{})
+	defer h.StopBroker.Unsubscribe(client)
+	streamEvents(c, client)
+}
+
 // curl -X GET http://localhost:9090/hub/bus
 func (h *Handler) GetBusEntries(c *gin.Context) {
 	err, busEntries := h.DC.GetBusEntries()
@@ -54,12 +294,32 @@ func (h *Handler) GetBusEntries(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus entries", "detail": err})
 		return
 	}
+	if wantsGeoJSON(c) {
+		collection, err := busCollection(busEntries)
+		writeGeoJSON(c, collection, err)
+		return
+	}
 	c.IndentedJSON(http.StatusOK, busEntries)
 }
 
 // curl -X GET http://localhost:9090/hub/bus/492/time_table
+// curl -X GET http://localhost:9090/hub/bus/492/time_table?date=today
 func (h *Handler) GetBusTimeTableEntries(c *gin.Context) {
 	busId := c.Param("bus_id")
+	if _, ok := c.GetQuery("date"); ok {
+		date, err := parseDate(c.Query("date"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wrong date", "detail": err.Error()})
+			return
+		}
+		err, busTimeTableEntries := h.DC.GetBusTripTimeTableEntries(busId, date)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
+			return
+		}
+		c.IndentedJSON(http.StatusOK, busTimeTableEntries)
+		return
+	}
 	err, busTimeTableEntries := h.DC.GetBusTimeTableEntries(busId)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
@@ -68,7 +328,223 @@ func (h *Handler) GetBusTimeTableEntries(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, busTimeTableEntries)
 }
 
-// curl -X POST http://localhost:9090/hub/bus/register --header "Content-Type: application/json" --data '{"id": "1","latitude": "0.34","longitude":"1.1"}'
+// curl -X POST http://localhost:9090/hub/bus/492/time_table/preview --header "Authorization: Bearer <token>" --header "Content-Type: text/csv" --data-binary $'bus_stop_id,time_seconds\n1,0\n2,55\n3,75'
+func (h *Handler) PreviewBusTimeTable(c *gin.Context) {
+	busId := c.Param("bus_id")
+	entries, current, ok := h.uploadedTimeTable(c, busId)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, timeTablePreview{BusId: busId, Stops: entries, Diff: timetable.Compare(current, entries)})
+}
+
+// curl -X PUT "http://localhost:9090/hub/bus/492/time_table?effective_from=2025-01-02" --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '[{"bus_stop_id": "1", "time_seconds": 0}, {"bus_stop_id": "2", "time_seconds": 55}]'
+func (h *Handler) SaveBusTimeTable(c *gin.Context) {
+	busId := c.Param("bus_id")
+	effectiveFrom, err := parseDate(c.Query("effective_from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong effective_from", "detail": err.Error()})
+		return
+	}
+	entries, current, ok := h.uploadedTimeTable(c, busId)
+	if !ok {
+		return
+	}
+	err, upload := h.DC.SaveBusTimeTable(busId, entries, effectiveFrom)
+	if errors.Is(err, database.ErrUnknownBusStop) {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while saving the bus time table", "detail": err})
+		return
+	}
+	status := http.StatusAccepted
+	if upload.Applied {
+		status = http.StatusOK
+	}
+	c.IndentedJSON(status, timeTableUploadResult{TimeTableUpload: upload, Diff: timetable.Compare(current, entries)})
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492/time_table/uploads --header "Authorization: Bearer <token>"
+func (h *Handler) GetBusTimeTableUploads(c *gin.Context) {
+	err, uploads := h.DC.GetBusTimeTableUploads(c.Param("bus_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the time table uploads", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, uploads)
+}
+
+// curl -X DELETE http://localhost:9090/hub/bus/492/time_table/uploads/1 --header "Authorization: Bearer <token>"
+func (h *Handler) DeleteBusTimeTableUpload(c *gin.Context) {
+	err := h.DC.DeleteBusTimeTableUpload(c.Param("bus_id"), c.Param("upload_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "time table upload does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while deleting the time table upload", "detail": err})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// curl -X GET http://localhost:9090/hub/route/492/time_table
+func (h *Handler) GetRouteTimeTable(c *gin.Context) {
+	routeId := c.Param("route_id")
+	err, exists := h.DC.RouteExists(routeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route", "detail": err})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "route does not exist"})
+		return
+	}
+	err, entries := h.DC.GetRouteTimeTable(routeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route time table", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, entries)
+}
+
+// curl -X POST http://localhost:9090/hub/route/492/time_table/preview --header "Authorization: Bearer <token>" --header "Content-Type: text/csv" --data-binary $'bus_stop_id,time_seconds\n1,0\n2,55\n3,75'
+func (h *Handler) PreviewRouteTimeTable(c *gin.Context) {
+	routeId := c.Param("route_id")
+	entries, current, ok := h.uploadedRouteTimeTable(c, routeId)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, timeTablePreview{RouteId: routeId, Stops: entries, Diff: timetable.Compare(current, entries)})
+}
+
+// curl -X PUT "http://localhost:9090/hub/route/492/time_table?effective_from=2025-01-02" --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '[{"bus_stop_id": "1", "time_seconds": 0}, {"bus_stop_id": "2", "time_seconds": 55}]'
+func (h *Handler) SaveRouteTimeTable(c *gin.Context) {
+	routeId := c.Param("route_id")
+	effectiveFrom, err := parseDate(c.Query("effective_from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong effective_from", "detail": err.Error()})
+		return
+	}
+	entries, current, ok := h.uploadedRouteTimeTable(c, routeId)
+	if !ok {
+		return
+	}
+	err, upload := h.DC.SaveRouteTimeTable(routeId, entries, effectiveFrom)
+	if errors.Is(err, database.ErrUnknownBusStop) {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus stop does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while saving the route time table", "detail": err})
+		return
+	}
+	status := http.StatusAccepted
+	if upload.Applied {
+		status = http.StatusOK
+	}
+	c.IndentedJSON(status, timeTableUploadResult{TimeTableUpload: upload, Diff: timetable.Compare(current, entries)})
+}
+
+// curl -X GET http://localhost:9090/hub/route/492/time_table/uploads --header "Authorization: Bearer <token>"
+func (h *Handler) GetRouteTimeTableUploads(c *gin.Context) {
+	err, uploads := h.DC.GetRouteTimeTableUploads(c.Param("route_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the time table uploads", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, uploads)
+}
+
+// curl -X DELETE http://localhost:9090/hub/route/492/time_table/uploads/1 --header "Authorization: Bearer <token>"
+func (h *Handler) DeleteRouteTimeTableUpload(c *gin.Context) {
+	err := h.DC.DeleteRouteTimeTableUpload(c.Param("route_id"), c.Param("upload_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "time table upload does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while deleting the time table upload", "detail": err})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492
+func (h *Handler) GetBus(c *gin.Context) {
+	err, b := h.DC.GetBus(c.Param("bus_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, b)
+}
+
+// curl -X PATCH http://localhost:9090/hub/bus/492 --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"label": "Night line", "in_service": false}'
+func (h *Handler) PatchBus(c *gin.Context) {
+	var patch busPatch
+	if err := c.BindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus parameters"})
+		return
+	}
+	busId := c.Param("bus_id")
+	err, b := h.DC.GetBus(busId)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus", "detail": err})
+		return
+	}
+	b = patch.apply(b)
+	if err := validateBus(b); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus parameters", "detail": err.Error()})
+		return
+	}
+	err = h.DC.UpdateBus(b)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while updating bus", "detail": err})
+		return
+	}
+	err, b = h.DC.GetBus(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, b)
+}
+
+// curl -X DELETE http://localhost:9090/hub/bus/492 --header "Authorization: Bearer <token>"
+func (h *Handler) DeleteBus(c *gin.Context) {
+	err, archive := h.DC.DeleteBus(c.Param("bus_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if errors.Is(err, database.ErrBusInService) {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus is in service, put it out of service before deleting it"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while deleting bus", "detail": err})
+		return
+	}
+	h.Routes.Invalidate()
+	c.IndentedJSON(http.StatusOK, archive)
+}
+
+// curl -X POST http://localhost:9090/hub/bus/register --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"id": "1","latitude": "0.34","longitude":"1.1"}'
 func (h *Handler) BusRegister(c *gin.Context) {
 	var newBus bus
 	if err := c.BindJSON(&newBus); err != nil {
@@ -84,69 +560,612 @@ func (h *Handler) BusRegister(c *gin.Context) {
 		c.JSON(http.StatusConflict, gin.H{"error": "bus already exists"})
 		return
 	}
-	if err := h.DC.CreateBus(newBus.Id, newBus.Latitude, newBus.Longitude); err != nil {
+	key, hash, err := newDeviceKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating api key", "detail": err})
+		return
+	}
+	if err := h.DC.CreateBus(newBus.Id, newBus.Latitude, newBus.Longitude, hash); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating bus", "detail": err})
 		return
 	}
-	c.IndentedJSON(http.StatusCreated, newBus)
+	// The API key is only returned here: the Hub keeps its hash.
+	c.IndentedJSON(http.StatusCreated, registeredBus{bus: newBus, ApiKey: key})
 }
 
-// curl -X POST http://localhost:9090/hub/bus/position --header "Content-Type: application/json" --data '{"bus_id": "492","latitude": "0.34","longitude":"1.1", "next_bus_stop_id": "1", "is_stop": "true"}'
+// curl -X POST http://localhost:9090/hub/bus/position --header "X-Api-Key: <key>" --header "Content-Type: application/json" --data '{"bus_id": "492","latitude": "0.34","longitude":"1.1", "next_bus_stop_id": "1", "is_stop": "true"}'
 func (h *Handler) InsertBusPosition(c *gin.Context) {
+	deviceBusId, ok := h.authenticateDevice(c)
+	if !ok {
+		return
+	}
 	var newBusPosition busPosition
 	if err := c.BindJSON(&newBusPosition); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position parameters"})
 		return
 	}
-	err, exists := h.DC.BusExists(newBusPosition.BusId)
+	np, err := newBusPosition.toDatabase()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position parameters", "detail": err.Error()})
+		return
+	}
+	h.insertBusPosition(c, deviceBusId, np)
+}
+
+// curl -X POST http://localhost:9090/hub/v2/bus/position --header "X-Api-Key: <key>" --header "Content-Type: application/json" --data '{"bus_id": "492", "timestamp": "2025-01-02T08:00:00+01:00", "latitude": 41.9096, "longitude": 12.52975, "speed": 8.5, "heading": 270, "accuracy": 5, "sequence": 1, "next_bus_stop_id": "1", "is_bus_stop": false}'
+func (h *Handler) InsertBusPositionV2(c *gin.Context) {
+	deviceBusId, ok := h.authenticateDevice(c)
+	if !ok {
+		return
+	}
+	var newBusPosition busPositionV2
+	if err := c.BindJSON(&newBusPosition); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position parameters"})
+		return
+	}
+	np, err := newBusPosition.toDatabase(time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position parameters", "detail": err.Error()})
+		return
+	}
+	h.insertBusPosition(c, deviceBusId, np)
+}
+
+// insertBusPosition stores the position sent by the device of the bus deviceBusId.
+func (h *Handler) insertBusPosition(c *gin.Context, deviceBusId string, np database.NewBusPosition) {
+	if np.BusId != deviceBusId {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key is not a key of the bus"})
 		return
 	}
-	if exists == false {
+	err, b := h.DC.GetBus(np.BusId)
+	if err == sql.ErrNoRows {
 		c.JSON(http.StatusConflict, gin.H{"error": "bus does not exist"})
 		return
 	}
-	err, busPosition := h.DC.CreateBusPosition(newBusPosition.BusId, newBusPosition.Latitude, newBusPosition.Longitude, newBusPosition.NextBusStopId, newBusPosition.IsBusStop)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		return
+	}
+	if !b.InService {
+		c.JSON(http.StatusConflict, gin.H{"error": "bus is out of service"})
+		return
+	}
+	err, busPosition, created := h.DC.CreateBusPosition(np)
+	if errors.Is(err, database.ErrUnknownBusStop) {
+		c.JSON(http.StatusConflict, gin.H{"error": "next bus stop does not exist"})
+		return
+	}
+	if errors.Is(err, database.ErrPositionOutOfOrder) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating bus position", "detail": err})
 		return
 	}
+	// A position sent again isn't stored twice: the stored one is returned.
+	if !created {
+		c.IndentedJSON(http.StatusOK, busPosition)
+		return
+	}
 	c.IndentedJSON(http.StatusCreated, busPosition)
 }
 
-func main() {
-	var dc database.DatabaseConnection
-	dc, err := database.NewDatabaseConnection()
+// curl -X GET "http://localhost:9090/hub/bus/492/positions?from=2025-01-01T08:00:00Z&to=2025-01-01T09:00:00Z&limit=100&order=asc" --header "Authorization: Bearer <token>"
+func (h *Handler) GetBusPositions(c *gin.Context) {
+	busId := c.Param("bus_id")
+	query, err := parsePositionQuery(c)
 	if err != nil {
-		fmt.Println("Error while connecting to the database ", err)
-		panic(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bus position query", "detail": err.Error()})
+		return
 	}
-	err = dc.InitDatabase()
+	err, exists := h.DC.BusExists(busId)
 	if err != nil {
-		fmt.Println("Error while initializing the database ", err)
-		panic(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	// One more position than the limit tells whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+	err, busPositions := h.DC.GetBusPositions(busId, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus positions", "detail": err})
+		return
+	}
+	page := busPositionPage{Positions: busPositions}
+	if len(busPositions) > limit {
+		page.Positions = busPositions[:limit]
+		page.NextCursor = encodeCursor(query.Descending, page.Positions[limit-1])
+	}
+	if wantsGeoJSON(c) {
+		collection, err := busPositionCollection(page.Positions)
+		writeGeoJSON(c, busPositionPageCollection{FeatureCollection: collection, NextCursor: page.NextCursor}, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492/eta
+func (h *Handler) GetBusEta(c *gin.Context) {
+	busId := c.Param("bus_id")
+	err, busState := h.DC.GetBusState(busId)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus has no position"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the latest bus position", "detail": err})
+		return
+	}
+	busStops, err := h.Spatial.BusStops()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop entries", "detail": err})
+		return
+	}
+	err, busTimeTableEntries := h.DC.GetBusTimeTableEntries(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
+		return
+	}
+	err, arrivals := h.DC.GetBusStopArrivals(busId, etaPositions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stop arrivals", "detail": err})
+		return
+	}
+	stops, err := etaStops(busTimeTableEntries, busStops)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "wrong bus time table", "detail": err.Error()})
+		return
+	}
+	position, err := etaPosition(busState)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "wrong bus position", "detail": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busEta{
+		BusId:            busState.BusId,
+		PositionId:       busState.PositionId,
+		Timestamp:        busState.Timestamp,
+		StalenessSeconds: busState.StalenessSeconds,
+		Predictions:      eta.Predict(stops, position, etaArrivals(arrivals)),
+	})
+}
+
+// curl -X POST http://localhost:9090/hub/bus/492/trips --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"direction_id": 0, "departures": ["2025-01-02T08:00:00+01:00", "2025-01-02T08:30:00+01:00"]}'
+func (h *Handler) CreateBusTrips(c *gin.Context) {
+	busId := c.Param("bus_id")
+	var newTrips trips
+	if err := c.BindJSON(&newTrips); err != nil || len(newTrips.Departures) == 0 || (newTrips.DirectionId != 0 && newTrips.DirectionId != 1) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong trip parameters"})
+		return
+	}
+	err, exists := h.DC.BusExists(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if newTrips.RouteId == "" {
+		newTrips.RouteId = h.Routes.Route(busId)
+	}
+	if newTrips.RouteId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "route_id is required, the bus is not assigned to a route"})
+		return
+	}
+	err, busTrips := h.DC.CreateTrips(busId, newTrips.RouteId, newTrips.DirectionId, newTrips.Departures)
+	if errors.Is(err, database.ErrNoTimeTable) || errors.Is(err, database.ErrTripExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, database.ErrUnknownRoute) {
+		c.JSON(http.StatusConflict, gin.H{"error": "route does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while creating trips", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, busTrips)
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492/trips?date=2025-01-02
+func (h *Handler) GetBusTrips(c *gin.Context) {
+	busId := c.Param("bus_id")
+	date, err := parseDate(c.Query("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong date", "detail": err.Error()})
+		return
+	}
+	err, busTrips := h.DC.GetBusTrips(busId, date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the trips", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busTrips)
+}
+
+// curl -X GET http://localhost:9090/hub/trip/1
+func (h *Handler) GetTrip(c *gin.Context) {
+	err, trip := h.DC.GetTrip(c.Param("trip_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trip does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the trip", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, trip)
+}
+
+// curl -X GET http://localhost:9090/hub/trip/1/positions --header "Authorization: Bearer <token>"
+func (h *Handler) GetTripPositions(c *gin.Context) {
+	err, busPositions := h.DC.GetTripPositions(c.Param("trip_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the trip positions", "detail": err})
+		return
+	}
+	if wantsGeoJSON(c) {
+		collection, err := busPositionCollection(busPositions)
+		writeGeoJSON(c, collection, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busPositions)
+}
+
+// curl -X GET http://localhost:9090/hub/route
+func (h *Handler) GetRoutes(c *gin.Context) {
+	err, routes := h.DC.GetRoutes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the routes", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, routes)
+}
+
+// curl -X GET http://localhost:9090/hub/route/492
+func (h *Handler) GetRoute(c *gin.Context) {
+	err, route := h.DC.GetRoute(c.Param("route_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "route does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route", "detail": err})
+		return
+	}
+	if wantsGeoJSON(c) {
+		writeGeoJSON(c, routeCollection(route), nil)
+		return
 	}
+	c.IndentedJSON(http.StatusOK, route)
+}
+
+// curl -X PUT http://localhost:9090/hub/route/492 --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"short_name": "492", "long_name": "Tiburtina - Cipro", "directions": [{"direction_id": 0, "stops": [{"bus_stop_id": "1"}, {"bus_stop_id": "2"}], "shape": [{"latitude": 41.9096, "longitude": 12.52975}, {"latitude": 41.9091, "longitude": 12.5262}]}]}'
+func (h *Handler) SaveRoute(c *gin.Context) {
+	var route database.Route
+	if err := c.BindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong route parameters"})
+		return
+	}
+	route.Id = c.Param("route_id")
+	if err := validateRoute(route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong route parameters", "detail": err.Error()})
+		return
+	}
+	err, created := h.DC.SaveRoute(route)
+	if errors.Is(err, database.ErrUnknownBusStop) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong route parameters", "detail": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while saving the route", "detail": err})
+		return
+	}
+	err, route = h.DC.GetRoute(route.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route", "detail": err})
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.IndentedJSON(status, route)
+}
+
+// curl -X PUT http://localhost:9090/hub/bus/492/route --header "Authorization: Bearer <token>" --header "Content-Type: application/json" --data '{"route_id": "492"}'
+func (h *Handler) AssignBusRoute(c *gin.Context) {
+	busId := c.Param("bus_id")
+	var assignment busRoute
+	if err := c.BindJSON(&assignment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong route assignment parameters"})
+		return
+	}
+	err := h.DC.AssignBusRoute(busId, assignment.RouteId)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if errors.Is(err, database.ErrUnknownRoute) {
+		c.JSON(http.StatusConflict, gin.H{"error": "route does not exist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while assigning the route", "detail": err})
+		return
+	}
+	h.Routes.Invalidate()
+	c.IndentedJSON(http.StatusOK, busRoute{BusId: busId, RouteId: assignment.RouteId})
+}
+
+// curl -X GET http://localhost:9090/hub/bus/delay --header "Authorization: Bearer <token>"
+func (h *Handler) GetBusDelays(c *gin.Context) {
+	err, busStopDelays := h.DC.GetLatestBusStopDelays()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus delays", "detail": err})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busStopDelays)
+}
+
+// curl -X GET http://localhost:9090/hub/bus/492/delay --header "Authorization: Bearer <token>"
+func (h *Handler) GetBusDelay(c *gin.Context) {
+	busId := c.Param("bus_id")
+	err, busStopDelays := h.DC.GetBusTripDelays(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus delays", "detail": err})
+		return
+	}
+	if len(busStopDelays) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus has no delay"})
+		return
+	}
+	current := busStopDelays[len(busStopDelays)-1]
+	c.IndentedJSON(http.StatusOK, busDelay{
+		BusId:        busId,
+		BusStopId:    current.BusStopId,
+		TripStart:    current.TripStart,
+		ArrivalTime:  current.ArrivalTime,
+		DelaySeconds: current.DelaySeconds,
+		Stops:        busStopDelays,
+	})
+}
+
+// curl -X GET http://localhost:9090/hub/bus/position/latest
+func (h *Handler) GetLatestBusPositions(c *gin.Context) {
+	if bbox := c.Query("bbox"); bbox != "" {
+		bb, err := parseBoundingBox(bbox)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wrong bbox", "detail": err.Error()})
+			return
+		}
+		busStates, err := h.Spatial.BusStatesInBox(bb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the latest bus positions", "detail": err})
+			return
+		}
+		writeBusStates(c, busStates)
+		return
+	}
+	err, busStates := h.DC.GetBusStates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the latest bus positions", "detail": err})
+		return
+	}
+	writeBusStates(c, busStates)
+}
+
+func writeBusStates(c *gin.Context, busStates []database.BusState) {
+	if wantsGeoJSON(c) {
+		collection, err := busStateCollection(busStates)
+		writeGeoJSON(c, collection, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, busStates)
+}
+
+// curl -N "http://localhost:9090/hub/bus/position/stream?bus_id=492&route=492&bbox=12.44,41.89,12.53,41.92"
+func (h *Handler) StreamBusPositions(c *gin.Context) {
+	filter, err := parseFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong stream filter", "detail": err.Error()})
+		return
+	}
+	client := h.Broker.Subscribe(filter)
+	defer h.Broker.Unsubscribe(client)
+	streamEvents(c, client)
+}
 
-	h := &Handler{DC: &dc}
+// curl -X GET http://localhost:9090/hub/gtfs-rt/vehicle_positions?format=json
+func (h *Handler) GetVehiclePositionsFeed(c *gin.Context) {
+	err, busPositions := h.DC.GetLatestBusPositions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus positions", "detail": err})
+		return
+	}
+	writeFeed(c, realtime.VehiclePositions(busPositions, h.Routes.Route, time.Now()))
+}
 
+// curl -X GET http://localhost:9090/hub/gtfs-rt/trip_updates?format=json
+func (h *Handler) GetTripUpdatesFeed(c *gin.Context) {
+	err, busPositions := h.DC.GetLatestBusPositions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus positions", "detail": err})
+		return
+	}
+	err, busTimeTableEntries := h.DC.GetAllBusTimeTableEntries()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
+		return
+	}
+	writeFeed(c, realtime.TripUpdates(busPositions, busTimeTableEntries, h.Routes.Route, time.Now()))
+}
+
+// writeFeed writes a GTFS-Realtime feed as protobuf, or as JSON with ?format=json.
+func writeFeed(c *gin.Context, feed proto.Message) {
+	if c.Query("format") == "json" {
+		data, err := protojson.Marshal(feed)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error while encoding the feed", "detail": err})
+			return
+		}
+		c.Data(http.StatusOK, "application/json", data)
+		return
+	}
+	data, err := proto.Marshal(feed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while encoding the feed", "detail": err})
+		return
+	}
+	c.Data(http.StatusOK, "application/x-protobuf", data)
+}
+
+// newRouter returns the router of the Hub API. Health and the public reads
+// are anonymous, and the devices post their positions with their API key.
+// The other routes need a token whose role includes the role of their group.
+func newRouter(h *Handler) *gin.Engine {
 	router := gin.Default()
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "accepted"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
+	viewer := router.Group("", h.requireRole(auth.RoleViewer))
+	dispatcher := router.Group("", h.requireRole(auth.RoleDispatcher))
+	admin := router.Group("", h.requireRole(auth.RoleAdmin))
+
 	router.GET("/hub/health", h.GetHealthStatus)
 	router.GET("/hub/bus_stop", h.GetBusStopEntries)
+	admin.POST("/hub/bus_stop", h.CreateBusStop)
+	router.GET("/hub/bus_stop/stream", h.StreamBusStops)
+	router.GET("/hub/bus_stop/nearby", h.GetNearbyBusStops)
+	router.GET("/hub/bus_stop/:bus_stop_id", h.GetBusStop)
+	router.GET("/hub/bus_stop/:bus_stop_id/departures", h.GetBusStopDepartures)
+	admin.PUT("/hub/bus_stop/:bus_stop_id", h.UpdateBusStop)
+	admin.PATCH("/hub/bus_stop/:bus_stop_id", h.PatchBusStop)
+	admin.DELETE("/hub/bus_stop/:bus_stop_id", h.DeleteBusStop)
 	router.GET("/hub/bus", h.GetBusEntries)
+	router.GET("/hub/bus/:bus_id", h.GetBus)
+	dispatcher.PATCH("/hub/bus/:bus_id", h.PatchBus)
+	admin.DELETE("/hub/bus/:bus_id", h.DeleteBus)
+	router.POST("/hub/bus/:bus_id/api_key", h.RotateDeviceKey)
+	admin.GET("/hub/bus/:bus_id/api_keys", h.GetDeviceKeys)
+	admin.POST("/hub/bus/:bus_id/api_keys", h.IssueDeviceKey)
+	admin.DELETE("/hub/bus/:bus_id/api_keys/:key_id", h.RevokeDeviceKey)
 	router.GET("/hub/bus/:bus_id/time_table", h.GetBusTimeTableEntries)
-	router.POST("/hub/bus/register", h.BusRegister)
+	dispatcher.PUT("/hub/bus/:bus_id/time_table", h.SaveBusTimeTable)
+	dispatcher.POST("/hub/bus/:bus_id/time_table/preview", h.PreviewBusTimeTable)
+	viewer.GET("/hub/bus/:bus_id/time_table/uploads", h.GetBusTimeTableUploads)
+	dispatcher.DELETE("/hub/bus/:bus_id/time_table/uploads/:upload_id", h.DeleteBusTimeTableUpload)
+	viewer.GET("/hub/bus/:bus_id/positions", h.GetBusPositions)
+	router.GET("/hub/bus/:bus_id/eta", h.GetBusEta)
+	viewer.GET("/hub/bus/:bus_id/delay", h.GetBusDelay)
+	dispatcher.PUT("/hub/bus/:bus_id/route", h.AssignBusRoute)
+	dispatcher.POST("/hub/bus/:bus_id/trips", h.CreateBusTrips)
+	router.GET("/hub/bus/:bus_id/trips", h.GetBusTrips)
+	router.GET("/hub/route", h.GetRoutes)
+	router.GET("/hub/route/:route_id", h.GetRoute)
+	dispatcher.PUT("/hub/route/:route_id", h.SaveRoute)
+	router.GET("/hub/route/:route_id/time_table", h.GetRouteTimeTable)
+	dispatcher.PUT("/hub/route/:route_id/time_table", h.SaveRouteTimeTable)
+	dispatcher.POST("/hub/route/:route_id/time_table/preview", h.PreviewRouteTimeTable)
+	viewer.GET("/hub/route/:route_id/time_table/uploads", h.GetRouteTimeTableUploads)
+	dispatcher.DELETE("/hub/route/:route_id/time_table/uploads/:upload_id", h.DeleteRouteTimeTableUpload)
+	router.GET("/hub/trip/:trip_id", h.GetTrip)
+	viewer.GET("/hub/trip/:trip_id/positions", h.GetTripPositions)
+	viewer.GET("/hub/bus/delay", h.GetBusDelays)
+	dispatcher.POST("/hub/bus/register", h.BusRegister)
 	router.POST("/hub/bus/position", h.InsertBusPosition)
+	router.POST("/hub/v2/bus/position", h.InsertBusPositionV2)
+	router.POST("/hub/v2/bus/position/batch", h.InsertBusPositions)
+	router.GET("/hub/bus/position/latest", h.GetLatestBusPositions)
+	router.GET("/hub/bus/position/stream", h.StreamBusPositions)
+	router.GET("/hub/gtfs-rt/vehicle_positions", h.GetVehiclePositionsFeed)
+	router.GET("/hub/gtfs-rt/trip_updates", h.GetTripUpdatesFeed)
+
+	return router
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var dc database.DatabaseConnection
+	dc, err := database.NewDatabaseConnection()
+	if err != nil {
+		fmt.Println("Error while connecting to the database ", err)
+		panic(err)
+	}
+	err = dc.InitDatabase()
+	if err != nil {
+		fmt.Println("Error while initializing the database ", err)
+		panic(err)
+	}
+
+	broker := stream.NewBroker(streamBufferSize)
+	stopBroker := stream.NewBroker(streamBufferSize)
+	deviceKeys, err := parseDeviceKeys(os.Getenv("BUS_DEVICE_KEYS"))
+	if err != nil {
+		fmt.Println("Error while reading BUS_DEVICE_KEYS ", err)
+		panic(err)
+	}
+	err, provisioned := dc.ProvisionDeviceKeys(deviceKeys)
+	if err != nil {
+		fmt.Println("Error while provisioning BUS_DEVICE_KEYS ", err)
+		panic(err)
+	}
+	for _, busId := range provisioned {
+		fmt.Println("Device key of bus", busId, "provisioned from BUS_DEVICE_KEYS")
+	}
+	authenticator, err := auth.NewAuthenticator(os.Getenv("AUTH_JWT_SECRET"))
+	if err != nil {
+		fmt.Println("Error while reading AUTH_JWT_SECRET ", err)
+		panic(err)
+	}
+	h := &Handler{DC: &dc, Broker: broker, StopBroker: stopBroker, Routes: newRouteResolver(&dc), Spatial: newSpatialIndex(&dc), Arrivals: newArrivalCache(&dc), Auth: authenticator}
+
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	tracker := adherence.NewTracker(&dc, func(delay database.BusStopDelay, position adherence.Position) {
+		broker.Publish(delayEvent(delay, position, h.Routes.Route))
+	})
+	go tracker.Run(listenCtx)
+	go applyTimeTableUploads(listenCtx, &dc)
+	go func() {
+		err := dc.Listen(listenCtx, func(channel string, payload string) {
+			if channel == "bus_stop_notification" {
+				h.Spatial.Invalidate()
+				stopBroker.Publish(busStopEvent(payload))
+				return
+			}
+			broker.Publish(positionEvent(payload, h.Routes.Route))
+			if err := tracker.Observe(payload); err != nil {
+				fmt.Println("Error while tracking the bus position ", err)
+			}
+		}, "bus_position_notification", "bus_stop_notification")
+		if err != nil {
+			fmt.Println("Error while listening to the notifications ", err)
+		}
+	}()
+
+	router := newRouter(h)
 
 	srv := &http.Server{
 		Addr:    ":9090",
@@ -167,6 +1186,9 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	fmt.Println("Shutdown Server ...")
+	stopListening()
+	broker.Close()
+	stopBroker.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/auth"
+	"hub/start/database"
+)
+
+// allowed stands for any status but 401 and 403: the request went past the
+// authentication, whatever the handler answered without a database.
+const allowed = 0
+
+func TestRouterAuthentication(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator(strings.Repeat("s", auth.MinSecretLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(role auth.Role) string {
+		token, err := authenticator.Issue("alice", role, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	// The database can't be reached: the handlers answer with an error once
+	// the request is authenticated.
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dc := &database.DatabaseConnection{Db: db}
+	h := &Handler{DC: dc, Routes: newRouteResolver(dc), Spatial: &spatialIndex{dc: dc}, Arrivals: newArrivalCache(dc), Auth: authenticator}
+
+	gin.SetMode(gin.TestMode)
+	router := newRouter(h)
+
+	credentials := []struct {
+		name          string
+		authorization string
+	}{
+		{name: "anonymous"},
+		{name: "invalid token", authorization: "Bearer abc"},
+		{name: "viewer", authorization: token(auth.RoleViewer)},
+		{name: "dispatcher", authorization: token(auth.RoleDispatcher)},
+		{name: "admin", authorization: token(auth.RoleAdmin)},
+	}
+	tests := []struct {
+		method, path string
+		// want is the status per credentials, in the order above.
+		want [5]int
+	}{
+		{method: "GET", path: "/hub/health", want: [5]int{200, 200, 200, 200, 200}},
+		{method: "GET", path: "/hub/bus_stop", want: [5]int{allowed, allowed, allowed, allowed, allowed}},
+		{method: "GET", path: "/hub/bus/492/trips", want: [5]int{allowed, allowed, allowed, allowed, allowed}},
+		{method: "GET", path: "/hub/bus/position/latest", want: [5]int{allowed, allowed, allowed, allowed, allowed}},
+		{method: "GET", path: "/hub/bus/492/positions", want: [5]int{401, 401, allowed, allowed, allowed}},
+		{method: "GET", path: "/hub/bus/delay", want: [5]int{401, 401, allowed, allowed, allowed}},
+		{method: "GET", path: "/hub/trip/1/positions", want: [5]int{401, 401, allowed, allowed, allowed}},
+		{method: "PATCH", path: "/hub/bus/492", want: [5]int{401, 401, 403, allowed, allowed}},
+		{method: "POST", path: "/hub/bus/register", want: [5]int{401, 401, 403, allowed, allowed}},
+		{method: "PUT", path: "/hub/route/R1", want: [5]int{401, 401, 403, allowed, allowed}},
+		{method: "POST", path: "/hub/bus/492/trips", want: [5]int{401, 401, 403, allowed, allowed}},
+		{method: "POST", path: "/hub/bus_stop", want: [5]int{401, 401, 403, 403, allowed}},
+		{method: "DELETE", path: "/hub/bus/492", want: [5]int{401, 401, 403, 403, allowed}},
+		{method: "GET", path: "/hub/bus/492/api_keys", want: [5]int{401, 401, 403, 403, allowed}},
+		{method: "DELETE", path: "/hub/bus/492/api_keys/1", want: [5]int{401, 401, 403, 403, allowed}},
+		// The devices authenticate with their API key, which no token replaces.
+		{method: "POST", path: "/hub/bus/position", want: [5]int{401, 401, 401, 401, 401}},
+		{method: "POST", path: "/hub/v2/bus/position", want: [5]int{401, 401, 401, 401, 401}},
+		{method: "POST", path: "/hub/bus/492/api_key", want: [5]int{401, 401, 401, 401, 401}},
+		// A gateway may send batches of any bus with the token of a dispatcher.
+		{method: "POST", path: "/hub/v2/bus/position/batch", want: [5]int{401, 401, 403, allowed, allowed}},
+	}
+	for _, tt := range tests {
+		for i, cred := range credentials {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if cred.authorization != "" {
+				req.Header.Set("Authorization", cred.authorization)
+			}
+			router.ServeHTTP(recorder, req)
+			got := recorder.Code
+			if want := tt.want[i]; want == allowed {
+				if got == http.StatusUnauthorized || got == http.StatusForbidden {
+					t.Errorf("%s %s as %s: status %d, want the request allowed", tt.method, tt.path, cred.name, got)
+				}
+			} else if got != want {
+				t.Errorf("%s %s as %s: status %d, want %d", tt.method, tt.path, cred.name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+)
+
+const (
+	defaultPositionLimit = 100
+	maxPositionLimit     = 1000
+	// cursorTimeLayout keeps the creation time as stored, without time zone.
+	cursorTimeLayout = "2006-01-02T15:04:05.999999"
+)
+
+// busPositionPage is a page of positions. NextCursor is empty on the last page.
+type busPositionPage struct {
+	Positions  []database.BusPosition `json:"positions"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+}
+
+// parsePositionQuery reads the query parameters from and to (RFC 3339), limit,
+// order (asc or desc) and cursor. The cursor must be used with the order it was created for.
+func parsePositionQuery(c *gin.Context) (query database.BusPositionQuery, err error) {
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, fmt.Errorf("from is not an RFC 3339 timestamp")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, fmt.Errorf("to is not an RFC 3339 timestamp")
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+
+	query.Limit = defaultPositionLimit
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxPositionLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxPositionLimit)
+		}
+	}
+
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		descending, key, ok := decodeCursor(cursor)
+		if !ok || descending != query.Descending {
+			return query, fmt.Errorf("invalid cursor")
+		}
+		query.After = &key
+	}
+	return query, nil
+}
+
+// parseDate reads a date as YYYY-MM-DD; empty or "today" is the current date.
+func parseDate(value string) (time.Time, error) {
+	if value == "" || value == "today" {
+		return time.Now(), nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return date, fmt.Errorf("date must be YYYY-MM-DD or today")
+	}
+	return date, nil
+}
+
+// encodeCursor returns an opaque cursor pointing after the position.
+func encodeCursor(descending bool, bp database.BusPosition) string {
+	order := "asc"
+	if descending {
+		order = "desc"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(order + "|" + bp.CreationTime.Format(cursorTimeLayout) + "|" + bp.Id))
+}
+
+func decodeCursor(cursor string) (descending bool, key database.BusPositionKey, ok bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(string(data), "|")
+	if len(parts) != 3 || (parts[0] != "asc" && parts[0] != "desc") {
+		return
+	}
+	if key.CreationTime, err = time.Parse(cursorTimeLayout, parts[1]); err != nil {
+		return
+	}
+	if key.Id, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return
+	}
+	return parts[0] == "desc", key, true
+}
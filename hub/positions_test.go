@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		descending bool
+		position   database.BusPosition
+		wantId     int64
+	}{
+		{descending: false, position: database.BusPosition{Id: "1", CreationTime: time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)}, wantId: 1},
+		{descending: true, position: database.BusPosition{Id: "9007199254740993", CreationTime: time.Date(2026, 3, 1, 8, 0, 0, 123456000, time.UTC)}, wantId: 9007199254740993},
+	}
+	for _, tt := range tests {
+		cursor := encodeCursor(tt.descending, tt.position)
+		descending, key, ok := decodeCursor(cursor)
+		if !ok {
+			t.Errorf("decodeCursor(%q) failed", cursor)
+			continue
+		}
+		if descending != tt.descending {
+			t.Errorf("decodeCursor(%q) descending = %v, want %v", cursor, descending, tt.descending)
+		}
+		if !key.CreationTime.Equal(tt.position.CreationTime) || key.Id != tt.wantId {
+			t.Errorf("decodeCursor(%q) key = %+v, want position %+v", cursor, key, tt.position)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "not base64", cursor: "!!!"},
+		{name: "padded base64", cursor: base64.URLEncoding.EncodeToString([]byte("asc|2026-03-01T08:00:00|1"))},
+		{name: "missing id", cursor: encode("asc|2026-03-01T08:00:00")},
+		{name: "extra field", cursor: encode("asc|2026-03-01T08:00:00|1|2")},
+		{name: "unknown order", cursor: encode("up|2026-03-01T08:00:00|1")},
+		{name: "invalid time", cursor: encode("asc|yesterday|1")},
+		{name: "invalid id", cursor: encode("asc|2026-03-01T08:00:00|one")},
+	}
+	for _, tt := range tests {
+		if _, _, ok := decodeCursor(tt.cursor); ok {
+			t.Errorf("%s: decodeCursor(%q) succeeded", tt.name, tt.cursor)
+		}
+	}
+}
+
+func TestParsePositionQuery(t *testing.T) {
+	position := database.BusPosition{Id: "42", CreationTime: time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)}
+	ascCursor, descCursor := encodeCursor(false, position), encodeCursor(true, position)
+	tests := []struct {
+		name    string
+		query   string
+		want    database.BusPositionQuery
+		wantErr bool
+	}{
+		{name: "defaults", query: "", want: database.BusPositionQuery{Limit: defaultPositionLimit}},
+		{
+			name:  "range and order",
+			query: "from=2026-03-01T08:00:00Z&to=2026-03-01T09:00:00Z&limit=10&order=desc",
+			want: database.BusPositionQuery{
+				From:       time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC),
+				To:         time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC),
+				Limit:      10,
+				Descending: true,
+			},
+		},
+		{
+			name:  "cursor of the same order",
+			query: "order=desc&cursor=" + descCursor,
+			want: database.BusPositionQuery{
+				After:      &database.BusPositionKey{CreationTime: position.CreationTime, Id: 42},
+				Limit:      defaultPositionLimit,
+				Descending: true,
+			},
+		},
+		{name: "cursor of the other order", query: "order=desc&cursor=" + ascCursor, wantErr: true},
+		{name: "descending cursor with default order", query: "cursor=" + descCursor, wantErr: true},
+		{name: "invalid cursor", query: "cursor=abc", wantErr: true},
+		{name: "from after to", query: "from=2026-03-01T09:00:00Z&to=2026-03-01T08:00:00Z", wantErr: true},
+		{name: "empty range", query: "from=2026-03-01T09:00:00Z&to=2026-03-01T09:00:00Z", wantErr: true},
+		{name: "from not RFC 3339", query: "from=2026-03-01", wantErr: true},
+		{name: "limit zero", query: "limit=0", wantErr: true},
+		{name: "limit too large", query: "limit=1001", wantErr: true},
+		{name: "unknown order", query: "order=random", wantErr: true},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/hub/bus/1/positions?"+tt.query, nil)
+			got, err := parsePositionQuery(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePositionQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !got.From.Equal(tt.want.From) || !got.To.Equal(tt.want.To) || got.Limit != tt.want.Limit || got.Descending != tt.want.Descending {
+				t.Errorf("parsePositionQuery() = %+v, want %+v", got, tt.want)
+			}
+			if (got.After == nil) != (tt.want.After == nil) ||
+				(got.After != nil && (got.After.Id != tt.want.After.Id || !got.After.CreationTime.Equal(tt.want.After.CreationTime))) {
+				t.Errorf("parsePositionQuery() After = %+v, want %+v", got.After, tt.want.After)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Package realtime builds GTFS-Realtime feeds from the bus positions and time tables.
+// The vehicle ID of the feed entities is the bus ID, and the route ID the
+// route the bus is assigned to. A position linked to a trip is reported as
+// SCHEDULED with the trip ID, otherwise as UNSCHEDULED.
+package realtime
+
+import (
+	"strconv"
+	"time"
+
+	gtfsrt "github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+	"hub/start/database"
+)
+
+const gtfsRealtimeVersion = "2.0"
+
+// VehiclePositions returns a VehiclePositions feed with the latest position of every bus.
+func VehiclePositions(positions []database.BusPosition, routeOf func(busId string) string, now time.Time) *gtfsrt.FeedMessage {
+	feed := newFeed(now)
+	for _, bp := range positions {
+		latitude, err := strconv.ParseFloat(bp.Latitude, 32)
+		if err != nil {
+			continue
+		}
+		longitude, err := strconv.ParseFloat(bp.Longitude, 32)
+		if err != nil {
+			continue
+		}
+		status := gtfsrt.VehiclePosition_IN_TRANSIT_TO
+		if bp.IsBusStop {
+			status = gtfsrt.VehiclePosition_STOPPED_AT
+		}
+		feed.Entity = append(feed.Entity, &gtfsrt.FeedEntity{
+			Id: proto.String("vehicle-" + bp.BusId),
+			Vehicle: &gtfsrt.VehiclePosition{
+				Trip:    tripDescriptor(bp, routeOf(bp.BusId)),
+				Vehicle: vehicleDescriptor(bp.BusId),
+				Position: &gtfsrt.Position{
+					Latitude:  proto.Float32(float32(latitude)),
+					Longitude: proto.Float32(float32(longitude)),
+				},
+				StopId:        proto.String(bp.NextBusStopId),
+				CurrentStatus: status.Enum(),
+				Timestamp:     proto.Uint64(uint64(bp.CreationTime.Unix())),
+			},
+		})
+	}
+	return feed
+}
+
+// TripUpdates returns a TripUpdates feed with the predicted arrival of every
+// bus at its remaining stops. The arrivals are projected from the latest
+// position, keeping the time table offsets between the next stop and the following ones.
+func TripUpdates(positions []database.BusPosition, timeTables []database.BusTimeTable, routeOf func(busId string) string, now time.Time) *gtfsrt.FeedMessage {
+	entries := make(map[string][]database.BusTimeTable)
+	for _, btt := range timeTables {
+		entries[btt.BusId] = append(entries[btt.BusId], btt)
+	}
+
+	feed := newFeed(now)
+	for _, bp := range positions {
+		busEntries := entries[bp.BusId]
+		next := -1
+		for i, btt := range busEntries {
+			if btt.BusStopId == bp.NextBusStopId {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			continue
+		}
+		tripUpdate := &gtfsrt.TripUpdate{
+			Trip:      tripDescriptor(bp, routeOf(bp.BusId)),
+			Vehicle:   vehicleDescriptor(bp.BusId),
+			Timestamp: proto.Uint64(uint64(bp.CreationTime.Unix())),
+		}
+		for i := next; i < len(busEntries); i++ {
+			offset := time.Duration(busEntries[i].TimeSeconds-busEntries[next].TimeSeconds) * time.Second
+			tripUpdate.StopTimeUpdate = append(tripUpdate.StopTimeUpdate, &gtfsrt.TripUpdate_StopTimeUpdate{
+				StopSequence: proto.Uint32(uint32(i + 1)),
+				StopId:       proto.String(busEntries[i].BusStopId),
+				Arrival: &gtfsrt.TripUpdate_StopTimeEvent{
+					Time: proto.Int64(bp.CreationTime.Add(offset).Unix()),
+				},
+			})
+		}
+		feed.Entity = append(feed.Entity, &gtfsrt.FeedEntity{
+			Id:         proto.String("trip-" + bp.BusId),
+			TripUpdate: tripUpdate,
+		})
+	}
+	return feed
+}
+
+func newFeed(now time.Time) *gtfsrt.FeedMessage {
+	return &gtfsrt.FeedMessage{
+		Header: &gtfsrt.FeedHeader{
+			GtfsRealtimeVersion: proto.String(gtfsRealtimeVersion),
+			Incrementality:      gtfsrt.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+	}
+}
+
+func tripDescriptor(bp database.BusPosition, routeId string) *gtfsrt.TripDescriptor {
+	td := &gtfsrt.TripDescriptor{
+		ScheduleRelationship: gtfsrt.TripDescriptor_UNSCHEDULED.Enum(),
+	}
+	if routeId != "" {
+		td.RouteId = proto.String(routeId)
+	}
+	if bp.TripId != "" {
+		td.TripId = proto.String(bp.TripId)
+		td.ScheduleRelationship = gtfsrt.TripDescriptor_SCHEDULED.Enum()
+	}
+	return td
+}
+
+func vehicleDescriptor(busId string) *gtfsrt.VehicleDescriptor {
+	return &gtfsrt.VehicleDescriptor{
+		Id:    proto.String(busId),
+		Label: proto.String(busId),
+	}
+}
@@ -0,0 +1,155 @@
+package realtime
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	gtfsrt "github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"hub/start/database"
+)
+
+var (
+	feedTime     = time.Date(2026, 3, 1, 8, 5, 0, 0, time.UTC)
+	positionTime = time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+)
+
+func routeOf(busId string) string {
+	return map[string]string{"492": "R1"}[busId]
+}
+
+func TestVehiclePositions(t *testing.T) {
+	tests := []struct {
+		name         string
+		position     database.BusPosition
+		wantEntity   bool
+		wantStatus   gtfsrt.VehiclePosition_VehicleStopStatus
+		wantRoute    string
+		wantTrip     string
+		wantSchedule gtfsrt.TripDescriptor_ScheduleRelationship
+	}{
+		{
+			name:         "on a trip",
+			position:     database.BusPosition{BusId: "492", CreationTime: positionTime, Latitude: "41.9096", Longitude: "12.52975", NextBusStopId: "2", TripId: "10"},
+			wantEntity:   true,
+			wantStatus:   gtfsrt.VehiclePosition_IN_TRANSIT_TO,
+			wantRoute:    "R1",
+			wantTrip:     "10",
+			wantSchedule: gtfsrt.TripDescriptor_SCHEDULED,
+		},
+		{
+			name:         "at a stop without trip nor route",
+			position:     database.BusPosition{BusId: "493", CreationTime: positionTime, Latitude: "41.9", Longitude: "12.5", NextBusStopId: "1", IsBusStop: true},
+			wantEntity:   true,
+			wantStatus:   gtfsrt.VehiclePosition_STOPPED_AT,
+			wantSchedule: gtfsrt.TripDescriptor_UNSCHEDULED,
+		},
+		{
+			name:     "invalid latitude",
+			position: database.BusPosition{BusId: "492", CreationTime: positionTime, Latitude: "north", Longitude: "12.5"},
+		},
+		{
+			name:     "invalid longitude",
+			position: database.BusPosition{BusId: "492", CreationTime: positionTime, Latitude: "41.9", Longitude: ""},
+		},
+	}
+	for _, tt := range tests {
+		feed := VehiclePositions([]database.BusPosition{tt.position}, routeOf, feedTime)
+		if feed.GetHeader().GetTimestamp() != uint64(feedTime.Unix()) || feed.GetHeader().GetGtfsRealtimeVersion() != gtfsRealtimeVersion {
+			t.Errorf("%s: header %v", tt.name, feed.GetHeader())
+		}
+		if (len(feed.Entity) == 1) != tt.wantEntity {
+			t.Errorf("%s: %d entities, want entity %v", tt.name, len(feed.Entity), tt.wantEntity)
+			continue
+		}
+		if !tt.wantEntity {
+			continue
+		}
+		entity := feed.Entity[0]
+		vehicle := entity.GetVehicle()
+		if entity.GetId() != "vehicle-"+tt.position.BusId || vehicle.GetVehicle().GetId() != tt.position.BusId {
+			t.Errorf("%s: entity %s of vehicle %s", tt.name, entity.GetId(), vehicle.GetVehicle().GetId())
+		}
+		if vehicle.GetCurrentStatus() != tt.wantStatus || vehicle.GetStopId() != tt.position.NextBusStopId {
+			t.Errorf("%s: status %v at stop %s, want %v at %s", tt.name, vehicle.GetCurrentStatus(), vehicle.GetStopId(), tt.wantStatus, tt.position.NextBusStopId)
+		}
+		if vehicle.GetTimestamp() != uint64(positionTime.Unix()) {
+			t.Errorf("%s: timestamp %d, want the position time", tt.name, vehicle.GetTimestamp())
+		}
+		trip := vehicle.GetTrip()
+		if trip.GetRouteId() != tt.wantRoute || trip.GetTripId() != tt.wantTrip || trip.GetScheduleRelationship() != tt.wantSchedule {
+			t.Errorf("%s: trip %v, want route %q, trip %q, %v", tt.name, trip, tt.wantRoute, tt.wantTrip, tt.wantSchedule)
+		}
+		if trip.RouteId != nil && tt.wantRoute == "" {
+			t.Errorf("%s: empty route ID set", tt.name)
+		}
+	}
+}
+
+func TestTripUpdates(t *testing.T) {
+	timeTables := []database.BusTimeTable{
+		{BusId: "492", BusStopId: "1", TimeSeconds: 0},
+		{BusId: "492", BusStopId: "2", TimeSeconds: 120},
+		{BusId: "492", BusStopId: "3", TimeSeconds: 300},
+		{BusId: "493", BusStopId: "1", TimeSeconds: 0},
+	}
+	tests := []struct {
+		name      string
+		position  database.BusPosition
+		wantStops []string
+		// wantArrivals are the arrivals in seconds after the position time.
+		wantArrivals []int64
+		wantSequence []uint32
+	}{
+		{
+			name:         "remaining stops from the next one",
+			position:     database.BusPosition{BusId: "492", CreationTime: positionTime, NextBusStopId: "2"},
+			wantStops:    []string{"2", "3"},
+			wantArrivals: []int64{0, 180},
+			wantSequence: []uint32{2, 3},
+		},
+		{
+			name:         "last stop",
+			position:     database.BusPosition{BusId: "492", CreationTime: positionTime, NextBusStopId: "3"},
+			wantStops:    []string{"3"},
+			wantArrivals: []int64{0},
+			wantSequence: []uint32{3},
+		},
+		{
+			name:     "next stop not in the time table",
+			position: database.BusPosition{BusId: "492", CreationTime: positionTime, NextBusStopId: "9"},
+		},
+		{
+			name:     "bus without time table",
+			position: database.BusPosition{BusId: "494", CreationTime: positionTime, NextBusStopId: "1"},
+		},
+	}
+	for _, tt := range tests {
+		feed := TripUpdates([]database.BusPosition{tt.position}, timeTables, routeOf, feedTime)
+		if tt.wantStops == nil {
+			if len(feed.Entity) != 0 {
+				t.Errorf("%s: %d entities, want none", tt.name, len(feed.Entity))
+			}
+			continue
+		}
+		if len(feed.Entity) != 1 {
+			t.Errorf("%s: %d entities, want 1", tt.name, len(feed.Entity))
+			continue
+		}
+		update := feed.Entity[0].GetTripUpdate()
+		if feed.Entity[0].GetId() != "trip-"+tt.position.BusId || update.GetVehicle().GetId() != tt.position.BusId || update.GetTrip().GetRouteId() != "R1" {
+			t.Errorf("%s: entity %s, trip update %v", tt.name, feed.Entity[0].GetId(), update)
+		}
+		var stops []string
+		var arrivals []int64
+		var sequences []uint32
+		for _, stu := range update.StopTimeUpdate {
+			stops = append(stops, stu.GetStopId())
+			arrivals = append(arrivals, stu.GetArrival().GetTime()-positionTime.Unix())
+			sequences = append(sequences, stu.GetStopSequence())
+		}
+		if !reflect.DeepEqual(stops, tt.wantStops) || !reflect.DeepEqual(arrivals, tt.wantArrivals) || !reflect.DeepEqual(sequences, tt.wantSequence) {
+			t.Errorf("%s: stops %v arriving %v with sequences %v, want %v arriving %v with sequences %v", tt.name, stops, arrivals, sequences, tt.wantStops, tt.wantArrivals, tt.wantSequence)
+		}
+	}
+}
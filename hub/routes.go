@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"hub/start/database"
+	"hub/start/gtfs"
+)
+
+// routeCacheTtl is how long the route assignments of the buses are cached.
+const routeCacheTtl = 30 * time.Second
+
+// routeResolver returns the route of the buses, caching their assignments.
+type routeResolver struct {
+	dc       *database.DatabaseConnection
+	mu       sync.Mutex
+	routes   map[string]string
+	loadedAt time.Time
+}
+
+func newRouteResolver(dc *database.DatabaseConnection) *routeResolver {
+	return &routeResolver{dc: dc}
+}
+
+// Route returns the route of the bus, empty if the bus isn't assigned to a
+// route. The previous assignments are kept if they can't be reloaded.
+func (rr *routeResolver) Route(busId string) string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.routes == nil || time.Since(rr.loadedAt) >= routeCacheTtl {
+		err, routes := rr.dc.GetBusRoutes()
+		if err != nil {
+			fmt.Println("Error while retrieving the bus routes ", err)
+		} else {
+			rr.routes = routes
+		}
+		rr.loadedAt = time.Now()
+	}
+	return rr.routes[busId]
+}
+
+// Invalidate reloads the assignments on the next call to Route.
+func (rr *routeResolver) Invalidate() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.routes = nil
+}
+
+// validateRoute checks the names, the directions and the shape of a route.
+func validateRoute(route database.Route) error {
+	switch {
+	case route.Id == "" || utf8.RuneCountInString(route.Id) > gtfs.MaxIdLength:
+		return fmt.Errorf("route id must have 1 to %d characters", gtfs.MaxIdLength)
+	case route.ShortName == "" || utf8.RuneCountInString(route.ShortName) > gtfs.MaxNameLength:
+		return fmt.Errorf("short_name must have 1 to %d characters", gtfs.MaxNameLength)
+	case utf8.RuneCountInString(route.LongName) > gtfs.MaxLongNameLength:
+		return fmt.Errorf("long_name must have at most %d characters", gtfs.MaxLongNameLength)
+	}
+	seen := make(map[int]bool)
+	for _, d := range route.Directions {
+		if d.DirectionId != 0 && d.DirectionId != 1 {
+			return fmt.Errorf("direction_id must be 0 or 1")
+		}
+		if seen[d.DirectionId] {
+			return fmt.Errorf("direction %d is repeated", d.DirectionId)
+		}
+		seen[d.DirectionId] = true
+		if len(d.Stops) < 2 {
+			return fmt.Errorf("direction %d must have at least two stops", d.DirectionId)
+		}
+		for _, p := range d.Shape {
+			if math.IsNaN(p.Latitude) || math.IsNaN(p.Longitude) || math.Abs(p.Latitude) > 90 || math.Abs(p.Longitude) > 180 {
+				return fmt.Errorf("direction %d has a shape point out of range", d.DirectionId)
+			}
+		}
+	}
+	return nil
+}
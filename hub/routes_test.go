@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"hub/start/database"
+)
+
+func TestValidateRoute(t *testing.T) {
+	stops := []database.RouteStop{{StopSequence: 1, BusStopId: "A"}, {StopSequence: 2, BusStopId: "B"}}
+	route := func(modify func(r *database.Route)) database.Route {
+		r := database.Route{
+			Id:         "R1",
+			ShortName:  "1",
+			LongName:   "Alpha - Beta",
+			Directions: []database.RouteDirection{{DirectionId: 0, Stops: stops}, {DirectionId: 1, Stops: stops}},
+		}
+		if modify != nil {
+			modify(&r)
+		}
+		return r
+	}
+	tests := []struct {
+		name    string
+		route   database.Route
+		wantErr bool
+	}{
+		{name: "valid", route: route(nil)},
+		{name: "without directions", route: route(func(r *database.Route) { r.Directions = nil })},
+		{name: "multi-byte names at the limit", route: route(func(r *database.Route) {
+			r.Id = strings.Repeat("é", 36)
+			r.ShortName = strings.Repeat("ß", 36)
+			r.LongName = strings.Repeat("ü", 255)
+		})},
+		{name: "empty id", route: route(func(r *database.Route) { r.Id = "" }), wantErr: true},
+		{name: "id too long", route: route(func(r *database.Route) { r.Id = strings.Repeat("é", 37) }), wantErr: true},
+		{name: "empty short name", route: route(func(r *database.Route) { r.ShortName = "" }), wantErr: true},
+		{name: "short name too long", route: route(func(r *database.Route) { r.ShortName = strings.Repeat("ß", 37) }), wantErr: true},
+		{name: "long name too long", route: route(func(r *database.Route) { r.LongName = strings.Repeat("ü", 256) }), wantErr: true},
+		{name: "unknown direction", route: route(func(r *database.Route) { r.Directions[1].DirectionId = 2 }), wantErr: true},
+		{name: "repeated direction", route: route(func(r *database.Route) { r.Directions[1].DirectionId = 0 }), wantErr: true},
+		{name: "single stop", route: route(func(r *database.Route) { r.Directions[0].Stops = stops[:1] }), wantErr: true},
+		{name: "shape point out of range", route: route(func(r *database.Route) {
+			r.Directions[0].Shape = []database.RouteShapePoint{{Latitude: 91, Longitude: 0}}
+		}), wantErr: true},
+		{name: "shape point not a number", route: route(func(r *database.Route) {
+			r.Directions[0].Shape = []database.RouteShapePoint{{Latitude: 0, Longitude: math.NaN()}}
+		}), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateRoute(tt.route); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateRoute() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+	"hub/start/geo"
+	"hub/start/stream"
+)
+
+const (
+	// busStopGridTtl is how long the grid of the bus stops is kept without a bus stop change.
+	busStopGridTtl = 5 * time.Minute
+	// busStopGridCellSize is the size in degrees of the cells of the grid, about 1 km.
+	busStopGridCellSize = 0.01
+
+	defaultNearbyRadius = 500
+	maxNearbyRadius     = 10000
+	defaultNearbyLimit  = 20
+	maxNearbyLimit      = 100
+	// maxBoxStaleness is the age of the latest position of a bus beyond which it is no longer in a box.
+	maxBoxStaleness = 10 * time.Minute
+)
+
+// nearbyQuery is a search of the bus stops within Radius meters of a location.
+type nearbyQuery struct {
+	Latitude  float64
+	Longitude float64
+	Radius    float64
+	Limit     int
+}
+
+// spatialIndex answers the spatial queries with PostGIS when it is enabled.
+// Otherwise the bus stops are searched in an in-memory grid, reloaded when
+// they change, and the buses with the btree index of their coordinates. The
+// bus stops are kept in memory either way, for the predictions.
+type spatialIndex struct {
+	dc       *database.DatabaseConnection
+	postGIS  bool
+	mu       sync.Mutex
+	grid     *geo.Grid
+	busStops map[string]database.BusStop
+	loadedAt time.Time
+}
+
+func newSpatialIndex(dc *database.DatabaseConnection) *spatialIndex {
+	err, postGIS := dc.HasPostGIS()
+	if err != nil {
+		fmt.Println("Error while checking PostGIS ", err)
+	}
+	return &spatialIndex{dc: dc, postGIS: postGIS}
+}
+
+// NearbyBusStops returns at most limit bus stops within radius meters of the location, nearest first.
+func (si *spatialIndex) NearbyBusStops(query nearbyQuery) ([]database.NearbyBusStop, error) {
+	if si.postGIS {
+		err, busStops := si.dc.GetNearbyBusStops(query.Latitude, query.Longitude, query.Radius, query.Limit)
+		return busStops, err
+	}
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if err := si.refresh(); err != nil {
+		return nil, err
+	}
+	busStops := []database.NearbyBusStop{}
+	for _, neighbor := range si.grid.Nearby(query.Latitude, query.Longitude, query.Radius) {
+		if len(busStops) == query.Limit {
+			break
+		}
+		busStops = append(busStops, database.NearbyBusStop{BusStop: si.busStops[neighbor.Id], DistanceMeters: neighbor.Distance})
+	}
+	return busStops, nil
+}
+
+// BusStops returns the bus stops by id. The map is replaced, never modified, when the bus stops are reloaded.
+func (si *spatialIndex) BusStops() (map[string]database.BusStop, error) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if err := si.refresh(); err != nil {
+		return nil, err
+	}
+	return si.busStops, nil
+}
+
+// refresh reloads the bus stops when they changed or are older than busStopGridTtl.
+func (si *spatialIndex) refresh() error {
+	if si.grid != nil && time.Since(si.loadedAt) < busStopGridTtl {
+		return nil
+	}
+	return si.load()
+}
+
+func (si *spatialIndex) load() error {
+	err, busStopEntries := si.dc.GetBusStopEntries()
+	if err != nil {
+		return err
+	}
+	points := make([]geo.Point, 0, len(busStopEntries))
+	busStops := make(map[string]database.BusStop, len(busStopEntries))
+	for _, bs := range busStopEntries {
+		latitude, longitude, err := parseLocation(bs.Latitude, bs.Longitude)
+		if err != nil {
+			return fmt.Errorf("bus stop %s: %w", bs.Id, err)
+		}
+		points = append(points, geo.Point{Id: bs.Id, Latitude: latitude, Longitude: longitude})
+		busStops[bs.Id] = bs
+	}
+	si.grid, si.busStops, si.loadedAt = geo.NewGrid(points, busStopGridCellSize), busStops, time.Now()
+	return nil
+}
+
+// BusStatesInBox returns the latest position of the buses in service that
+// are inside the box, leaving out the positions older than maxBoxStaleness.
+func (si *spatialIndex) BusStatesInBox(bb *stream.BoundingBox) ([]database.BusState, error) {
+	err, busStates := si.dc.GetBusStatesInBox(bb.MinLatitude, bb.MinLongitude, bb.MaxLatitude, bb.MaxLongitude, maxBoxStaleness, si.postGIS)
+	return busStates, err
+}
+
+// Invalidate reloads the grid of the bus stops on the next search.
+func (si *spatialIndex) Invalidate() {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.grid = nil
+}
+
+// parseNearbyQuery reads the query parameters lat and lon, required, radius in meters and limit.
+func parseNearbyQuery(c *gin.Context) (query nearbyQuery, err error) {
+	query.Latitude, query.Longitude, err = parseLocation(c.Query("lat"), c.Query("lon"))
+	if err != nil {
+		return query, err
+	}
+	if math.IsNaN(query.Latitude) || math.Abs(query.Latitude) > 90 || math.IsNaN(query.Longitude) || math.Abs(query.Longitude) > 180 {
+		return query, fmt.Errorf("lat must be between -90 and 90 and lon between -180 and 180")
+	}
+	query.Radius = defaultNearbyRadius
+	if radius := c.Query("radius"); radius != "" {
+		query.Radius, err = strconv.ParseFloat(radius, 64)
+		if err != nil || !(query.Radius > 0 && query.Radius <= maxNearbyRadius) {
+			return query, fmt.Errorf("radius must be between 0 and %d meters", maxNearbyRadius)
+		}
+	}
+	query.Limit = defaultNearbyLimit
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxNearbyLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxNearbyLimit)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/adherence"
+	"hub/start/database"
+	"hub/start/stream"
+)
+
+const (
+	// streamBufferSize is the number of events buffered per client before the client is dropped.
+	streamBufferSize = 256
+	// heartbeatInterval keeps idle connections open through proxies.
+	heartbeatInterval = 15 * time.Second
+	// writeTimeout drops clients whose connection doesn't accept data anymore.
+	writeTimeout = 10 * time.Second
+)
+
+// positionEvent builds the stream event of a bus_position_notification
+// payload. routeOf returns the route served by a bus.
+func positionEvent(payload string, routeOf func(busId string) string) stream.Event {
+	var notification struct {
+		Id        json.Number `json:"id"`
+		BusId     string      `json:"busId"`
+		Latitude  *float64    `json:"latitude"`
+		Longitude *float64    `json:"longitude"`
+	}
+	_ = json.Unmarshal([]byte(payload), &notification)
+	e := stream.Event{
+		Id:      notification.Id.String(),
+		Data:    []byte(payload),
+		BusId:   notification.BusId,
+		RouteId: routeOf(notification.BusId),
+	}
+	if notification.Latitude != nil && notification.Longitude != nil {
+		e.Latitude, e.Longitude, e.HasLocation = *notification.Latitude, *notification.Longitude, true
+	}
+	return e
+}
+
+// busStopEvent builds the stream event of a bus_stop_notification payload,
+// named "created", "updated" or "deleted".
+func busStopEvent(payload string) stream.Event {
+	var notification struct {
+		Operation string `json:"operation"`
+	}
+	_ = json.Unmarshal([]byte(payload), &notification)
+	names := map[string]string{"INSERT": "created", "UPDATE": "updated", "DELETE": "deleted"}
+	return stream.Event{Name: names[notification.Operation], Data: []byte(payload)}
+}
+
+// delayEvent builds the "delay" stream event of a bus stop delay, located at the position of the arrival.
+func delayEvent(delay database.BusStopDelay, position adherence.Position, routeOf func(busId string) string) stream.Event {
+	data, _ := json.Marshal(delay)
+	return stream.Event{
+		Id:          position.Id.String(),
+		Name:        "delay",
+		Data:        data,
+		BusId:       delay.BusId,
+		RouteId:     routeOf(delay.BusId),
+		Latitude:    position.Latitude,
+		Longitude:   position.Longitude,
+		HasLocation: true,
+	}
+}
+
+// parseFilter reads the stream filter from the query parameters: bus_id and
+// route, repeated or comma-separated, and bbox=minLon,minLat,maxLon,maxLat.
+func parseFilter(c *gin.Context) (filter stream.Filter, err error) {
+	filter.BusIds = queryValues(c, "bus_id")
+	filter.Routes = queryValues(c, "route")
+	if bbox := c.Query("bbox"); bbox != "" {
+		if filter.Box, err = parseBoundingBox(bbox); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func queryValues(c *gin.Context, key string) map[string]bool {
+	values := make(map[string]bool)
+	for _, param := range c.QueryArray(key) {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values[value] = true
+			}
+		}
+	}
+	return values
+}
+
+func parseBoundingBox(value string) (*stream.BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	var coordinates [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("bbox coordinate %q is not a number", part)
+		}
+		coordinates[i] = f
+	}
+	bb := &stream.BoundingBox{
+		MinLongitude: coordinates[0],
+		MinLatitude:  coordinates[1],
+		MaxLongitude: coordinates[2],
+		MaxLatitude:  coordinates[3],
+	}
+	for _, longitude := range []float64{bb.MinLongitude, bb.MaxLongitude} {
+		if longitude < -180 || longitude > 180 {
+			return nil, fmt.Errorf("bbox out of range")
+		}
+	}
+	for _, latitude := range []float64{bb.MinLatitude, bb.MaxLatitude} {
+		if latitude < -90 || latitude > 90 {
+			return nil, fmt.Errorf("bbox out of range")
+		}
+	}
+	// A minimum longitude greater than the maximum wraps around the antimeridian.
+	if bb.MinLatitude > bb.MaxLatitude {
+		return nil, fmt.Errorf("bbox minimum latitude greater than maximum")
+	}
+	return bb, nil
+}
+
+// streamEvents writes the events of the client as server-sent events, until
+// the client disconnects or is dropped by the broker.
+func streamEvents(c *gin.Context, client *stream.Client) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	rc := http.NewResponseController(c.Writer)
+	write := func(data string) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := io.WriteString(c.Writer, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !write("retry: 3000\n\n") {
+		return
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-client.Events():
+			if !ok {
+				return
+			}
+			if !write(formatEvent(e)) {
+				return
+			}
+		case <-heartbeat.C:
+			if !write(": heartbeat\n\n") {
+				return
+			}
+		}
+	}
+}
+
+func formatEvent(e stream.Event) string {
+	var sb strings.Builder
+	if e.Id != "" {
+		sb.WriteString("id: " + e.Id + "\n")
+	}
+	if e.Name != "" {
+		sb.WriteString("event: " + e.Name + "\n")
+	}
+	for _, line := range strings.Split(string(e.Data), "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
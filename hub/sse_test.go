@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"hub/start/stream"
+)
+
+func TestParseBoundingBox(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    stream.BoundingBox
+		wantErr bool
+	}{
+		{value: "12.44,41.89,12.53,41.92", want: stream.BoundingBox{MinLongitude: 12.44, MinLatitude: 41.89, MaxLongitude: 12.53, MaxLatitude: 41.92}},
+		{value: " -180, -90, 180, 90 ", want: stream.BoundingBox{MinLongitude: -180, MinLatitude: -90, MaxLongitude: 180, MaxLatitude: 90}},
+		{value: "170,-20,-170,-10", want: stream.BoundingBox{MinLongitude: 170, MinLatitude: -20, MaxLongitude: -170, MaxLatitude: -10}},
+		{value: "12.44,41.92,12.53,41.89", wantErr: true},
+		{value: "181,41.89,12.53,41.92", wantErr: true},
+		{value: "170,41.89,-181,41.92", wantErr: true},
+		{value: "12.44,-91,12.53,41.92", wantErr: true},
+		{value: "12.44,41.89,12.53", wantErr: true},
+		{value: "12.44,41.89,east,41.92", wantErr: true},
+		{value: "NaN,41.89,12.53,41.92", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBoundingBox(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBoundingBox(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("parseBoundingBox(%q) = %+v, want %+v", tt.value, *got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package stream
+
+// Filter selects the events received by a client. An event matches when it
+// matches every non-empty criterion: one of the bus IDs, one of the routes,
+// and a location inside the bounding box.
+type Filter struct {
+	BusIds map[string]bool
+	Routes map[string]bool
+	Box    *BoundingBox
+}
+
+// BoundingBox is an area delimited by two parallels and two meridians. It
+// goes east from MinLongitude to MaxLongitude: when MinLongitude is greater,
+// the box wraps around the antimeridian.
+type BoundingBox struct {
+	MinLongitude float64
+	MinLatitude  float64
+	MaxLongitude float64
+	MaxLatitude  float64
+}
+
+// Contains reports whether the location is inside the box, borders included.
+func (bb BoundingBox) Contains(latitude float64, longitude float64) bool {
+	if latitude < bb.MinLatitude || latitude > bb.MaxLatitude {
+		return false
+	}
+	if bb.WrapsAntimeridian() {
+		return longitude >= bb.MinLongitude || longitude <= bb.MaxLongitude
+	}
+	return longitude >= bb.MinLongitude && longitude <= bb.MaxLongitude
+}
+
+// WrapsAntimeridian reports whether the box crosses the meridian 180.
+func (bb BoundingBox) WrapsAntimeridian() bool {
+	return bb.MinLongitude > bb.MaxLongitude
+}
+
+func (f Filter) Match(e Event) bool {
+	if len(f.BusIds) > 0 && !f.BusIds[e.BusId] {
+		return false
+	}
+	if len(f.Routes) > 0 && !f.Routes[e.RouteId] {
+		return false
+	}
+	if f.Box != nil && (!e.HasLocation || !f.Box.Contains(e.Latitude, e.Longitude)) {
+		return false
+	}
+	return true
+}
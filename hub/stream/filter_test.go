@@ -0,0 +1,51 @@
+package stream
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	box := &BoundingBox{MinLongitude: 13.0, MinLatitude: 52.0, MaxLongitude: 14.0, MaxLatitude: 53.0}
+	antimeridian := &BoundingBox{MinLongitude: 170.0, MinLatitude: -20.0, MaxLongitude: -170.0, MaxLatitude: -10.0}
+	located := func(busId, routeId string, latitude, longitude float64) Event {
+		return Event{BusId: busId, RouteId: routeId, Latitude: latitude, Longitude: longitude, HasLocation: true}
+	}
+	tests := []struct {
+		name   string
+		filter Filter
+		event  Event
+		want   bool
+	}{
+		{name: "empty filter", filter: Filter{}, event: Event{BusId: "1"}, want: true},
+		{name: "bus id", filter: Filter{BusIds: map[string]bool{"1": true, "2": true}}, event: Event{BusId: "2"}, want: true},
+		{name: "other bus id", filter: Filter{BusIds: map[string]bool{"1": true}}, event: Event{BusId: "2"}, want: false},
+		{name: "route", filter: Filter{Routes: map[string]bool{"R1": true}}, event: Event{BusId: "1", RouteId: "R1"}, want: true},
+		{name: "other route", filter: Filter{Routes: map[string]bool{"R1": true}}, event: Event{BusId: "1", RouteId: "R2"}, want: false},
+		{name: "no route", filter: Filter{Routes: map[string]bool{"R1": true}}, event: Event{BusId: "1"}, want: false},
+		{name: "inside box", filter: Filter{Box: box}, event: located("1", "", 52.5, 13.4), want: true},
+		{name: "on box border", filter: Filter{Box: box}, event: located("1", "", 53.0, 13.0), want: true},
+		{name: "north of box", filter: Filter{Box: box}, event: located("1", "", 53.1, 13.4), want: false},
+		{name: "east of box", filter: Filter{Box: box}, event: located("1", "", 52.5, 14.1), want: false},
+		{name: "box without location", filter: Filter{Box: box}, event: Event{BusId: "1"}, want: false},
+		{name: "west of the antimeridian", filter: Filter{Box: antimeridian}, event: located("1", "", -15, 179.5), want: true},
+		{name: "east of the antimeridian", filter: Filter{Box: antimeridian}, event: located("1", "", -15, -179.5), want: true},
+		{name: "on the antimeridian", filter: Filter{Box: antimeridian}, event: located("1", "", -15, 180), want: true},
+		{name: "outside a box across the antimeridian", filter: Filter{Box: antimeridian}, event: located("1", "", -15, 0), want: false},
+		{name: "south of a box across the antimeridian", filter: Filter{Box: antimeridian}, event: located("1", "", -25, 179.5), want: false},
+		{
+			name:   "every criterion",
+			filter: Filter{BusIds: map[string]bool{"1": true}, Routes: map[string]bool{"R1": true}, Box: box},
+			event:  located("1", "R1", 52.5, 13.4),
+			want:   true,
+		},
+		{
+			name:   "one criterion failing",
+			filter: Filter{BusIds: map[string]bool{"1": true}, Routes: map[string]bool{"R1": true}, Box: box},
+			event:  located("1", "R1", 51.0, 13.4),
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(tt.event); got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
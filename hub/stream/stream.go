@@ -0,0 +1,110 @@
+// Package stream fans out the database notifications to the clients of the server-sent events streams.
+package stream
+
+import (
+	"sync"
+)
+
+// Event is a message sent to the stream clients. Name is the SSE event
+// name, empty for the default "message" event. BusId, RouteId and the
+// location, when HasLocation is set, are used to filter the event.
+type Event struct {
+	Id          string
+	Name        string
+	Data        []byte
+	BusId       string
+	RouteId     string
+	Latitude    float64
+	Longitude   float64
+	HasLocation bool
+}
+
+// Client is a subscriber of the broker. Its events are buffered; a client
+// that doesn't keep up with the events is dropped, and its channel is closed.
+type Client struct {
+	events chan Event
+	filter Filter
+}
+
+// Events returns the channel of the client events, closed when the client is dropped or the broker closed.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Broker publishes events to its subscribed clients.
+type Broker struct {
+	mu         sync.Mutex
+	clients    map[*Client]struct{}
+	bufferSize int
+	closed     bool
+}
+
+func NewBroker(bufferSize int) *Broker {
+	return &Broker{
+		clients:    make(map[*Client]struct{}),
+		bufferSize: bufferSize,
+	}
+}
+
+// Subscribe registers a new client receiving the events matching the filter.
+// The returned client has a closed channel if the broker is closed.
+func (b *Broker) Subscribe(filter Filter) *Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &Client{events: make(chan Event, b.bufferSize), filter: filter}
+	if b.closed {
+		close(c.events)
+		return c
+	}
+	b.clients[c] = struct{}{}
+	return c
+}
+
+// Unsubscribe removes the client from the broker.
+func (b *Broker) Unsubscribe(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(c)
+}
+
+// Publish sends the event to every client whose filter matches it, without
+// blocking. Clients whose buffer is full are dropped.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if !c.filter.Match(e) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			b.remove(c)
+		}
+	}
+}
+
+// Clients returns the number of subscribed clients.
+func (b *Broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// Close drops every client. Clients subscribing afterwards get a closed channel.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		b.remove(c)
+	}
+	b.closed = true
+}
+
+func (b *Broker) remove(c *Client) {
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	delete(b.clients, c)
+	close(c.events)
+}
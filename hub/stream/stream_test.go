@@ -0,0 +1,34 @@
+package stream
+
+import "testing"
+
+func TestBrokerPublish(t *testing.T) {
+	b := NewBroker(1)
+	all := b.Subscribe(Filter{})
+	bus1 := b.Subscribe(Filter{BusIds: map[string]bool{"1": true}})
+
+	b.Publish(Event{Id: "a", BusId: "2"})
+	if e := <-all.Events(); e.Id != "a" {
+		t.Errorf("unfiltered client got event %q, want a", e.Id)
+	}
+	select {
+	case e := <-bus1.Events():
+		t.Errorf("filtered client got event %q of another bus", e.Id)
+	default:
+	}
+
+	// The unfiltered client doesn't read: its buffer fills up and it is dropped.
+	b.Publish(Event{Id: "b", BusId: "1"})
+	if e := <-bus1.Events(); e.Id != "b" {
+		t.Errorf("filtered client got event %q, want b", e.Id)
+	}
+	b.Publish(Event{Id: "c", BusId: "1"})
+	if got := b.Clients(); got != 1 {
+		t.Errorf("Clients() = %d after a slow client, want 1", got)
+	}
+
+	b.Close()
+	if _, ok := <-b.Subscribe(Filter{}).Events(); ok {
+		t.Error("client subscribing after Close has an open channel")
+	}
+}
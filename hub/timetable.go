@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"hub/start/database"
+	"hub/start/timetable"
+)
+
+const (
+	// maxTimeTableSize is the size in bytes of the largest time table upload.
+	maxTimeTableSize = 1 << 20
+	// timeTableUploadInterval is how often the pending time table uploads are checked.
+	timeTableUploadInterval = time.Minute
+)
+
+// timeTablePreview is an uploaded time table of a bus or a route with its differences from the current one.
+type timeTablePreview struct {
+	BusId   string            `json:"bus_id,omitempty"`
+	RouteId string            `json:"route_id,omitempty"`
+	Stops   []timetable.Entry `json:"stops"`
+	Diff    timetable.Diff    `json:"diff"`
+}
+
+// timeTableUploadResult is a saved time table upload with its differences from the time table it replaces.
+type timeTableUploadResult struct {
+	database.TimeTableUpload
+	Diff timetable.Diff `json:"diff"`
+}
+
+// uploadedTimeTable reads the time table of the request for the bus and
+// returns it with the time table the bus currently follows. It writes the
+// error response when the bus doesn't exist or the time table is invalid.
+func (h *Handler) uploadedTimeTable(c *gin.Context, busId string) (entries []timetable.Entry, current []timetable.Entry, ok bool) {
+	err, exists := h.DC.BusExists(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving bus"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bus does not exist"})
+		return
+	}
+	if entries, ok = h.readTimeTable(c); !ok {
+		return
+	}
+	err, current = h.DC.GetBusTimeTable(busId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus time table entries", "detail": err})
+		return nil, nil, false
+	}
+	return entries, current, true
+}
+
+// uploadedRouteTimeTable reads the time table of the request for the route
+// and returns it with the current time table of the route. It writes the
+// error response when the route doesn't exist or the time table is invalid.
+func (h *Handler) uploadedRouteTimeTable(c *gin.Context, routeId string) (entries []timetable.Entry, current []timetable.Entry, ok bool) {
+	err, exists := h.DC.RouteExists(routeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route", "detail": err})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "route does not exist"})
+		return
+	}
+	if entries, ok = h.readTimeTable(c); !ok {
+		return
+	}
+	err, current = h.DC.GetRouteTimeTable(routeId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the route time table", "detail": err})
+		return nil, nil, false
+	}
+	return entries, current, true
+}
+
+// readTimeTable reads the time table of the request, as CSV when the content
+// type is text/csv and as JSON otherwise, and checks it. It writes the error
+// response when the time table is invalid.
+func (h *Handler) readTimeTable(c *gin.Context) (entries []timetable.Entry, ok bool) {
+	var err error
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxTimeTableSize)
+	switch c.ContentType() {
+	case "text/csv":
+		entries, err = timetable.ParseCSV(body)
+	case "", "application/json":
+		entries, err = timetable.ParseJSON(body)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "the time table must be text/csv or application/json"})
+		return
+	}
+	if err == nil {
+		err = timetable.Validate(entries)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong time table", "detail": err.Error()})
+		return
+	}
+
+	busStopIds := make([]string, len(entries))
+	for i, entry := range entries {
+		busStopIds[i] = entry.BusStopId
+	}
+	err, unknown := h.DC.GetUnknownBusStops(busStopIds)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "error while retrieving the bus stops", "detail": err})
+		return
+	}
+	if len(unknown) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong time table", "detail": fmt.Sprintf("%d bus stops do not exist", len(unknown)), "unknown_bus_stops": unknown})
+		return
+	}
+	return entries, true
+}
+
+// applyTimeTableUploads applies the pending time table uploads when they
+// become effective, until the context is cancelled.
+func applyTimeTableUploads(ctx context.Context, dc *database.DatabaseConnection) {
+	ticker := time.NewTicker(timeTableUploadInterval)
+	defer ticker.Stop()
+	for {
+		err, applied := dc.ApplyTimeTableUploads()
+		if err != nil {
+			fmt.Println("Error while applying the time table uploads ", err)
+		}
+		for _, upload := range applied {
+			if upload.RouteId != "" {
+				fmt.Println("Time table of route", upload.RouteId, "effective from", upload.EffectiveFrom, "applied")
+			} else {
+				fmt.Println("Time table of bus", upload.BusId, "effective from", upload.EffectiveFrom, "applied")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
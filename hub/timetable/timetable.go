@@ -0,0 +1,159 @@
+// Package timetable reads, validates and compares the time tables uploaded
+// for a bus or a route.
+//
+// A time table is the sequence of stops of a trip with the offset of each
+// stop from the start of the trip, in seconds. The first stop is at offset 0
+// and the offsets increase strictly, so that the offsets give the order of the stops.
+package timetable
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxStopIdLength is the size of the varchar column of the bus stop ID.
+const maxStopIdLength = 36
+
+// Entry is a stop of a time table, reached TimeSeconds after the start of the trip.
+type Entry struct {
+	BusStopId   string `json:"bus_stop_id"`
+	TimeSeconds int    `json:"time_seconds"`
+}
+
+// Change is a stop whose offset differs between two time tables.
+type Change struct {
+	BusStopId           string `json:"bus_stop_id"`
+	PreviousTimeSeconds int    `json:"previous_time_seconds"`
+	TimeSeconds         int    `json:"time_seconds"`
+}
+
+// Diff lists the stops added, removed and moved by a new time table.
+type Diff struct {
+	Added     []Entry  `json:"added"`
+	Removed   []Entry  `json:"removed"`
+	Changed   []Change `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// ParseCSV reads a time table with a header line naming the columns
+// bus_stop_id and time_seconds, in any order. Other columns are ignored.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the CSV is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	stopColumn, timeColumn := -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")) {
+		case "bus_stop_id":
+			stopColumn = i
+		case "time_seconds":
+			timeColumn = i
+		}
+	}
+	if stopColumn < 0 || timeColumn < 0 {
+		return nil, errors.New("the CSV header must name the columns bus_stop_id and time_seconds")
+	}
+
+	entries := []Entry{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if stopColumn >= len(record) || timeColumn >= len(record) {
+			return nil, fmt.Errorf("line %d: missing columns", line)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(record[timeColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: time_seconds is not an integer", line)
+		}
+		entries = append(entries, Entry{BusStopId: strings.TrimSpace(record[stopColumn]), TimeSeconds: seconds})
+	}
+	return entries, nil
+}
+
+// ParseJSON reads a time table as an array of entries.
+func ParseJSON(r io.Reader) ([]Entry, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	entries := []Entry{}
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Validate checks that the time table has at least two stops, that every
+// stop appears once and that the offsets start at 0 and increase strictly.
+func Validate(entries []Entry) error {
+	if len(entries) < 2 {
+		return errors.New("the time table must have at least two stops")
+	}
+	seen := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		if entry.BusStopId == "" || utf8.RuneCountInString(entry.BusStopId) > maxStopIdLength {
+			return fmt.Errorf("stop %d: bus_stop_id must have 1 to %d characters", i+1, maxStopIdLength)
+		}
+		if seen[entry.BusStopId] {
+			return fmt.Errorf("stop %d: bus stop %s is repeated", i+1, entry.BusStopId)
+		}
+		seen[entry.BusStopId] = true
+		if i == 0 && entry.TimeSeconds != 0 {
+			return errors.New("stop 1: time_seconds must be 0")
+		}
+		if i > 0 && entry.TimeSeconds <= entries[i-1].TimeSeconds {
+			return fmt.Errorf("stop %d: time_seconds must be greater than %d", i+1, entries[i-1].TimeSeconds)
+		}
+	}
+	return nil
+}
+
+// Compare returns the differences of the next time table from the current one.
+// The added and changed stops follow the next time table, the removed ones the current one.
+func Compare(current []Entry, next []Entry) Diff {
+	diff := Diff{Added: []Entry{}, Removed: []Entry{}, Changed: []Change{}}
+	currentTimes := make(map[string]int, len(current))
+	for _, entry := range current {
+		currentTimes[entry.BusStopId] = entry.TimeSeconds
+	}
+	nextStops := make(map[string]bool, len(next))
+	for _, entry := range next {
+		nextStops[entry.BusStopId] = true
+		previous, ok := currentTimes[entry.BusStopId]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, entry)
+		case previous != entry.TimeSeconds:
+			diff.Changed = append(diff.Changed, Change{BusStopId: entry.BusStopId, PreviousTimeSeconds: previous, TimeSeconds: entry.TimeSeconds})
+		default:
+			diff.Unchanged++
+		}
+	}
+	for _, entry := range current {
+		if !nextStops[entry.BusStopId] {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+	sort.SliceStable(diff.Removed, func(i, j int) bool {
+		return diff.Removed[i].TimeSeconds < diff.Removed[j].TimeSeconds
+	})
+	return diff
+}
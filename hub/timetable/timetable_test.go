@@ -0,0 +1,155 @@
+package timetable
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []Entry
+		wantErr string
+	}{
+		{
+			name: "header in order",
+			csv:  "bus_stop_id,time_seconds\n1,0\n2,55\n",
+			want: []Entry{{"1", 0}, {"2", 55}},
+		},
+		{
+			name: "byte order mark, other columns and spaces",
+			csv:  "\ufefftime_seconds, name ,bus_stop_id\n0,Tiburtina, 1\n 55 ,Cipro,2",
+			want: []Entry{{"1", 0}, {"2", 55}},
+		},
+		{
+			name: "CRLF line endings",
+			csv:  "bus_stop_id,time_seconds\r\n1,0\r\n2,55\r\n",
+			want: []Entry{{"1", 0}, {"2", 55}},
+		},
+		{
+			name: "header only",
+			csv:  "bus_stop_id,time_seconds\n",
+			want: []Entry{},
+		},
+		{name: "empty", csv: "", wantErr: "the CSV is empty"},
+		{name: "missing column", csv: "bus_stop_id,seconds\n1,0\n", wantErr: "the CSV header must name the columns bus_stop_id and time_seconds"},
+		{name: "short line", csv: "bus_stop_id,time_seconds\n1,0\n2\n", wantErr: "line 3: missing columns"},
+		{name: "time not an integer", csv: "bus_stop_id,time_seconds\n1,0\n2,5.5\n", wantErr: "line 3: time_seconds is not an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCSV(strings.NewReader(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseCSV() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCSV() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCSV() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    []Entry
+		wantErr bool
+	}{
+		{name: "entries", json: `[{"bus_stop_id": "1", "time_seconds": 0}, {"bus_stop_id": "2", "time_seconds": 55}]`, want: []Entry{{"1", 0}, {"2", 55}}},
+		{name: "empty array", json: `[]`, want: []Entry{}},
+		{name: "unknown field", json: `[{"bus_stop_id": "1", "time_seconds": 0, "name": "Tiburtina"}]`, wantErr: true},
+		{name: "not an array", json: `{"bus_stop_id": "1", "time_seconds": 0}`, wantErr: true},
+		{name: "string time", json: `[{"bus_stop_id": "1", "time_seconds": "0"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseJSON(strings.NewReader(tt.json))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ParseJSON() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseJSON() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		wantErr string
+	}{
+		{name: "valid", entries: []Entry{{"1", 0}, {"2", 55}, {"3", 75}}},
+		{name: "multi-byte stop id at the limit", entries: []Entry{{strings.Repeat("é", 36), 0}, {"2", 1}}},
+		{name: "no stop", entries: nil, wantErr: "the time table must have at least two stops"},
+		{name: "one stop", entries: []Entry{{"1", 0}}, wantErr: "the time table must have at least two stops"},
+		{name: "first offset not 0", entries: []Entry{{"1", 5}, {"2", 55}}, wantErr: "stop 1: time_seconds must be 0"},
+		{name: "decreasing offsets", entries: []Entry{{"1", 0}, {"2", 55}, {"3", 40}}, wantErr: "stop 3: time_seconds must be greater than 55"},
+		{name: "equal offsets", entries: []Entry{{"1", 0}, {"2", 55}, {"3", 55}}, wantErr: "stop 3: time_seconds must be greater than 55"},
+		{name: "negative offset", entries: []Entry{{"1", 0}, {"2", -5}}, wantErr: "stop 2: time_seconds must be greater than 0"},
+		{name: "repeated stop", entries: []Entry{{"1", 0}, {"2", 55}, {"1", 75}}, wantErr: "stop 3: bus stop 1 is repeated"},
+		{name: "empty stop id", entries: []Entry{{"1", 0}, {"", 55}}, wantErr: "stop 2: bus_stop_id must have 1 to 36 characters"},
+		{name: "stop id too long", entries: []Entry{{"1", 0}, {strings.Repeat("a", 37), 55}}, wantErr: "stop 2: bus_stop_id must have 1 to 36 characters"},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.entries)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: Validate() error = %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+			t.Errorf("%s: Validate() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []Entry
+		next    []Entry
+		want    Diff
+	}{
+		{
+			name: "no current time table",
+			next: []Entry{{"1", 0}, {"2", 55}},
+			want: Diff{Added: []Entry{{"1", 0}, {"2", 55}}, Removed: []Entry{}, Changed: []Change{}},
+		},
+		{
+			name:    "identical",
+			current: []Entry{{"1", 0}, {"2", 55}},
+			next:    []Entry{{"1", 0}, {"2", 55}},
+			want:    Diff{Added: []Entry{}, Removed: []Entry{}, Changed: []Change{}, Unchanged: 2},
+		},
+		{
+			name:    "added, removed and changed",
+			current: []Entry{{"1", 0}, {"4", 20}, {"2", 55}, {"3", 75}},
+			next:    []Entry{{"1", 0}, {"5", 30}, {"2", 60}},
+			want: Diff{
+				Added:     []Entry{{"5", 30}},
+				Removed:   []Entry{{"4", 20}, {"3", 75}},
+				Changed:   []Change{{BusStopId: "2", PreviousTimeSeconds: 55, TimeSeconds: 60}},
+				Unchanged: 1,
+			},
+		},
+		{
+			name:    "removed stops ordered by time",
+			current: []Entry{{"3", 75}, {"1", 0}, {"2", 55}},
+			next:    []Entry{{"1", 0}, {"9", 10}},
+			want:    Diff{Added: []Entry{{"9", 10}}, Removed: []Entry{{"2", 55}, {"3", 75}}, Changed: []Change{}, Unchanged: 1},
+		},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.current, tt.next); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Compare() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}